@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	kvcrutch "github.com/bbkane/kvcrutch/lib"
+	"github.com/bbkane/logos"
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// yamlErrLine splits yaml.v2's "line 3: field x not found" messages
+var yamlErrLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+func isAuthMode(mode string) bool {
+	for _, m := range kvcrutch.AuthModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// configKeys are config's top level YAML keys
+func configKeys() []string {
+	t := reflect.TypeOf(config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" {
+			// yaml.v2's default
+			key = strings.ToLower(t.Field(i).Name)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// checkEnvOverrides parses each override on its own so a mistake (like an
+// unknown key) is reported with the variable's name
+func checkEnvOverrides(envOverrides []kvcrutch.EnvOverride) kvcrutch.ValidationErrors {
+	var errs kvcrutch.ValidationErrors
+	for _, o := range envOverrides {
+		y, err := yaml.Marshal(o.Tree())
+		if err == nil {
+			err = yaml.UnmarshalStrict(y, &config{})
+		}
+		msgs := []string{fmt.Sprint(err)}
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			msgs = typeErr.Errors
+		} else if err == nil {
+			continue
+		}
+		for _, msg := range msgs {
+			if m := yamlErrLine.FindStringSubmatch(msg); m != nil {
+				msg = m[2]
+			}
+			// the anonymous struct types in config are unreadable
+			if i := strings.Index(msg, " in type struct"); i != -1 {
+				msg = msg[:i]
+			}
+			errs = append(errs, kvcrutch.ValidationError{Path: o.Name, Message: msg})
+		}
+	}
+	return errs
+}
+
+// validateConfig returns every problem it can find in configBytes with
+// envOverrides applied: unknown keys, references to vaults and templates
+// that don't exist, and certificate create parameters Key Vault would
+// reject. Problems with keys set by environment variables don't get line
+// numbers
+func validateConfig(configBytes []byte, envOverrides []kvcrutch.EnvOverride) kvcrutch.ValidationErrors {
+	var errs kvcrutch.ValidationErrors
+	add := func(path string, format string, args ...interface{}) {
+		errs = append(errs, kvcrutch.ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	cfg := config{}
+	err := yaml.UnmarshalStrict(configBytes, &cfg)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// the rest of the config is still decoded, so keep checking
+		for _, e := range typeErr.Errors {
+			ve := kvcrutch.ValidationError{Message: e}
+			if m := yamlErrLine.FindStringSubmatch(e); m != nil {
+				ve.Line, _ = strconv.Atoi(m[1])
+				ve.Message = m[2]
+			}
+			errs = append(errs, ve)
+		}
+	} else if err != nil {
+		return kvcrutch.ValidationErrors{{Message: err.Error()}}
+	}
+
+	if len(envOverrides) > 0 {
+		envErrs := checkEnvOverrides(envOverrides)
+		if len(envErrs) > 0 {
+			// the merged config would fail to parse for the same reasons
+			return append(errs, envErrs...)
+		}
+		merged, err := kvcrutch.ApplyEnvOverrides(configBytes, envOverrides)
+		if err != nil {
+			return append(errs, kvcrutch.ValidationError{Message: err.Error()})
+		}
+		cfg = config{}
+		// problems were reported above
+		_ = yaml.Unmarshal(merged, &cfg)
+	}
+
+	if cfg.VaultURL != "" || cfg.VaultName != "" {
+		_, err = kvcrutch.BuildVaultURL(cfg.VaultURL, cfg.VaultName, cfg.VaultDNSSuffix)
+		if err != nil {
+			path := "vault_name"
+			if cfg.VaultURL != "" {
+				path = "vault_url"
+			}
+			add(path, "%s", err)
+		}
+	}
+
+	if cfg.CABundlePath != "" {
+		caBundlePath, err := homedir.Expand(cfg.CABundlePath)
+		if err == nil {
+			_, err = kvcrutch.NewTLSConfig(caBundlePath)
+		}
+		if err != nil {
+			add("ca_bundle_path", "%s", errors.Cause(err))
+		}
+	}
+
+	if cfg.Auth.Mode != "" && !isAuthMode(cfg.Auth.Mode) {
+		add("auth.mode", "unknown auth mode %#v. Valid modes: %v", cfg.Auth.Mode, kvcrutch.AuthModes)
+	}
+	if cfg.Auth.CertificatePath != "" {
+		certPath, err := homedir.Expand(cfg.Auth.CertificatePath)
+		if err == nil {
+			_, err = os.Stat(certPath)
+		}
+		if err != nil {
+			add("auth.certificate_path", "%s", errors.Cause(err))
+		}
+	}
+
+	aliases := make([]string, 0, len(cfg.Vaults))
+	for alias := range cfg.Vaults {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		cfgVault := cfg.Vaults[alias]
+		path := "vaults." + alias
+		_, err = kvcrutch.NewVaultTarget(alias, cfgVault, cfg.VaultDNSSuffix)
+		if err != nil {
+			add(path, "%s", errors.Cause(err))
+		}
+		if cfgVault.AuthMode != "" && !isAuthMode(cfgVault.AuthMode) {
+			add(path+".auth_mode", "unknown auth mode %#v. Valid modes: %v", cfgVault.AuthMode, kvcrutch.AuthModes)
+		}
+		if t := cfgVault.CertificateTemplate; t != "" {
+			if _, exists := cfg.CertificateTemplates[t]; !exists {
+				add(path+".certificate_template", "no certificate template named %#v", t)
+			}
+		}
+	}
+	if cfg.DefaultVault != "" {
+		if _, exists := cfg.Vaults[cfg.DefaultVault]; !exists {
+			add("default_vault", "no vault with alias %#v in the vaults section", cfg.DefaultVault)
+		}
+	}
+
+	if cfg.Exporter.Interval != "" {
+		interval, err := kvcrutch.ParseDuration(cfg.Exporter.Interval)
+		if err != nil {
+			add("exporter.interval", "%s", errors.Cause(err))
+		} else if interval <= 0 {
+			add("exporter.interval", "must be positive: %s", interval)
+		}
+	}
+	for i, ref := range cfg.Exporter.Vaults {
+		_, err = kvcrutch.ResolveVaultRef(cfg.Vaults, ref, cfg.VaultDNSSuffix)
+		if err != nil {
+			add("exporter.vaults."+strconv.Itoa(i), "%s", errors.Cause(err))
+		}
+	}
+
+	// only check certificate_create_parameters if it's there - a config
+	// might only use templates
+	top := map[string]interface{}{}
+	_ = yaml.Unmarshal(configBytes, &top)
+	_, hasCCP := top["certificate_create_parameters"]
+	for _, o := range envOverrides {
+		hasCCP = hasCCP || o.Path[0] == "certificate_create_parameters"
+	}
+	if hasCCP {
+		params := kvcrutch.CreateKVCertCreateParamsFromCfg(cfg.CertificateCreateParameters)
+		errs = append(errs, kvcrutch.ValidateCertificateCreateParameters(params).Prefix("certificate_create_parameters")...)
+	}
+	errs = append(errs, cfg.CertificateTemplates.Validate(configBytes, cfg.CertificateCreateParameters)...)
+
+	// keys set by the environment aren't on a line of the file
+	var fileErrs kvcrutch.ValidationErrors
+	var envErrs kvcrutch.ValidationErrors
+	for _, e := range errs {
+		if o, exists := kvcrutch.EnvOverrideFor(envOverrides, e.Path); exists {
+			e.Line = 0
+			e.Message += " (set by " + o.Name + ")"
+			envErrs = append(envErrs, e)
+		} else {
+			fileErrs = append(fileErrs, e)
+		}
+	}
+	errs = append(envErrs, fileErrs.WithLines(configBytes)...)
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Line < errs[j].Line
+	})
+	return errs
+}
+
+// certificateCreateParams returns the config `certificate create` starts
+// from and the template it came from, if any. templateName (--template)
+// beats the vault's certificate_template, which beats
+// certificate_create_parameters
+func certificateCreateParams(cfg *config, templateName string, vaultAlias string) (kvcrutch.CfgCertificateCreateParameters, string, error) {
+	if templateName == "" && vaultAlias != "" {
+		templateName = cfg.Vaults[vaultAlias].CertificateTemplate
+	}
+	if templateName == "" {
+		return cfg.CertificateCreateParameters, "", nil
+	}
+	params, err := cfg.CertificateTemplates.Resolve(templateName, cfg.CertificateCreateParameters)
+	return params, templateName, err
+}
+
+type effectiveVault struct {
+	Alias    string `json:"alias,omitempty"`
+	URL      string `json:"url"`
+	AuthMode string `json:"auth_mode"`
+}
+
+type effectiveAuth struct {
+	TenantID        string `json:"tenant_id,omitempty"`
+	ClientID        string `json:"client_id,omitempty"`
+	CertificatePath string `json:"certificate_path,omitempty"`
+	AADEndpoint     string `json:"aad_endpoint,omitempty"`
+}
+
+type effectiveExporter struct {
+	LabelTags []string `json:"label_tags"`
+	Interval  string   `json:"interval"`
+}
+
+// effectiveConfig is what commands actually use after the config file,
+// environment and flags are merged
+type effectiveConfig struct {
+	ConfigPath string `json:"config_path"`
+	// Env are the KVCRUTCH_ variables that set config keys
+	Env          []string          `json:"env,omitempty"`
+	LogFile      string            `json:"log_file,omitempty"`
+	Timeout      string            `json:"timeout"`
+	CABundlePath string            `json:"ca_bundle_path,omitempty"`
+	Vaults       []effectiveVault  `json:"vaults"`
+	Auth         effectiveAuth     `json:"auth"`
+	Exporter     effectiveExporter `json:"exporter"`
+	// CertificateTemplate is blank if certificate_create_parameters is used
+	CertificateTemplate string `json:"certificate_template,omitempty"`
+	// CertificateCreateParameters are sent as is by `certificate create`
+	// without flags
+	CertificateCreateParameters keyvault.CertificateCreateParameters `json:"certificate_create_parameters"`
+}
+
+func newEffectiveConfig(
+	cfg *config,
+	configPath string,
+	envOverrides []kvcrutch.EnvOverride,
+	targets []kvcrutch.VaultTarget,
+	authModeOverride string,
+	caBundlePath string,
+	timeout time.Duration,
+	templateName string,
+) (effectiveConfig, error) {
+	cfgAuth := cfg.Auth.WithEnv()
+	ec := effectiveConfig{
+		ConfigPath:   configPath,
+		Timeout:      timeout.String(),
+		CABundlePath: caBundlePath,
+		Auth: effectiveAuth{
+			TenantID:        cfgAuth.TenantID,
+			ClientID:        cfgAuth.ClientID,
+			CertificatePath: cfgAuth.CertificatePath,
+			AADEndpoint:     cfgAuth.AADEndpoint,
+		},
+		Exporter: effectiveExporter{
+			LabelTags: cfg.Exporter.LabelTags,
+			Interval:  cfg.Exporter.Interval,
+		},
+	}
+	for _, o := range envOverrides {
+		ec.Env = append(ec.Env, o.Name)
+	}
+	if cfg.LumberjackLogger != nil {
+		ec.LogFile = cfg.LumberjackLogger.Filename
+	}
+	if ec.Exporter.Interval == "" {
+		ec.Exporter.Interval = kvcrutch.DefaultExporterInterval
+	}
+	for _, t := range targets {
+		ec.Vaults = append(ec.Vaults, effectiveVault{
+			Alias:    t.Alias,
+			URL:      t.URL.String(),
+			AuthMode: t.ResolveAuthMode(authModeOverride, cfg.Auth.Mode),
+		})
+	}
+
+	alias := ""
+	if len(targets) > 0 {
+		alias = targets[0].Alias
+	}
+	cfgCertCreateParams, templateName, err := certificateCreateParams(cfg, templateName, alias)
+	if err != nil {
+		return ec, err
+	}
+	ec.CertificateTemplate = templateName
+	ec.CertificateCreateParameters = kvcrutch.BuildCertificateCreateParameters(
+		cfgCertCreateParams,
+		kvcrutch.FlagCertificateCreateParameters{},
+	)
+	return ec, nil
+}
+
+// configShow prints cfg, or with effective, what commands use after the
+// vault, auth mode, CA bundle and template flags are applied. Both are
+// YAML; the effective certificate create parameters use the REST API's
+// JSON names, since that's what's sent
+func configShow(
+	cfg *config,
+	configPath string,
+	envOverrides []kvcrutch.EnvOverride,
+	effective bool,
+	vf vaultFlags,
+	authModeOverride string,
+	caBundleFlag string,
+	timeout time.Duration,
+	templateName string,
+) error {
+	if !effective {
+		if templateName != "" {
+			err := errors.New("--template needs --effective")
+			logos.Errorw(
+				"flag error",
+				"err", err,
+			)
+			return err
+		}
+		y, err := yaml.Marshal(cfg)
+		if err != nil {
+			err = errors.WithStack(err)
+			logos.Errorw(
+				"Can't print config",
+				"err", err,
+			)
+			return err
+		}
+		_, err = os.Stdout.Write(y)
+		return errors.WithStack(err)
+	}
+
+	targets, err := selectVaultTargets(cfg, vf, false, nil)
+	if err != nil {
+		logos.Errorw(
+			"can't pick a vault. Pass --vault, --vault-name or --vault-url, or set default_vault in the config",
+			"err", err,
+		)
+		return err
+	}
+	caBundlePath := cfg.CABundlePath
+	if caBundleFlag != "" {
+		caBundlePath = caBundleFlag
+	}
+	ec, err := newEffectiveConfig(cfg, configPath, envOverrides, targets, authModeOverride, caBundlePath, timeout, templateName)
+	if err != nil {
+		logos.Errorw(
+			"can't use certificate template",
+			"template", templateName,
+			"err", err,
+		)
+		return err
+	}
+	return kvcrutch.WriteData(os.Stdout, ec, kvcrutch.OutputYAML)
+}
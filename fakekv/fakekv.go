@@ -0,0 +1,686 @@
+// Package fakekv is an in-memory fake of the Azure Key Vault certificate
+// data-plane REST API (api-version 2016-10-01), plus reading the secrets
+// backing certificates. It's meant for running
+// kvcrutch without Azure access: serve a Server with net/http (or
+// net/http/httptest) and point kvcrutch's vault URL at it.
+//
+// Only the parts of the API kvcrutch uses are implemented, authorization
+// headers are ignored, and everything is lost when the process exits.
+package fakekv
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/pkg/errors"
+)
+
+// DefaultPageSize is the page size Key Vault uses when maxresults isn't passed
+const DefaultPageSize = 25
+
+// IssuerUnknown is the reserved issuer name for certificates whose CSR is
+// signed outside of Key Vault. Creating one leaves an operation pending
+// until it's merged.
+const IssuerUnknown = "Unknown"
+
+var certNameRe = regexp.MustCompile(`^[0-9a-zA-Z-]{1,127}$`)
+
+// Server is an http.Handler serving the fake Key Vault API.
+// Use New to create one.
+type Server struct {
+	mu       sync.Mutex
+	pageSize int
+	// issueDelay keeps operations for issuers other than Self in progress
+	// this long, like a real CA
+	issueDelay time.Duration
+	// certs is keyed by lower-cased name - Key Vault names are case
+	// insensitive
+	certs map[string]*certificate
+}
+
+type certificate struct {
+	name     string
+	versions []*version
+	pending  *operation
+}
+
+type version struct {
+	id         string
+	policy     keyvault.CertificatePolicy
+	enabled    bool
+	notBefore  time.Time
+	expires    time.Time
+	created    time.Time
+	updated    time.Time
+	tags       map[string]string
+	cer        []byte
+	privateKey crypto.Signer
+	// chain is the merged or imported CA certificates, DER encoded
+	chain [][]byte
+}
+
+type operation struct {
+	issuerName            string
+	csr                   []byte
+	privateKey            crypto.Signer
+	cancellationRequested bool
+	status                string
+	statusDetails         string
+	requestID             string
+	params                keyvault.CertificateCreateParameters
+	// issueAt is when an operation waiting on issueDelay completes
+	issueAt time.Time
+}
+
+// New creates an empty Server. pageSize limits how many items are returned
+// per list page; pass 0 for DefaultPageSize.
+func New(pageSize int) *Server {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	return &Server{
+		pageSize: pageSize,
+		certs:    make(map[string]*certificate),
+	}
+}
+
+// SetIssueDelay makes operations for issuers other than Self (and
+// IssuerUnknown, which waits for a merge) stay in progress for d before the
+// certificate is issued
+func (s *Server) SetIssueDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.issueDelay = d
+}
+
+// ServeHTTP routes Key Vault certificate API requests
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// /certificates/{name}/{version} with a blank version has a trailing slash
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) > 1 && parts[0] == "secrets" && r.Method == http.MethodGet {
+		version := ""
+		if len(parts) == 3 {
+			version = parts[2]
+		}
+		s.getSecret(w, r, parts[1], version)
+		return
+	}
+	if len(parts) == 0 || parts[0] != "certificates" {
+		writeError(w, http.StatusNotFound, "NotFound", "unknown path: "+r.URL.Path)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.listCertificates(w, r)
+	case len(parts) == 3 && parts[2] == "create" && r.Method == http.MethodPost:
+		s.createCertificate(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "import" && r.Method == http.MethodPost:
+		s.importCertificate(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "versions" && r.Method == http.MethodGet:
+		s.listVersions(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "pending" && r.Method == http.MethodGet:
+		s.getOperation(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "pending" && r.Method == http.MethodPatch:
+		s.updateOperation(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "pending" && r.Method == http.MethodDelete:
+		s.deleteOperation(w, r, parts[1])
+	case len(parts) == 4 && parts[2] == "pending" && parts[3] == "merge" && r.Method == http.MethodPost:
+		s.mergeCertificate(w, r, parts[1])
+	case len(parts) == 3 && parts[2] == "policy" && r.Method == http.MethodGet:
+		s.getPolicy(w, r, parts[1])
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		s.getCertificate(w, r, parts[1], "")
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		s.getCertificate(w, r, parts[1], parts[2])
+	default:
+		writeError(w, http.StatusBadRequest, "BadParameter", "unsupported request: "+r.Method+" "+r.URL.Path)
+	}
+}
+
+func (s *Server) createCertificate(w http.ResponseWriter, r *http.Request, name string) {
+	if !certNameRe.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "BadParameter", "invalid certificate name: "+name)
+		return
+	}
+
+	params := keyvault.CertificateCreateParameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", "can't decode request body: "+err.Error())
+		return
+	}
+	if params.CertificatePolicy == nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", "policy is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists {
+		cert = &certificate{name: name}
+	}
+	if cert.pending != nil && cert.pending.status == "inProgress" {
+		writeError(w, http.StatusConflict, "Conflict", "there is already a pending operation for certificate: "+name)
+		return
+	}
+
+	op, err := s.startOperation(cert, params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+	cert.pending = op
+	s.certs[strings.ToLower(name)] = cert
+
+	writeJSON(w, http.StatusAccepted, operationToJSON(baseURL(r), cert.name, op))
+}
+
+// startOperation makes a new key and either issues a self-signed
+// certificate right away (for any issuer but IssuerUnknown - the fake acts
+// as every CA) or leaves the CSR pending
+func (s *Server) startOperation(cert *certificate, params keyvault.CertificateCreateParameters) (*operation, error) {
+	policy := *params.CertificatePolicy
+	key, err := newKey(policy.KeyProperties)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := parseSubject(strPtrValue(subjectPtr(policy)))
+	if err != nil {
+		return nil, err
+	}
+	csr, err := newCSR(key, subject, dnsNames(policy))
+	if err != nil {
+		return nil, err
+	}
+
+	op := &operation{
+		issuerName: issuerName(policy),
+		csr:        csr,
+		privateKey: key,
+		requestID:  newID(),
+		params:     params,
+	}
+
+	if op.issuerName == IssuerUnknown {
+		op.status = "inProgress"
+		op.statusDetails = "Pending certificate created. Please Perform Merge to complete the request."
+		return op, nil
+	}
+	if s.issueDelay > 0 && op.issuerName != "Self" {
+		op.status = "inProgress"
+		op.statusDetails = "Pending certificate created. Certificate request is in progress. This may take some time based on the issuer provider. Please check again later."
+		op.issueAt = time.Now().Add(s.issueDelay)
+		return op, nil
+	}
+
+	err = issue(cert, op)
+	if err != nil {
+		return nil, err
+	}
+	return op, nil
+}
+
+// issue signs op's CSR (the fake acts as every CA) and completes op
+func issue(cert *certificate, op *operation) error {
+	policy := *op.params.CertificatePolicy
+	subject, err := parseSubject(strPtrValue(subjectPtr(policy)))
+	if err != nil {
+		return err
+	}
+	cer, err := selfSign(op.privateKey, subject, dnsNames(policy), validityInMonths(policy))
+	if err != nil {
+		return err
+	}
+	err = cert.addVersion(op.params, op.privateKey, cer)
+	if err != nil {
+		return err
+	}
+	op.status = "completed"
+	op.statusDetails = ""
+	op.issueAt = time.Time{}
+	return nil
+}
+
+// advance issues certificates whose operations are past their issueAt.
+// Callers must hold s.mu
+func (s *Server) advance() {
+	now := time.Now()
+	for _, cert := range s.certs {
+		op := cert.pending
+		if op == nil || op.status != "inProgress" || op.issueAt.IsZero() || now.Before(op.issueAt) {
+			continue
+		}
+		err := issue(cert, op)
+		if err != nil {
+			op.status = "failed"
+			op.statusDetails = err.Error()
+		}
+	}
+}
+
+// addVersion appends a new issued version of a certificate
+func (c *certificate) addVersion(params keyvault.CertificateCreateParameters, key crypto.Signer, cer []byte) error {
+	parsed, err := parseCertificate(cer)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	enabled := true
+	if params.CertificateAttributes != nil && params.CertificateAttributes.Enabled != nil {
+		enabled = *params.CertificateAttributes.Enabled
+	}
+	tags := make(map[string]string)
+	for k, v := range params.Tags {
+		if v != nil {
+			tags[k] = *v
+		}
+	}
+	policy := keyvault.CertificatePolicy{}
+	if params.CertificatePolicy != nil {
+		policy = *params.CertificatePolicy
+	}
+	c.versions = append(c.versions, &version{
+		id:         newID(),
+		policy:     policy,
+		enabled:    enabled,
+		notBefore:  parsed.NotBefore,
+		expires:    parsed.NotAfter,
+		created:    now,
+		updated:    now,
+		tags:       tags,
+		cer:        cer,
+		privateKey: key,
+	})
+	return nil
+}
+
+func (s *Server) getCertificate(w http.ResponseWriter, r *http.Request, name string, versionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, v, ok := s.lookup(w, name, versionID)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, bundleToJSON(baseURL(r), cert.name, v))
+}
+
+func (s *Server) getPolicy(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	_, v, ok := s.lookup(w, name, "")
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, v.policy)
+}
+
+func (s *Server) getOperation(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists || cert.pending == nil {
+		writeError(w, http.StatusNotFound, "PendingCertificateNotFound", "Pending certificate not found: "+name)
+		return
+	}
+	writeJSON(w, http.StatusOK, operationToJSON(baseURL(r), cert.name, cert.pending))
+}
+
+// updateOperation requests cancellation. The fake cancels in progress
+// operations right away; finished ones are left alone
+func (s *Server) updateOperation(w http.ResponseWriter, r *http.Request, name string) {
+	update := keyvault.CertificateOperationUpdateParameter{}
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", "can't decode request body: "+err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists || cert.pending == nil {
+		writeError(w, http.StatusNotFound, "PendingCertificateNotFound", "Pending certificate not found: "+name)
+		return
+	}
+	op := cert.pending
+	if update.CancellationRequested != nil && *update.CancellationRequested {
+		op.cancellationRequested = true
+		if op.status == "inProgress" {
+			op.status = "cancelled"
+			op.statusDetails = "Certificate request cancelled."
+			op.issueAt = time.Time{}
+		}
+	}
+	writeJSON(w, http.StatusOK, operationToJSON(baseURL(r), cert.name, op))
+}
+
+// deleteOperation forgets the operation, stopping it if it's in progress
+func (s *Server) deleteOperation(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists || cert.pending == nil {
+		writeError(w, http.StatusNotFound, "PendingCertificateNotFound", "Pending certificate not found: "+name)
+		return
+	}
+	op := cert.pending
+	cert.pending = nil
+	if len(cert.versions) == 0 {
+		delete(s.certs, strings.ToLower(name))
+	}
+	writeJSON(w, http.StatusOK, operationToJSON(baseURL(r), cert.name, op))
+}
+
+// mergeCertificate completes an IssuerUnknown operation with a certificate
+// signed outside of Key Vault. The fake only keeps the leaf certificate
+func (s *Server) mergeCertificate(w http.ResponseWriter, r *http.Request, name string) {
+	merge := keyvault.CertificateMergeParameters{}
+	err := json.NewDecoder(r.Body).Decode(&merge)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", "can't decode request body: "+err.Error())
+		return
+	}
+	if merge.X509Certificates == nil || len(*merge.X509Certificates) == 0 {
+		writeError(w, http.StatusBadRequest, "BadParameter", "x5c is required")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists || cert.pending == nil {
+		writeError(w, http.StatusNotFound, "PendingCertificateNotFound", "Pending certificate not found: "+name)
+		return
+	}
+	op := cert.pending
+	if op.issuerName != IssuerUnknown || op.status != "inProgress" {
+		writeError(w, http.StatusForbidden, "Forbidden", "Only in progress operations for the "+IssuerUnknown+" issuer can be merged: "+name)
+		return
+	}
+	leaf := (*merge.X509Certificates)[0]
+	parsed, err := parseCertificate(leaf)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", "can't parse x5c[0]: "+err.Error())
+		return
+	}
+	if !samePublicKey(parsed.PublicKey, op.privateKey.Public()) {
+		writeError(w, http.StatusBadRequest, "BadParameter", "Public key from x509 certificate and key of this instance doesn't match")
+		return
+	}
+
+	params := op.params
+	if merge.CertificateAttributes != nil {
+		params.CertificateAttributes = merge.CertificateAttributes
+	}
+	if merge.Tags != nil {
+		params.Tags = merge.Tags
+	}
+	err = cert.addVersion(params, op.privateKey, leaf)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+	latest := cert.versions[len(cert.versions)-1]
+	latest.chain = (*merge.X509Certificates)[1:]
+	op.status = "completed"
+	op.statusDetails = ""
+	writeJSON(w, http.StatusCreated, bundleToJSON(baseURL(r), cert.name, cert.versions[len(cert.versions)-1]))
+}
+
+// importCertificate adds a version from a PKCS #12 (base64) or PEM
+// certificate with its private key. The policy's content type says which
+func (s *Server) importCertificate(w http.ResponseWriter, r *http.Request, name string) {
+	if !certNameRe.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "BadParameter", "invalid certificate name: "+name)
+		return
+	}
+
+	params := keyvault.CertificateImportParameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", "can't decode request body: "+err.Error())
+		return
+	}
+	policy := keyvault.CertificatePolicy{}
+	if params.CertificatePolicy != nil {
+		policy = *params.CertificatePolicy
+	}
+	contentType := contentTypePKCS12
+	if policy.SecretProperties != nil && policy.SecretProperties.ContentType != nil && *policy.SecretProperties.ContentType != "" {
+		contentType = *policy.SecretProperties.ContentType
+	}
+	password := ""
+	if params.Password != nil {
+		password = *params.Password
+	}
+	key, cer, chain, err := decodeImport(contentType, strPtrValue(params.Base64EncodedCertificate), password)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+	if policy.IssuerParameters == nil {
+		unknown := IssuerUnknown
+		policy.IssuerParameters = &keyvault.IssuerParameters{Name: &unknown}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists {
+		cert = &certificate{name: name}
+	}
+	err = cert.addVersion(
+		keyvault.CertificateCreateParameters{
+			CertificatePolicy:     &policy,
+			CertificateAttributes: params.CertificateAttributes,
+			Tags:                  params.Tags,
+		},
+		key,
+		cer,
+	)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadParameter", err.Error())
+		return
+	}
+	s.certs[strings.ToLower(name)] = cert
+	latest := cert.versions[len(cert.versions)-1]
+	latest.chain = chain
+	writeJSON(w, http.StatusOK, bundleToJSON(baseURL(r), cert.name, latest))
+}
+
+// getSecret returns the secret backing a certificate version: its key and
+// certificates as PKCS #12 or PEM, depending on the policy's content type.
+// Like Key Vault, it's forbidden for non-exportable keys
+func (s *Server) getSecret(w http.ResponseWriter, r *http.Request, name string, versionID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, v, ok := s.lookup(w, name, versionID)
+	if !ok {
+		return
+	}
+	kp := v.policy.KeyProperties
+	if kp == nil || kp.Exportable == nil || !*kp.Exportable {
+		writeError(w, http.StatusForbidden, "Forbidden", "Operation get is not allowed on a non-exportable certificate: "+name)
+		return
+	}
+	secret, err := secretToJSON(baseURL(r), cert.name, v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, secret)
+}
+
+// lookup finds a certificate version, writing a 404 if it can't. A blank
+// versionID means the latest version.
+func (s *Server) lookup(w http.ResponseWriter, name string, versionID string) (*certificate, *version, bool) {
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists || len(cert.versions) == 0 {
+		writeError(w, http.StatusNotFound, "CertificateNotFound", "A certificate with (name/id) "+name+" was not found in this key vault.")
+		return nil, nil, false
+	}
+	if versionID == "" {
+		return cert, cert.versions[len(cert.versions)-1], true
+	}
+	for _, v := range cert.versions {
+		if strings.EqualFold(v.id, versionID) {
+			return cert, v, true
+		}
+	}
+	writeError(w, http.StatusNotFound, "CertificateNotFound", "A certificate with (name/id) "+name+"/"+versionID+" was not found in this key vault.")
+	return nil, nil, false
+}
+
+func (s *Server) listCertificates(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	names := make([]string, 0, len(s.certs))
+	for k, cert := range s.certs {
+		if len(cert.versions) > 0 {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	base := baseURL(r)
+	items := make([]itemJSON, 0, len(names))
+	for _, k := range names {
+		cert := s.certs[k]
+		latest := cert.versions[len(cert.versions)-1]
+		items = append(items, itemToJSON(base+"/certificates/"+cert.name, latest))
+	}
+	s.writePage(w, r, items)
+}
+
+func (s *Server) listVersions(w http.ResponseWriter, r *http.Request, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	cert, exists := s.certs[strings.ToLower(name)]
+	if !exists || len(cert.versions) == 0 {
+		writeError(w, http.StatusNotFound, "CertificateNotFound", "A certificate with (name/id) "+name+" was not found in this key vault.")
+		return
+	}
+	base := baseURL(r)
+	items := make([]itemJSON, 0, len(cert.versions))
+	for _, v := range cert.versions {
+		items = append(items, itemToJSON(base+"/certificates/"+cert.name+"/"+v.id, v))
+	}
+	s.writePage(w, r, items)
+}
+
+// writePage writes one page of items, starting at $skiptoken, and adds a
+// nextLink if there are more
+func (s *Server) writePage(w http.ResponseWriter, r *http.Request, items []itemJSON) {
+	query := r.URL.Query()
+	pageSize := s.pageSize
+	if mr := query.Get("maxresults"); mr != "" {
+		n, err := strconv.Atoi(mr)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, "BadParameter", "invalid maxresults: "+mr)
+			return
+		}
+		if n < pageSize {
+			pageSize = n
+		}
+	}
+	start := 0
+	if st := query.Get("$skiptoken"); st != "" {
+		n, err := strconv.Atoi(st)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "BadParameter", "invalid $skiptoken: "+st)
+			return
+		}
+		start = n
+	}
+	if start > len(items) {
+		start = len(items)
+	}
+	end := start + pageSize
+	if end > len(items) {
+		end = len(items)
+	}
+
+	page := listJSON{Value: items[start:end]}
+	if end < len(items) {
+		next := url.Values{}
+		next.Set("api-version", query.Get("api-version"))
+		next.Set("$skiptoken", strconv.Itoa(end))
+		if mr := query.Get("maxresults"); mr != "" {
+			next.Set("maxresults", mr)
+		}
+		page.NextLink = baseURL(r) + r.URL.Path + "?" + next.Encode()
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// baseURL is the vault URL as the client sees it, used to build ids and
+// nextLinks
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(errors.WithStack(err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	body, _ := json.Marshal(errorResponseJSON{Error: errorJSON{Code: code, Message: message}})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,339 @@
+package fakekv
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// newKey makes a key matching the policy's key properties. Missing
+// properties get Key Vault's defaults (RSA 2048)
+func newKey(kp *keyvault.KeyProperties) (crypto.Signer, error) {
+	keyType := "RSA"
+	var keySize int32
+	if kp != nil && kp.KeyType != nil && *kp.KeyType != "" {
+		keyType = *kp.KeyType
+	}
+	if kp != nil && kp.KeySize != nil {
+		keySize = *kp.KeySize
+	}
+
+	switch keyType {
+	case "RSA", "RSA-HSM":
+		if keySize == 0 {
+			keySize = 2048
+		}
+		if keySize != 2048 && keySize != 3072 && keySize != 4096 {
+			return nil, errors.Errorf("unsupported RSA key size: %d", keySize)
+		}
+		key, err := rsa.GenerateKey(rand.Reader, int(keySize))
+		return key, errors.WithStack(err)
+	case "EC", "EC-HSM":
+		var curve elliptic.Curve
+		switch keySize {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported EC key size: %d", keySize)
+		}
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		return key, errors.WithStack(err)
+	default:
+		return nil, errors.Errorf("unsupported key type: %#v", keyType)
+	}
+}
+
+// parseSubject parses simple comma separated distinguished names like
+// "CN=example.com, O=Example". It's not a full RFC 4514 parser
+func parseSubject(subject string) (pkix.Name, error) {
+	name := pkix.Name{}
+	if strings.TrimSpace(subject) == "" {
+		return name, errors.New("subject is required")
+	}
+	for _, rdn := range strings.Split(subject, ",") {
+		kv := strings.SplitN(rdn, "=", 2)
+		if len(kv) != 2 {
+			return name, errors.Errorf("invalid subject component: %#v", rdn)
+		}
+		key := strings.ToUpper(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+		switch key {
+		case "CN":
+			name.CommonName = value
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		case "ST", "S":
+			name.Province = append(name.Province, value)
+		case "C":
+			name.Country = append(name.Country, value)
+		case "STREET":
+			name.StreetAddress = append(name.StreetAddress, value)
+		case "POSTALCODE":
+			name.PostalCode = append(name.PostalCode, value)
+		case "SERIALNUMBER":
+			name.SerialNumber = value
+		default:
+			return name, errors.Errorf("unsupported subject attribute: %#v", key)
+		}
+	}
+	return name, nil
+}
+
+func newCSR(key crypto.Signer, subject pkix.Name, sans []string) ([]byte, error) {
+	csr, err := x509.CreateCertificateRequest(
+		rand.Reader,
+		&x509.CertificateRequest{
+			Subject:  subject,
+			DNSNames: sans,
+		},
+		key,
+	)
+	return csr, errors.WithStack(err)
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial, errors.WithStack(err)
+}
+
+// selfSign issues a self-signed certificate, returning its DER bytes
+func selfSign(key crypto.Signer, subject pkix.Name, sans []string, validityInMonths int) ([]byte, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		DNSNames:              sans,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(0, validityInMonths, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	return der, errors.WithStack(err)
+}
+
+// samePublicKey compares public keys by their PKIX encoding
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(aDER, bDER)
+}
+
+// secret content types
+const (
+	contentTypePKCS12 = "application/x-pkcs12"
+	contentTypePEM    = "application/x-pem-file"
+)
+
+// encodePKCS12 encodes a key and certificates without a password
+func encodePKCS12(key crypto.Signer, cer []byte, chain [][]byte) ([]byte, error) {
+	leaf, err := parseCertificate(cer)
+	if err != nil {
+		return nil, err
+	}
+	var caCerts []*x509.Certificate
+	for _, der := range chain {
+		c, err := parseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		caCerts = append(caCerts, c)
+	}
+	pfx, err := pkcs12.Encode(rand.Reader, key, leaf, caCerts, "")
+	return pfx, errors.WithStack(err)
+}
+
+// encodePEM encodes a PKCS #8 key followed by the certificates
+func encodePEM(key crypto.Signer, cer []byte, chain [][]byte) ([]byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ret := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	for _, der := range append([][]byte{cer}, chain...) {
+		ret = append(ret, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return ret, nil
+}
+
+// decodeImport decodes an imported certificate's key, certificate (DER) and
+// chain (DER). PKCS #12 values are base64 encoded
+func decodeImport(contentType string, value string, password string) (crypto.Signer, []byte, [][]byte, error) {
+	var key interface{}
+	var certs []*x509.Certificate
+	switch contentType {
+	case contentTypePKCS12:
+		pfx, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "value isn't base64")
+		}
+		var leaf *x509.Certificate
+		var caCerts []*x509.Certificate
+		key, leaf, caCerts, err = pkcs12.DecodeChain(pfx, password)
+		if err != nil {
+			return nil, nil, nil, errors.Wrap(err, "can't decode PKCS #12")
+		}
+		certs = append([]*x509.Certificate{leaf}, caCerts...)
+	case contentTypePEM:
+		rest := []byte(value)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			var err error
+			switch block.Type {
+			case "CERTIFICATE":
+				var c *x509.Certificate
+				c, err = parseCertificate(block.Bytes)
+				certs = append(certs, c)
+			case "PRIVATE KEY":
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			case "RSA PRIVATE KEY":
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			case "EC PRIVATE KEY":
+				key, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+			if err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "can't parse %s", block.Type)
+			}
+		}
+	default:
+		return nil, nil, nil, errors.Errorf("unsupported content type: %#v", contentType)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, nil, errors.New("the certificate needs a private key")
+	}
+	if len(certs) == 0 {
+		return nil, nil, nil, errors.New("no certificate found")
+	}
+	// the leaf is the one matching the key
+	var cer []byte
+	var chain [][]byte
+	for _, c := range certs {
+		if cer == nil && samePublicKey(c.PublicKey, signer.Public()) {
+			cer = c.Raw
+		} else {
+			chain = append(chain, c.Raw)
+		}
+	}
+	if cer == nil {
+		return nil, nil, nil, errors.New("Private key specified in the certificate content doesn't match any certificate")
+	}
+	return signer, cer, chain, nil
+}
+
+func parseCertificate(der []byte) (*x509.Certificate, error) {
+	cert, err := x509.ParseCertificate(der)
+	return cert, errors.WithStack(err)
+}
+
+// NewTLSCertificate makes a self-signed certificate to serve the fake over
+// HTTPS. hosts may be DNS names or IP addresses. The returned PEM is the
+// certificate clients need to trust.
+func NewTLSCertificate(hosts []string) (tls.Certificate, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, errors.WithStack(err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	now := time.Now().UTC()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "kvcrutch fake-server"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, nil, errors.WithStack(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, certPEM, nil
+}
+
+func strPtrValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func subjectPtr(p keyvault.CertificatePolicy) *string {
+	if p.X509CertificateProperties == nil {
+		return nil
+	}
+	return p.X509CertificateProperties.Subject
+}
+
+func dnsNames(p keyvault.CertificatePolicy) []string {
+	x := p.X509CertificateProperties
+	if x == nil || x.SubjectAlternativeNames == nil || x.SubjectAlternativeNames.DNSNames == nil {
+		return nil
+	}
+	return *x.SubjectAlternativeNames.DNSNames
+}
+
+func validityInMonths(p keyvault.CertificatePolicy) int {
+	x := p.X509CertificateProperties
+	if x == nil || x.ValidityInMonths == nil || *x.ValidityInMonths <= 0 {
+		return 12
+	}
+	return int(*x.ValidityInMonths)
+}
+
+func issuerName(p keyvault.CertificatePolicy) string {
+	if p.IssuerParameters == nil || p.IssuerParameters.Name == nil || *p.IssuerParameters.Name == "" {
+		return "Self"
+	}
+	return *p.IssuerParameters.Name
+}
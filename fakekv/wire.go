@@ -0,0 +1,166 @@
+package fakekv
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/pkg/errors"
+)
+
+// The SDK's MarshalJSON methods skip READ-ONLY fields (ids, created,
+// updated, ...), so responses use these types instead
+
+type attributesJSON struct {
+	Enabled       bool   `json:"enabled"`
+	NotBefore     int64  `json:"nbf"`
+	Expires       int64  `json:"exp"`
+	Created       int64  `json:"created"`
+	Updated       int64  `json:"updated"`
+	RecoveryLevel string `json:"recoveryLevel"`
+}
+
+type bundleJSON struct {
+	ID          string                     `json:"id"`
+	Kid         string                     `json:"kid"`
+	Sid         string                     `json:"sid"`
+	X5t         string                     `json:"x5t"`
+	Cer         []byte                     `json:"cer"`
+	ContentType string                     `json:"contentType,omitempty"`
+	Policy      keyvault.CertificatePolicy `json:"policy"`
+	Attributes  attributesJSON             `json:"attributes"`
+	Tags        map[string]string          `json:"tags"`
+}
+
+type itemJSON struct {
+	ID         string            `json:"id"`
+	Attributes attributesJSON    `json:"attributes"`
+	Tags       map[string]string `json:"tags"`
+	X5t        string            `json:"x5t"`
+}
+
+type listJSON struct {
+	Value    []itemJSON `json:"value"`
+	NextLink string     `json:"nextLink,omitempty"`
+}
+
+type operationJSON struct {
+	ID                    string                     `json:"id"`
+	Issuer                *keyvault.IssuerParameters `json:"issuer,omitempty"`
+	Csr                   []byte                     `json:"csr,omitempty"`
+	CancellationRequested bool                       `json:"cancellation_requested"`
+	Status                string                     `json:"status"`
+	StatusDetails         string                     `json:"status_details"`
+	Target                string                     `json:"target,omitempty"`
+	RequestID             string                     `json:"request_id"`
+}
+
+type secretJSON struct {
+	ID          string         `json:"id"`
+	Value       string         `json:"value"`
+	ContentType string         `json:"contentType"`
+	Kid         string         `json:"kid"`
+	Managed     bool           `json:"managed"`
+	Attributes  attributesJSON `json:"attributes"`
+}
+
+type errorJSON struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponseJSON struct {
+	Error errorJSON `json:"error"`
+}
+
+func attributesToJSON(v *version) attributesJSON {
+	return attributesJSON{
+		Enabled:       v.enabled,
+		NotBefore:     v.notBefore.Unix(),
+		Expires:       v.expires.Unix(),
+		Created:       v.created.Unix(),
+		Updated:       v.updated.Unix(),
+		RecoveryLevel: string(keyvault.Purgeable),
+	}
+}
+
+// thumbprint is the base64url SHA-1 of the DER certificate, like Key Vault's x5t
+func thumbprint(cer []byte) string {
+	sum := sha1.Sum(cer)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func bundleToJSON(base string, name string, v *version) bundleJSON {
+	contentType := ""
+	if v.policy.SecretProperties != nil && v.policy.SecretProperties.ContentType != nil {
+		contentType = *v.policy.SecretProperties.ContentType
+	}
+	return bundleJSON{
+		ID:          base + "/certificates/" + name + "/" + v.id,
+		Kid:         base + "/keys/" + name + "/" + v.id,
+		Sid:         base + "/secrets/" + name + "/" + v.id,
+		X5t:         thumbprint(v.cer),
+		Cer:         v.cer,
+		ContentType: contentType,
+		Policy:      v.policy,
+		Attributes:  attributesToJSON(v),
+		Tags:        v.tags,
+	}
+}
+
+// secretToJSON encodes a version's key and certificates like Key Vault:
+// base64 PKCS #12 without a password, or PEM with the key first
+func secretToJSON(base string, name string, v *version) (secretJSON, error) {
+	contentType := contentTypePKCS12
+	if v.policy.SecretProperties != nil && v.policy.SecretProperties.ContentType != nil && *v.policy.SecretProperties.ContentType != "" {
+		contentType = *v.policy.SecretProperties.ContentType
+	}
+	var value string
+	switch contentType {
+	case contentTypePKCS12:
+		pfx, err := encodePKCS12(v.privateKey, v.cer, v.chain)
+		if err != nil {
+			return secretJSON{}, err
+		}
+		value = base64.StdEncoding.EncodeToString(pfx)
+	case contentTypePEM:
+		pemBytes, err := encodePEM(v.privateKey, v.cer, v.chain)
+		if err != nil {
+			return secretJSON{}, err
+		}
+		value = string(pemBytes)
+	default:
+		return secretJSON{}, errors.Errorf("unsupported content type: %#v", contentType)
+	}
+	return secretJSON{
+		ID:          base + "/secrets/" + name + "/" + v.id,
+		Value:       value,
+		ContentType: contentType,
+		Kid:         base + "/keys/" + name + "/" + v.id,
+		Managed:     true,
+		Attributes:  attributesToJSON(v),
+	}, nil
+}
+
+func itemToJSON(id string, v *version) itemJSON {
+	return itemJSON{
+		ID:         id,
+		Attributes: attributesToJSON(v),
+		Tags:       v.tags,
+		X5t:        thumbprint(v.cer),
+	}
+}
+
+func operationToJSON(base string, name string, op *operation) operationJSON {
+	issuerName := op.issuerName
+	return operationJSON{
+		ID:                    base + "/certificates/" + name + "/pending",
+		Issuer:                &keyvault.IssuerParameters{Name: &issuerName},
+		Csr:                   op.csr,
+		CancellationRequested: op.cancellationRequested,
+		Status:                op.status,
+		StatusDetails:         op.statusDetails,
+		Target:                base + "/certificates/" + name,
+		RequestID:             op.requestID,
+	}
+}
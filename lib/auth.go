@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// Authentication modes for NewAuthorizer
+const (
+	AuthModeAuto              = "auto"
+	AuthModeCLI               = "cli"
+	AuthModeClientSecret      = "client-secret"
+	AuthModeClientCertificate = "client-certificate"
+	AuthModeManagedIdentity   = "managed-identity"
+	AuthModeDeviceCode        = "device-code"
+	AuthModeNone              = "none"
+)
+
+// AuthModes lists every valid auth mode
+var AuthModes = []string{
+	AuthModeAuto,
+	AuthModeCLI,
+	AuthModeClientSecret,
+	AuthModeClientCertificate,
+	AuthModeManagedIdentity,
+	AuthModeDeviceCode,
+	AuthModeNone,
+}
+
+// authModesAuto are tried in order by AuthModeAuto. Device code is
+// interactive and would hang build agents, so it has to be asked for
+var authModesAuto = []string{
+	AuthModeClientSecret,
+	AuthModeClientCertificate,
+	AuthModeCLI,
+	AuthModeManagedIdentity,
+}
+
+// azureCLIClientID is the Azure CLI's public client ID, used for device code
+// logins when no client_id is configured
+const azureCLIClientID = "04b07795-8ddb-461a-bbee-02f9e1bf7b46"
+
+// CfgAuth configures authentication. Secrets are only read from the
+// environment (AZURE_CLIENT_SECRET, AZURE_CERTIFICATE_PASSWORD). Blank
+// fields fall back to the matching AZURE_* environment variable.
+type CfgAuth struct {
+	Mode            string `yaml:"mode"`
+	TenantID        string `yaml:"tenant_id"`
+	ClientID        string `yaml:"client_id"`
+	CertificatePath string `yaml:"certificate_path"`
+	AADEndpoint     string `yaml:"aad_endpoint"`
+}
+
+// WithEnv fills blank fields from their AZURE_* environment variables and
+// aad_endpoint with the public cloud's. Secrets aren't included
+func (c CfgAuth) WithEnv() CfgAuth {
+	c.TenantID = firstNonEmpty(c.TenantID, os.Getenv("AZURE_TENANT_ID"))
+	c.ClientID = firstNonEmpty(c.ClientID, os.Getenv("AZURE_CLIENT_ID"))
+	c.CertificatePath = firstNonEmpty(c.CertificatePath, os.Getenv("AZURE_CERTIFICATE_PATH"))
+	c.AADEndpoint = firstNonEmpty(c.AADEndpoint, azure.PublicCloud.ActiveDirectoryEndpoint)
+	return c
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// refreshedBearerAuthorizer fetches a token now so a misconfigured method
+// fails here instead of on the first Key Vault call
+func refreshedBearerAuthorizer(spt *adal.ServicePrincipalToken, timeout time.Duration) (autorest.Authorizer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := spt.RefreshWithContext(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return autorest.NewBearerAuthorizer(spt), nil
+}
+
+func newAuthorizerForMode(cfgAuth CfgAuth, mode string, resource string, timeout time.Duration) (autorest.Authorizer, error) {
+	cfgAuth = cfgAuth.WithEnv()
+	tenantID := cfgAuth.TenantID
+	clientID := cfgAuth.ClientID
+	aadEndpoint := cfgAuth.AADEndpoint
+
+	switch mode {
+	case AuthModeCLI:
+		authorizer, err := auth.NewAuthorizerFromCLIWithResource(resource)
+		return authorizer, errors.WithStack(err)
+
+	case AuthModeClientSecret:
+		clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+		if tenantID == "" || clientID == "" || clientSecret == "" {
+			return nil, errors.New("tenant ID, client ID and AZURE_CLIENT_SECRET must be set")
+		}
+		ccc := auth.NewClientCredentialsConfig(clientID, clientSecret, tenantID)
+		ccc.Resource = resource
+		ccc.AADEndpoint = aadEndpoint
+		spt, err := ccc.ServicePrincipalToken()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return refreshedBearerAuthorizer(spt, timeout)
+
+	case AuthModeClientCertificate:
+		certificatePath := cfgAuth.CertificatePath
+		if tenantID == "" || clientID == "" || certificatePath == "" {
+			return nil, errors.New("tenant ID, client ID and certificate path must be set")
+		}
+		ccc := auth.NewClientCertificateConfig(certificatePath, os.Getenv("AZURE_CERTIFICATE_PASSWORD"), clientID, tenantID)
+		ccc.Resource = resource
+		ccc.AADEndpoint = aadEndpoint
+		spt, err := ccc.ServicePrincipalToken()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return refreshedBearerAuthorizer(spt, timeout)
+
+	case AuthModeManagedIdentity:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if !adal.MSIAvailable(ctx, nil) {
+			return nil, errors.New("managed identity endpoint not available")
+		}
+		mc := auth.NewMSIConfig()
+		mc.Resource = resource
+		// a user assigned identity needs its client ID
+		mc.ClientID = clientID
+		spt, err := mc.ServicePrincipalToken()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return refreshedBearerAuthorizer(spt, timeout)
+
+	case AuthModeDeviceCode:
+		dfc := auth.NewDeviceFlowConfig(
+			firstNonEmpty(clientID, azureCLIClientID),
+			firstNonEmpty(tenantID, "common"),
+		)
+		dfc.Resource = resource
+		dfc.AADEndpoint = aadEndpoint
+		authorizer, err := dfc.Authorizer()
+		return authorizer, errors.WithStack(err)
+
+	case AuthModeNone:
+		return autorest.NullAuthorizer{}, nil
+
+	default:
+		return nil, errors.Errorf("unknown auth mode: %#v", mode)
+	}
+}
+
+// NewAuthorizer authorizes requests for resource (see VaultResource) with
+// the given mode. AuthModeAuto tries client secret, client certificate, the
+// Azure CLI, and managed identity in order and uses the first that works.
+// Blank mode means AuthModeAuto. The chosen mode is logged and returned.
+func NewAuthorizer(logger *logos.Logger, cfgAuth CfgAuth, mode string, resource string, timeout time.Duration) (autorest.Authorizer, string, error) {
+	if mode == "" {
+		mode = AuthModeAuto
+	}
+
+	modes := []string{mode}
+	if mode == AuthModeAuto {
+		modes = authModesAuto
+	}
+
+	var err error
+	for _, m := range modes {
+		var authorizer autorest.Authorizer
+		authorizer, err = newAuthorizerForMode(cfgAuth, m, resource, timeout)
+		if err == nil {
+			logger.Debugw(
+				"authorized",
+				"authMode", m,
+				"resource", resource,
+			)
+			return authorizer, m, nil
+		}
+		logger.Debugw(
+			"auth mode failed",
+			"authMode", m,
+			"resource", resource,
+			"err", err,
+		)
+	}
+
+	logger.Errorw(
+		"keyvault authorization error. Log in with `az login` or see the `auth` config section",
+		"authMode", mode,
+		"resource", resource,
+		"err", err,
+	)
+	return nil, "", err
+}
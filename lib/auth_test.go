@@ -0,0 +1,168 @@
+package lib
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/bbkane/logos"
+)
+
+// authEnvVars are the environment variables NewAuthorizer reads
+var authEnvVars = []string{
+	"AZURE_TENANT_ID",
+	"AZURE_CLIENT_ID",
+	"AZURE_CLIENT_SECRET",
+	"AZURE_CERTIFICATE_PATH",
+	"AZURE_CERTIFICATE_PASSWORD",
+}
+
+// setAuthEnv replaces authEnvVars with env for the rest of the test
+func setAuthEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+	for _, name := range authEnvVars {
+		old, ok := os.LookupEnv(name)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, old)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+		if v, set := env[name]; set {
+			os.Setenv(name, v)
+		} else {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+// fakeAAD is a token endpoint that hands out tokens to anyone and records
+// which resources they were for
+type fakeAAD struct {
+	mu        sync.Mutex
+	resources []string
+}
+
+func (f *fakeAAD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.resources = append(f.resources, r.PostForm.Get("resource"))
+	f.mu.Unlock()
+	expiresOn := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(
+		w, `{"access_token": "token", "expires_in": "3600", "expires_on": %q, "not_before": %q, "resource": %q, "token_type": "Bearer"}`,
+		expiresOn, expiresOn, r.PostForm.Get("resource"),
+	)
+}
+
+// writeTestClientCertificate writes a PFX with an RSA key, which is all the
+// client certificate mode accepts
+func writeTestClientCertificate(t *testing.T, password string) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := testCertificate(t, "client", false, key.Public(), nil, key)
+	return writeTestPFX(t, t.TempDir(), "client.pfx", key, cert, nil, password)
+}
+
+func TestNewAuthorizer(t *testing.T) {
+	aad := &fakeAAD{}
+	aadServer := httptest.NewServer(aad)
+	t.Cleanup(aadServer.Close)
+	certificatePath := writeTestClientCertificate(t, "hunter2")
+
+	secretEnv := map[string]string{
+		"AZURE_TENANT_ID":     "tenant",
+		"AZURE_CLIENT_ID":     "client",
+		"AZURE_CLIENT_SECRET": "secret",
+	}
+	certificateEnv := map[string]string{
+		"AZURE_TENANT_ID":            "tenant",
+		"AZURE_CLIENT_ID":            "client",
+		"AZURE_CERTIFICATE_PATH":     certificatePath,
+		"AZURE_CERTIFICATE_PASSWORD": "hunter2",
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		cfgAuth  CfgAuth
+		mode     string
+		wantMode string
+		wantErr  bool
+	}{
+		{"auto uses the client secret", secretEnv, CfgAuth{}, AuthModeAuto, AuthModeClientSecret, false},
+		{"blank mode is auto", secretEnv, CfgAuth{}, "", AuthModeClientSecret, false},
+		{
+			"config fills in for the environment",
+			map[string]string{"AZURE_CLIENT_SECRET": "secret"},
+			CfgAuth{TenantID: "tenant", ClientID: "client"},
+			AuthModeAuto, AuthModeClientSecret, false,
+		},
+		// no AZURE_CLIENT_SECRET, so auto falls through to the certificate
+		{"auto falls through", certificateEnv, CfgAuth{}, AuthModeAuto, AuthModeClientCertificate, false},
+		{
+			"client secret needs a tenant",
+			map[string]string{"AZURE_CLIENT_ID": "client", "AZURE_CLIENT_SECRET": "secret"},
+			CfgAuth{}, AuthModeClientSecret, "", true,
+		},
+		{"client secret needs a secret", certificateEnv, CfgAuth{}, AuthModeClientSecret, "", true},
+		{"client certificate", certificateEnv, CfgAuth{}, AuthModeClientCertificate, AuthModeClientCertificate, false},
+		{"none", nil, CfgAuth{}, AuthModeNone, AuthModeNone, false},
+		{"unknown mode", secretEnv, CfgAuth{}, "password", "", true},
+	}
+	logger := logos.NewLogger(logos.NewZapSugaredLogger(nil, nil, "test"))
+	resource := "https://vault.azure.net"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAuthEnv(t, tt.env)
+			cfgAuth := tt.cfgAuth
+			cfgAuth.AADEndpoint = aadServer.URL
+
+			authorizer, mode, err := NewAuthorizer(logger, cfgAuth, tt.mode, resource, testTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode = %#v, want %#v", mode, tt.wantMode)
+			}
+			if tt.wantErr {
+				return
+			}
+			if authorizer == nil {
+				t.Fatal("nil authorizer")
+			}
+			_, isNull := authorizer.(autorest.NullAuthorizer)
+			if isNull != (tt.wantMode == AuthModeNone) {
+				t.Errorf("authorizer = %T", authorizer)
+			}
+		})
+	}
+
+	aad.mu.Lock()
+	defer aad.mu.Unlock()
+	if len(aad.resources) == 0 {
+		t.Fatal("no tokens were requested")
+	}
+	for _, r := range aad.resources {
+		if r != resource {
+			t.Errorf("token requested for %#v, want %#v", r, resource)
+		}
+	}
+}
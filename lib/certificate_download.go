@@ -0,0 +1,417 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Download formats
+const (
+	DownloadPEM       = "pem"
+	DownloadDER       = "der"
+	DownloadPFX       = "pfx"
+	DownloadPEMBundle = "pem-bundle"
+)
+
+// DownloadFormats are the formats for `certificate download`
+var DownloadFormats = []string{DownloadPEM, DownloadDER, DownloadPFX, DownloadPEMBundle}
+
+// Secret content types
+const (
+	ContentTypePKCS12 = "application/x-pkcs12"
+	ContentTypePEM    = "application/x-pem-file"
+)
+
+// parsePEMKeyAndCertificates reads the first private key and every
+// certificate from PEM data. Encrypted keys aren't supported
+func parsePEMKeyAndCertificates(data []byte) (crypto.PrivateKey, []*x509.Certificate, error) {
+	var key crypto.PrivateKey
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		var err error
+		switch block.Type {
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			certs = append(certs, cert)
+		case "PRIVATE KEY":
+			if key == nil {
+				key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			}
+		case "RSA PRIVATE KEY":
+			if key == nil {
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			}
+		case "EC PRIVATE KEY":
+			if key == nil {
+				key, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+		case "ENCRYPTED PRIVATE KEY":
+			err = errors.New("encrypted PEM keys aren't supported. Decrypt it first, for example with openssl pkey")
+		}
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "can't parse %s", block.Type)
+		}
+	}
+	return key, certs, nil
+}
+
+// parseSecretValue decodes the key and certificates from the secret backing
+// a certificate. PKCS #12 secrets are base64 encoded without a password
+func parseSecretValue(contentType string, value string) (crypto.PrivateKey, []*x509.Certificate, error) {
+	switch contentType {
+	case ContentTypePKCS12:
+		pfx, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		key, cert, caCerts, err := pkcs12.DecodeChain(pfx, "")
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return key, append([]*x509.Certificate{cert}, caCerts...), nil
+	case ContentTypePEM:
+		return parsePEMKeyAndCertificates([]byte(value))
+	default:
+		return nil, nil, errors.Errorf("unsupported secret content type: %#v", contentType)
+	}
+}
+
+// splitChain finds the certificate matching cer in certs and returns the
+// rest as its chain, in order
+func splitChain(cer []byte, certs []*x509.Certificate) []*x509.Certificate {
+	var chain []*x509.Certificate
+	for _, c := range certs {
+		if !bytes.Equal(c.Raw, cer) {
+			chain = append(chain, c)
+		}
+	}
+	return chain
+}
+
+// marshalPrivateKeyPEM encodes key as PKCS #8 PEM
+func marshalPrivateKeyPEM(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func certificatesPEM(certs []*x509.Certificate) []byte {
+	var ret []byte
+	for _, c := range certs {
+		ret = append(ret, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	return ret
+}
+
+// errFileExists is what writeFileSafely and checkFileFree return for a file
+// that's in the way
+func errFileExists(path string) error {
+	return errors.Errorf("%s already exists. Pass --overwrite to replace it", path)
+}
+
+// checkFileFree returns an error if path exists, so every file can be checked
+// before any are written
+func checkFileFree(path string) error {
+	_, err := os.Lstat(path)
+	if err == nil {
+		return errFileExists(path)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.WithStack(err)
+}
+
+// writeFileSafely writes data to path with perm, refusing to replace an
+// existing file unless overwrite is set. perm is applied to replaced files
+// too, so keys don't stay readable by others
+func writeFileSafely(path string, data []byte, perm os.FileMode, overwrite bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		if os.IsExist(err) {
+			return errFileExists(path)
+		}
+		return errors.WithStack(err)
+	}
+	err = f.Chmod(perm)
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Close())
+}
+
+// downloadFile is a file for CertificateDownload to write
+type downloadFile struct {
+	name string
+	data []byte
+	perm os.FileMode
+}
+
+// CertificateDownload writes a certificate version (blank for the latest)
+// to outDir in one of DownloadFormats:
+//
+// - der: <name>.cer, the certificate
+// - pem: <name>.crt, plus <name>.key and <name>.chain.pem if the key is exportable
+// - pfx: <name>.pfx, the key, certificate and chain, encrypted with pfxPassword
+// - pem-bundle: <name>.pem, the key, certificate and chain
+//
+// outDir is created if it doesn't exist. Files with private keys are only
+// readable by the owner
+func CertificateDownload(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	certVersion string,
+	format string,
+	outDir string,
+	pfxPassword string,
+	overwrite bool,
+) error {
+	if pfxPassword != "" && format != DownloadPFX {
+		err := errors.Errorf("a password only works with --format %s", DownloadPFX)
+		logger.Errorw(
+			"flag parsing error",
+			"format", format,
+			"err", err,
+		)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	bundle, err := kvClient.GetCertificate(ctx, vaultURL, certName, certVersion)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't get certificate",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"certVersion", certVersion,
+			"err", err,
+		)
+		return err
+	}
+	if bundle.Cer == nil || len(*bundle.Cer) == 0 {
+		err = errors.Errorf("%s has no certificate. Is it still pending?", certName)
+		logger.Errorw(
+			"Can't download certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	cer := *bundle.Cer
+	leaf, err := x509.ParseCertificate(cer)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't parse certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	_, version := ParseCertificateID(formatStrPtr(bundle.ID))
+
+	exportable := false
+	if bundle.Policy != nil && bundle.Policy.KeyProperties != nil && bundle.Policy.KeyProperties.Exportable != nil {
+		exportable = *bundle.Policy.KeyProperties.Exportable
+	}
+	needKey := format == DownloadPFX || format == DownloadPEMBundle || (format == DownloadPEM && exportable)
+	if needKey && !exportable {
+		err = errors.Errorf("%s's private key isn't exportable. Use --format %s or %s for just the certificate", certName, DownloadPEM, DownloadDER)
+		logger.Errorw(
+			"Can't download private key",
+			"certName", certName,
+			"format", format,
+			"err", err,
+		)
+		return err
+	}
+
+	var key crypto.PrivateKey
+	var chain []*x509.Certificate
+	var secretValue, secretContentType string
+	if needKey {
+		secretName, secretVersion := parseObjectID(formatStrPtr(bundle.Sid), "secrets")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		secret, err := kvClient.GetSecret(ctx, vaultURL, secretName, secretVersion)
+		if err != nil {
+			err = errors.WithStack(err)
+			logger.Errorw(
+				"Can't get the secret backing the certificate",
+				"certName", certName,
+				"sid", formatStrPtr(bundle.Sid),
+				"err", err,
+			)
+			return err
+		}
+		secretValue = formatStrPtr(secret.Value)
+		secretContentType = formatStrPtr(secret.ContentType)
+		var certs []*x509.Certificate
+		key, certs, err = parseSecretValue(secretContentType, secretValue)
+		if err == nil && key == nil {
+			err = errors.New("no private key in secret")
+		}
+		if err != nil {
+			logger.Errorw(
+				"Can't parse the secret backing the certificate",
+				"certName", certName,
+				"contentType", secretContentType,
+				"err", err,
+			)
+			return err
+		}
+		chain = splitChain(cer, certs)
+	}
+
+	var files []downloadFile
+	switch format {
+	case DownloadDER:
+		files = append(files, downloadFile{certName + ".cer", cer, 0644})
+	case DownloadPEM:
+		files = append(files, downloadFile{certName + ".crt", certificatesPEM([]*x509.Certificate{leaf}), 0644})
+		if key != nil {
+			keyPEM, err := marshalPrivateKeyPEM(key)
+			if err != nil {
+				logger.Errorw(
+					"Can't encode private key",
+					"certName", certName,
+					"err", err,
+				)
+				return err
+			}
+			files = append(files, downloadFile{certName + ".key", keyPEM, 0600})
+		}
+		if len(chain) > 0 {
+			files = append(files, downloadFile{certName + ".chain.pem", certificatesPEM(chain), 0644})
+		}
+	case DownloadPEMBundle:
+		keyPEM, err := marshalPrivateKeyPEM(key)
+		if err != nil {
+			logger.Errorw(
+				"Can't encode private key",
+				"certName", certName,
+				"err", err,
+			)
+			return err
+		}
+		data := append(keyPEM, certificatesPEM(append([]*x509.Certificate{leaf}, chain...))...)
+		files = append(files, downloadFile{certName + ".pem", data, 0600})
+	case DownloadPFX:
+		var pfx []byte
+		if secretContentType == ContentTypePKCS12 && pfxPassword == "" {
+			// keep Key Vault's encoding
+			pfx, err = base64.StdEncoding.DecodeString(secretValue)
+		} else {
+			pfx, err = pkcs12.Encode(rand.Reader, key, leaf, chain, pfxPassword)
+		}
+		if err != nil {
+			err = errors.WithStack(err)
+			logger.Errorw(
+				"Can't encode PFX",
+				"certName", certName,
+				"err", err,
+			)
+			return err
+		}
+		files = append(files, downloadFile{certName + ".pfx", pfx, 0600})
+	default:
+		err = errors.Errorf("unknown format: %#v", format)
+		logger.Errorw(
+			"Can't download certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	// check everything first so one existing file doesn't leave a partial
+	// download. writeFileSafely still refuses files created since
+	if !overwrite {
+		for _, f := range files {
+			path := filepath.Join(outDir, f.name)
+			err = checkFileFree(path)
+			if err != nil {
+				logger.Errorw(
+					"Can't write file",
+					"path", path,
+					"err", err,
+				)
+				return err
+			}
+		}
+	}
+
+	// owner only, like the key files going in it
+	err = os.MkdirAll(outDir, 0700)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't create output directory",
+			"outDir", outDir,
+			"err", err,
+		)
+		return err
+	}
+
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(outDir, f.name)
+		err = writeFileSafely(path, f.data, f.perm, overwrite)
+		if err != nil {
+			logger.Errorw(
+				"Can't write file",
+				"path", path,
+				"err", err,
+			)
+			return err
+		}
+		paths = append(paths, path)
+	}
+
+	if format == DownloadPEM && !exportable {
+		logger.Infow(
+			"private key isn't exportable, so only the certificate was downloaded",
+			"certName", certName,
+		)
+	}
+	logger.Infow(
+		"certificate downloaded",
+		"certName", certName,
+		"version", version,
+		"format", format,
+		"files", strings.Join(paths, ", "),
+		"chainLength", len(chain),
+	)
+	return nil
+}
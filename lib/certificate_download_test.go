@@ -0,0 +1,115 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestCertificateDownload(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.createTestCertificate(t, "dl")
+
+	tests := []struct {
+		format string
+		// wantFiles maps file names to permissions
+		wantFiles map[string]os.FileMode
+	}{
+		{DownloadDER, map[string]os.FileMode{"dl.cer": 0644}},
+		// Self signed, so no chain
+		{DownloadPEM, map[string]os.FileMode{"dl.crt": 0644, "dl.key": 0600}},
+		{DownloadPEMBundle, map[string]os.FileMode{"dl.pem": 0600}},
+		{DownloadPFX, map[string]os.FileMode{"dl.pfx": 0600}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			// doesn't exist yet
+			outDir := filepath.Join(t.TempDir(), "nested", "certs")
+			password := ""
+			if tt.format == DownloadPFX {
+				password = "hunter2"
+			}
+			err := CertificateDownload(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "dl", "", tt.format, outDir, password, false)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			infos, err := ioutil.ReadDir(outDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, info := range infos {
+				names = append(names, info.Name())
+				if want, exists := tt.wantFiles[info.Name()]; exists && info.Mode().Perm() != want {
+					t.Errorf("%s has mode %v, want %v", info.Name(), info.Mode().Perm(), want)
+				}
+			}
+			var wantNames []string
+			for name := range tt.wantFiles {
+				wantNames = append(wantNames, name)
+			}
+			sort.Strings(wantNames)
+			if strings.Join(names, ",") != strings.Join(wantNames, ",") {
+				t.Errorf("files = %v, want %v", names, wantNames)
+			}
+
+			if tt.format == DownloadPFX {
+				pfx, err := ioutil.ReadFile(filepath.Join(outDir, "dl.pfx"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, cert, _, err := pkcs12.DecodeChain(pfx, password)
+				if err != nil {
+					t.Fatalf("can't decode PFX with its password: %v", err)
+				}
+				if cert.Subject.CommonName != "test.example.com" {
+					t.Errorf("PFX certificate CN = %#v", cert.Subject.CommonName)
+				}
+			}
+
+			// files aren't replaced without overwrite
+			err = CertificateDownload(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "dl", "", tt.format, outDir, password, false)
+			if err == nil {
+				t.Error("downloading over existing files should fail")
+			}
+			err = CertificateDownload(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "dl", "", tt.format, outDir, password, true)
+			if err != nil {
+				t.Errorf("overwrite: %+v", err)
+			}
+		})
+	}
+
+	err := CertificateDownload(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "dl", "", DownloadPEM, t.TempDir(), "hunter2", false)
+	if err == nil {
+		t.Error("a password without --format pfx should fail")
+	}
+
+	// an existing key means nothing is written, not just the key
+	outDir := t.TempDir()
+	keyPath := filepath.Join(outDir, "dl.key")
+	err = ioutil.WriteFile(keyPath, []byte("old key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CertificateDownload(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "dl", "", DownloadPEM, outDir, "", false)
+	if err == nil || !strings.Contains(err.Error(), "dl.key already exists") {
+		t.Errorf("err = %v, want dl.key to be in the way", err)
+	}
+	_, err = os.Stat(filepath.Join(outDir, "dl.crt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("dl.crt shouldn't have been written: %v", err)
+	}
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != "old key" {
+		t.Error("dl.key was replaced")
+	}
+}
@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// Expiry buckets, most urgent first
+const (
+	BucketExpired  = "expired"
+	BucketCritical = "critical"
+	BucketWarning  = "warning"
+)
+
+// Exit codes for `certificate expiring`, from the most urgent bucket with a
+// certificate in it. 1 is still any other error
+const (
+	ExitCodeWarning  = 2
+	ExitCodeCritical = 3
+	ExitCodeExpired  = 4
+)
+
+var bucketExitCodes = map[string]int{
+	BucketExpired:  ExitCodeExpired,
+	BucketCritical: ExitCodeCritical,
+	BucketWarning:  ExitCodeWarning,
+}
+
+var bucketOrder = map[string]int{
+	BucketExpired:  0,
+	BucketCritical: 1,
+	BucketWarning:  2,
+}
+
+// ExitCodeError is returned when the process should exit with a specific
+// code. It's not a failure to log
+type ExitCodeError struct {
+	Code    int
+	Message string
+}
+
+func (e *ExitCodeError) Error() string {
+	return e.Message
+}
+
+// ExpiringCertificate is a certificate in an expiry bucket
+type ExpiringCertificate struct {
+	Bucket string `json:"bucket"`
+	// Vault is the vault's alias, or its URL if it doesn't have one
+	Vault   string     `json:"vault"`
+	Name    string     `json:"name"`
+	ID      string     `json:"id"`
+	Expires *time.Time `json:"expires"`
+	// DaysLeft is negative for expired certificates
+	DaysLeft int               `json:"days_left"`
+	Enabled  *bool             `json:"enabled"`
+	Owner    string            `json:"owner"`
+	Tags     map[string]string `json:"tags"`
+}
+
+// DefaultCertificateExpiringFields are the table and csv columns when no
+// fields are passed
+var DefaultCertificateExpiringFields = []string{"bucket", "name", "expires", "days_left", "owner"}
+
+// ExpiryThresholds decide a certificate's bucket
+type ExpiryThresholds struct {
+	// Within is the warning threshold. Certificates expiring later are skipped
+	Within time.Duration
+	// Critical must be <= Within
+	Critical time.Duration
+	// OwnerTags are checked in order for an owner
+	OwnerTags []string
+	// Now is when expiry is measured from. Defaults to time.Now()
+	Now time.Time
+}
+
+// Validate makes sure 0 <= t.Critical <= t.Within and t.Within > 0. A
+// Critical past Within would put every certificate in the critical bucket
+func (t ExpiryThresholds) Validate() error {
+	if t.Within <= 0 {
+		return errors.Errorf("--within must be positive: %s", t.Within)
+	}
+	if t.Critical < 0 {
+		return errors.Errorf("--critical can't be negative: %s", t.Critical)
+	}
+	if t.Critical > t.Within {
+		return errors.Errorf("--critical (%s) can't be longer than --within (%s)", t.Critical, t.Within)
+	}
+	return nil
+}
+
+// Bucket returns expires' bucket, or "" if it's not within t.Within
+func (t ExpiryThresholds) Bucket(expires time.Time) string {
+	switch {
+	case expires.Before(t.Now):
+		return BucketExpired
+	case expires.Before(t.Now.Add(t.Critical)):
+		return BucketCritical
+	case expires.Before(t.Now.Add(t.Within)):
+		return BucketWarning
+	}
+	return ""
+}
+
+// NewExpiringCertificate buckets a CertificateItem. ok is false if it has no
+// expiry or isn't expiring within t.Within
+func (t ExpiryThresholds) NewExpiringCertificate(item keyvault.CertificateItem) (ExpiringCertificate, bool) {
+	if item.Attributes == nil || item.Attributes.Expires == nil {
+		return ExpiringCertificate{}, false
+	}
+	expires := time.Time(*item.Attributes.Expires).UTC()
+	bucket := t.Bucket(expires)
+	if bucket == "" {
+		return ExpiringCertificate{}, false
+	}
+
+	ec := ExpiringCertificate{
+		Bucket:   bucket,
+		Expires:  &expires,
+		DaysLeft: int(math.Floor(expires.Sub(t.Now).Hours() / 24)),
+		Enabled:  item.Attributes.Enabled,
+		Tags:     tagsToMap(item.Tags),
+	}
+	if item.ID != nil {
+		ec.ID = *item.ID
+		ec.Name, _ = ParseCertificateID(*item.ID)
+	}
+	for _, k := range t.OwnerTags {
+		if v := ec.Tags[k]; v != "" {
+			ec.Owner = v
+			break
+		}
+	}
+	return ec, true
+}
+
+// CertificateExpiring prints every certificate in vaults expiring within
+// thresholds.Within, grouped into expired, critical and warning buckets
+// (most urgent first, then soonest first). If any certificates are printed,
+// it returns an *ExitCodeError for the most urgent bucket
+func CertificateExpiring(
+	logger *logos.Logger,
+	vaults []Vault,
+	timeout time.Duration,
+	thresholds ExpiryThresholds,
+	includeDisabled bool,
+	outputFormat string,
+	fields []string,
+) error {
+	err := thresholds.Validate()
+	if err != nil {
+		logger.Errorw(
+			"Invalid thresholds",
+			"err", err,
+		)
+		return err
+	}
+	if thresholds.Now.IsZero() {
+		thresholds.Now = time.Now()
+	}
+
+	defaultFields := DefaultCertificateExpiringFields
+	if len(vaults) > 1 {
+		defaultFields = append([]string{"vault"}, defaultFields...)
+	}
+	out, err := NewListWriter(os.Stdout, outputFormat, fields, defaultFields)
+	if err != nil {
+		logger.Errorw(
+			"Can't write output",
+			"outputFormat", outputFormat,
+			"fields", fields,
+			"err", err,
+		)
+		return err
+	}
+
+	filter := CertificateFilter{
+		ExpiresWithin: thresholds.Within,
+		Now:           thresholds.Now,
+	}
+	if !includeDisabled {
+		enabled := true
+		filter.Enabled = &enabled
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Every vault is read before printing so buckets can be grouped
+	var expiring []ExpiringCertificate
+	for _, vault := range vaults {
+		err = listCertificates(ctx, vault.Client, vault.URL, filter, func(cert keyvault.CertificateItem) error {
+			ec, ok := thresholds.NewExpiringCertificate(cert)
+			if ok {
+				ec.Vault = vault.Label()
+				expiring = append(expiring, ec)
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Errorw(
+				"Can't list certificates",
+				"vaultURL", vault.URL,
+				"err", err,
+			)
+			return err
+		}
+	}
+
+	sort.SliceStable(expiring, func(i, j int) bool {
+		if expiring[i].Bucket != expiring[j].Bucket {
+			return bucketOrder[expiring[i].Bucket] < bucketOrder[expiring[j].Bucket]
+		}
+		return expiring[i].Expires.Before(*expiring[j].Expires)
+	})
+
+	counts := make(map[string]int)
+	for _, ec := range expiring {
+		counts[ec.Bucket]++
+		err = out.Write(ec)
+		if err != nil {
+			logger.Errorw(
+				"Can't write expiring certificate",
+				"certName", ec.Name,
+				"err", err,
+			)
+			return err
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		logger.Errorw(
+			"Can't write output",
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+
+	logger.Debugw(
+		"Expiring certificates",
+		"vaults", len(vaults),
+		BucketExpired, counts[BucketExpired],
+		BucketCritical, counts[BucketCritical],
+		BucketWarning, counts[BucketWarning],
+	)
+
+	if len(expiring) == 0 {
+		return nil
+	}
+	worst := expiring[0].Bucket
+	return &ExitCodeError{
+		Code: bucketExitCodes[worst],
+		Message: fmt.Sprintf(
+			"expired: %d, critical: %d, warning: %d",
+			counts[BucketExpired], counts[BucketCritical], counts[BucketWarning],
+		),
+	}
+}
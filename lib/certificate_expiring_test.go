@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+)
+
+func TestExpiryThresholdsValidate(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		name     string
+		within   time.Duration
+		critical time.Duration
+		wantErr  bool
+	}{
+		{"critical inside within", 30 * day, 7 * day, false},
+		{"critical equals within", 30 * day, 30 * day, false},
+		{"no critical", 30 * day, 0, false},
+		{"critical past within", 7 * day, 30 * day, true},
+		{"negative critical", 30 * day, -day, true},
+		{"zero within", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ExpiryThresholds{Within: tt.within, Critical: tt.critical}.Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExpiryThresholdsBucket(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	thresholds := ExpiryThresholds{Within: 30 * day, Critical: 7 * day, Now: now}
+	tests := []struct {
+		name       string
+		thresholds ExpiryThresholds
+		expires    time.Time
+		want       string
+	}{
+		{"long expired", thresholds, now.Add(-365 * day), BucketExpired},
+		{"just expired", thresholds, now.Add(-time.Second), BucketExpired},
+		{"expires now", thresholds, now, BucketCritical},
+		{"just before critical", thresholds, now.Add(7*day - time.Second), BucketCritical},
+		{"at critical", thresholds, now.Add(7 * day), BucketWarning},
+		{"just before within", thresholds, now.Add(30*day - time.Second), BucketWarning},
+		{"at within", thresholds, now.Add(30 * day), ""},
+		{"later", thresholds, now.Add(365 * day), ""},
+		{"no critical bucket", ExpiryThresholds{Within: 30 * day, Now: now}, now, BucketWarning},
+		{"critical is within", ExpiryThresholds{Within: 30 * day, Critical: 30 * day, Now: now}, now.Add(29 * day), BucketCritical},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.thresholds.Bucket(tt.expires); got != tt.want {
+				t.Errorf("Bucket() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewExpiringCertificate(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	thresholds := ExpiryThresholds{
+		Within:    30 * day,
+		Critical:  7 * day,
+		OwnerTags: []string{"owner", "team"},
+		Now:       now,
+	}
+	tags := map[string]*string{"team": strPtr("payments")}
+	noExpiry := testCertificateItem("no-expiry", true, now, nil)
+	noExpiry.Attributes.Expires = nil
+
+	tests := []struct {
+		name         string
+		item         keyvault.CertificateItem
+		wantOk       bool
+		wantBucket   string
+		wantDaysLeft int
+		wantOwner    string
+		wantEnabled  bool
+	}{
+		{"expired", testCertificateItem("old", true, now.Add(-time.Hour), nil), true, BucketExpired, -1, "", true},
+		{"critical", testCertificateItem("soon", true, now.Add(36*time.Hour), tags), true, BucketCritical, 1, "payments", true},
+		// disabled certificates are bucketed too. CertificateExpiring
+		// filters them out unless includeDisabled is passed
+		{"disabled", testCertificateItem("off", false, now.Add(10*day), nil), true, BucketWarning, 10, "", false},
+		{"not expiring", testCertificateItem("later", true, now.Add(60*day), nil), false, "", 0, "", false},
+		{"no expiry", noExpiry, false, "", 0, "", false},
+		{"no attributes", keyvault.CertificateItem{ID: strPtr("https://test.vault.azure.net/certificates/x")}, false, "", 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ec, ok := thresholds.NewExpiringCertificate(tt.item)
+			if ok != tt.wantOk {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOk)
+			}
+			if !ok {
+				return
+			}
+			if ec.Bucket != tt.wantBucket || ec.DaysLeft != tt.wantDaysLeft || ec.Owner != tt.wantOwner {
+				t.Errorf("got %s, %d days left, owner %#v", ec.Bucket, ec.DaysLeft, ec.Owner)
+			}
+			if ec.Enabled == nil || *ec.Enabled != tt.wantEnabled {
+				t.Errorf("enabled = %v, want %v", ec.Enabled, tt.wantEnabled)
+			}
+		})
+	}
+}
+
+func TestCertificateExpiring(t *testing.T) {
+	tv := newTestVault(t, 0)
+	create := func(name string, validityInMonths int32, enabled bool) {
+		err := CertificateCreate(
+			tv.logger, tv.kvClient, tv.vaultURL, testTimeout, name,
+			testCertCreateParams(t), FlagCertificateCreateParameters{ValidityInMonths: validityInMonths, Enabled: &enabled},
+			false, true, 0,
+		)
+		if err != nil {
+			t.Fatalf("can't create %s: %+v", name, err)
+		}
+	}
+	// about 30, 60, 90 and 180 days left
+	create("one-month-disabled", 1, false)
+	create("two-months", 2, true)
+	create("three-months", 3, true)
+	create("six-months", 6, true)
+	vaults := []Vault{{Alias: "test", URL: tv.vaultURL, Client: tv.kvClient}}
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name            string
+		later           time.Duration
+		within          time.Duration
+		critical        time.Duration
+		includeDisabled bool
+		// wantCode is 0 for no error
+		wantCode int
+	}{
+		{"nothing expiring", 0, 10 * day, 5 * day, false, 0},
+		{"disabled certificates are skipped", 0, 45 * day, 0, false, 0},
+		{"include disabled", 0, 45 * day, 0, true, ExitCodeWarning},
+		// two-months has ~15 days left, three-months ~45
+		{"critical is worst", 45 * day, 60 * day, 30 * day, false, ExitCodeCritical},
+		{"disabled and expired is worst", 45 * day, 60 * day, 30 * day, true, ExitCodeExpired},
+		{"warning only", 45 * day, 60 * day, 5 * day, false, ExitCodeWarning},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			thresholds := ExpiryThresholds{
+				Within:   tt.within,
+				Critical: tt.critical,
+				Now:      time.Now().Add(tt.later),
+			}
+			err := CertificateExpiring(tv.logger, vaults, testTimeout, thresholds, tt.includeDisabled, OutputJSONL, nil)
+			if tt.wantCode == 0 {
+				if err != nil {
+					t.Errorf("unexpected err: %+v", err)
+				}
+				return
+			}
+			var exitCodeErr *ExitCodeError
+			if !errors.As(err, &exitCodeErr) {
+				t.Fatalf("err = %v, want an *ExitCodeError", err)
+			}
+			if exitCodeErr.Code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d (%s)", exitCodeErr.Code, tt.wantCode, exitCodeErr.Message)
+			}
+		})
+	}
+
+	err := CertificateExpiring(tv.logger, vaults, testTimeout, ExpiryThresholds{Within: day, Critical: 2 * day}, false, OutputJSONL, nil)
+	var exitCodeErr *ExitCodeError
+	if err == nil || errors.As(err, &exitCodeErr) {
+		t.Errorf("critical past within should be a plain error, got %v", err)
+	}
+}
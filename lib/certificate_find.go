@@ -0,0 +1,319 @@
+package lib
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// Where a CertificateHostMatch's names came from
+const (
+	// MatchSourceCertificate means the issued X.509 certificate was parsed
+	MatchSourceCertificate = "certificate"
+	// MatchSourcePolicy means there's no issued certificate yet (for
+	// example, it's pending with a CA), so the policy was used
+	MatchSourcePolicy = "policy"
+)
+
+// CertificateHostMatch is a certificate that covers a hostname
+type CertificateHostMatch struct {
+	// Vault is the vault's alias, or its URL if it doesn't have one
+	Vault string `json:"vault"`
+	Host  string `json:"host"`
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	// MatchedBy is "san" or "cn"
+	MatchedBy string `json:"matched_by"`
+	// Match is the SAN or CN that matched, like *.example.com
+	Match   string            `json:"match"`
+	Source  string            `json:"source"`
+	Enabled *bool             `json:"enabled"`
+	Expires *time.Time        `json:"expires"`
+	Tags    map[string]string `json:"tags"`
+}
+
+// DefaultCertificateFindFields are the table and csv columns when no fields
+// are passed
+var DefaultCertificateFindFields = []string{"vault", "host", "name", "matched_by", "match", "enabled", "expires"}
+
+// normalizeHost lowercases and drops a trailing dot
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// HostMatches reports whether a certificate name (a DNS SAN or CN) covers
+// host. Like browsers (RFC 6125), a wildcard is only allowed as the whole
+// leftmost label and matches exactly one label: *.example.com matches
+// api.example.com, but not example.com or a.b.example.com. Like
+// ValidateDNSName, a wildcard needs at least two more labels, so *.com
+// matches nothing
+func HostMatches(pattern string, host string) bool {
+	pattern = normalizeHost(pattern)
+	host = normalizeHost(host)
+	if pattern == "" || host == "" {
+		return false
+	}
+	if !strings.HasPrefix(pattern, "*.") {
+		return pattern == host
+	}
+	labels := strings.Split(pattern[2:], ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if l == "" {
+			return false
+		}
+	}
+	i := strings.Index(host, ".")
+	if i <= 0 {
+		return false
+	}
+	return host[i+1:] == pattern[2:]
+}
+
+// certificateNames returns the DNS SANs and CN from the issued certificate,
+// or from the policy if it hasn't been issued yet
+func certificateNames(bundle keyvault.CertificateBundle) ([]string, string, string, error) {
+	if bundle.Cer != nil && len(*bundle.Cer) > 0 {
+		cert, err := x509.ParseCertificate(*bundle.Cer)
+		if err != nil {
+			return nil, "", "", errors.WithStack(err)
+		}
+		return cert.DNSNames, cert.Subject.CommonName, MatchSourceCertificate, nil
+	}
+
+	var sans []string
+	cn := ""
+	if bundle.Policy != nil && bundle.Policy.X509CertificateProperties != nil {
+		props := bundle.Policy.X509CertificateProperties
+		if props.SubjectAlternativeNames != nil && props.SubjectAlternativeNames.DNSNames != nil {
+			sans = *props.SubjectAlternativeNames.DNSNames
+		}
+		if props.Subject != nil {
+			cn = subjectCommonName(*props.Subject)
+		}
+	}
+	return sans, cn, MatchSourcePolicy, nil
+}
+
+// subjectCommonName pulls the CN out of a policy subject like
+// "CN=example.com, O=Example", or returns "" if there isn't one
+func subjectCommonName(subject string) string {
+	rdns, err := ParseDN(subject)
+	if err != nil {
+		return ""
+	}
+	cn, _ := CommonName(rdns)
+	return cn
+}
+
+// MatchCertificateHosts returns a match for each host the certificate
+// covers. SANs are checked first; the CN is only checked if there are no DNS
+// SANs, which is what browsers do
+func MatchCertificateHosts(vaultLabel string, bundle keyvault.CertificateBundle, hosts []string) ([]CertificateHostMatch, error) {
+	sans, cn, source, err := certificateNames(bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []CertificateHostMatch
+	for _, host := range hosts {
+		matchedBy := ""
+		match := ""
+		for _, san := range sans {
+			if HostMatches(san, host) {
+				matchedBy, match = "san", san
+				break
+			}
+		}
+		if matchedBy == "" && len(sans) == 0 && HostMatches(cn, host) {
+			matchedBy, match = "cn", cn
+		}
+		if matchedBy == "" {
+			continue
+		}
+
+		m := CertificateHostMatch{
+			Vault:     vaultLabel,
+			Host:      host,
+			MatchedBy: matchedBy,
+			Match:     match,
+			Source:    source,
+			Tags:      tagsToMap(bundle.Tags),
+		}
+		if bundle.ID != nil {
+			m.ID = *bundle.ID
+			m.Name, _ = ParseCertificateID(*bundle.ID)
+		}
+		if bundle.Attributes != nil {
+			m.Enabled = bundle.Attributes.Enabled
+			m.Expires = unixTimeToTime(bundle.Attributes.Expires)
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+// listCertificateNames pages through every certificate name in a vault
+func listCertificateNames(ctx context.Context, kvClient KeyVaultClient, vaultURL string) ([]string, error) {
+	certs, err := kvClient.GetCertificatesComplete(ctx, vaultURL, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var names []string
+	for certs.NotDone() {
+		cert := certs.Value()
+		if cert.ID != nil {
+			name, _ := ParseCertificateID(*cert.ID)
+			names = append(names, name)
+		}
+		err = certs.NextWithContext(ctx)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return names, nil
+}
+
+// CertificateFind prints every certificate in vaults whose latest version
+// covers one of hosts. Each certificate needs a GetCertificate, so up to
+// concurrency of them run at once. Errors with one vault or certificate are
+// logged and the search carries on; an error is returned at the end
+func CertificateFind(
+	logger *logos.Logger,
+	vaults []Vault,
+	timeout time.Duration,
+	hosts []string,
+	concurrency int,
+	outputFormat string,
+	fields []string,
+) error {
+	if len(hosts) == 0 {
+		err := errors.New("no hosts passed")
+		logger.Errorw(
+			"Pass at least one --host",
+			"err", err,
+		)
+		return err
+	}
+	if concurrency < 1 {
+		err := errors.Errorf("concurrency must be at least 1: %d", concurrency)
+		logger.Errorw(
+			"Invalid --concurrency",
+			"err", err,
+		)
+		return err
+	}
+
+	out, err := NewListWriter(os.Stdout, outputFormat, fields, DefaultCertificateFindFields)
+	if err != nil {
+		logger.Errorw(
+			"Can't write output",
+			"outputFormat", outputFormat,
+			"fields", fields,
+			"err", err,
+		)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var matches []CertificateHostMatch
+	failed := 0
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, vault := range vaults {
+		names, err := listCertificateNames(ctx, vault.Client, vault.URL)
+		if err != nil {
+			logger.Errorw(
+				"Can't list certificates",
+				"vaultURL", vault.URL,
+				"err", err,
+			)
+			mu.Lock()
+			failed++
+			mu.Unlock()
+			continue
+		}
+
+		for _, name := range names {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(vault Vault, name string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				bundle, err := vault.Client.GetCertificate(ctx, vault.URL, name, "")
+				if err == nil {
+					var m []CertificateHostMatch
+					m, err = MatchCertificateHosts(vault.Label(), bundle, hosts)
+					if err == nil {
+						mu.Lock()
+						matches = append(matches, m...)
+						mu.Unlock()
+						return
+					}
+				}
+				logger.Errorw(
+					"Can't check certificate",
+					"vaultURL", vault.URL,
+					"certName", name,
+					"err", errors.WithStack(err),
+				)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}(vault, name)
+		}
+	}
+	wg.Wait()
+
+	// goroutines finish in any order
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Vault != matches[j].Vault {
+			return matches[i].Vault < matches[j].Vault
+		}
+		if matches[i].Name != matches[j].Name {
+			return matches[i].Name < matches[j].Name
+		}
+		return matches[i].Host < matches[j].Host
+	})
+
+	for _, m := range matches {
+		err = out.Write(m)
+		if err != nil {
+			logger.Errorw(
+				"Can't write match",
+				"match", m,
+				"err", err,
+			)
+			return err
+		}
+	}
+	err = out.Close()
+	if err != nil {
+		logger.Errorw(
+			"Can't write output",
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d vaults or certificates couldn't be checked. See the log", failed)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+)
+
+// testPolicyBundle is a pending certificate: just a policy, no x509
+func testPolicyBundle(subject string, sans []string) keyvault.CertificateBundle {
+	return keyvault.CertificateBundle{
+		ID: strPtr("https://test.vault.azure.net/certificates/test-cert/0123"),
+		Policy: &keyvault.CertificatePolicy{
+			X509CertificateProperties: &keyvault.X509CertificateProperties{
+				Subject:                 &subject,
+				SubjectAlternativeNames: &keyvault.SubjectAlternativeNames{DNSNames: &sans},
+			},
+		},
+	}
+}
+
+func TestHostMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"example.com", "example.com", true},
+		{"Example.COM.", "example.com", true},
+		{"example.com", " EXAMPLE.com. ", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "API.Example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.a.example.com", "x.a.example.com", true},
+		// ValidateDNSName rejects wildcards over fewer than two labels
+		{"*.com", "example.com", false},
+		{"*.com.", "example.com", false},
+		{"*..com", "a..com", false},
+		{"*", "example", false},
+		// only a whole leftmost label is a wildcard
+		{"a*.example.com", "ab.example.com", false},
+		{"api.*.com", "api.example.com", false},
+		{"", "example.com", false},
+		{"example.com", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.host, func(t *testing.T) {
+			if got := HostMatches(tt.pattern, tt.host); got != tt.want {
+				t.Errorf("HostMatches(%#v, %#v) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostMatchesAgreesWithValidateDNSName(t *testing.T) {
+	// a wildcard that matches something must be a valid SAN
+	for _, pattern := range []string{"*.com", "*.example.com", "*.a.b.example.com", "*"} {
+		host := "x" + pattern[1:]
+		if HostMatches(pattern, host) && ValidateDNSName(pattern) != nil {
+			t.Errorf("HostMatches accepts %#v, which ValidateDNSName rejects", pattern)
+		}
+	}
+}
+
+func TestMatchCertificateHosts(t *testing.T) {
+	subject := "CN=example.com"
+	sans := []string{"www.example.com", "*.api.example.com"}
+	bundle := testPolicyBundle(subject, sans)
+	noSANs := testPolicyBundle(subject, nil)
+
+	tests := []struct {
+		name          string
+		bundle        keyvault.CertificateBundle
+		host          string
+		wantMatchedBy string
+	}{
+		{"san", bundle, "www.example.com", "san"},
+		{"wildcard san", bundle, "v1.api.example.com", "san"},
+		{"cn ignored when there are sans", bundle, "example.com", ""},
+		{"cn without sans", noSANs, "example.com", "cn"},
+		{"no match", bundle, "other.example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, err := MatchCertificateHosts("test", tt.bundle, []string{tt.host})
+			if err != nil {
+				t.Fatal(err)
+			}
+			matchedBy := ""
+			if len(matches) > 0 {
+				matchedBy = matches[0].MatchedBy
+				if matches[0].Source != MatchSourcePolicy || matches[0].Name != "test-cert" {
+					t.Errorf("unexpected match: %#v", matches[0])
+				}
+			}
+			if matchedBy != tt.wantMatchedBy {
+				t.Errorf("matched by %#v, want %#v", matchedBy, tt.wantMatchedBy)
+			}
+		})
+	}
+}
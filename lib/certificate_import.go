@@ -0,0 +1,438 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// ImportExtensions are the file extensions `certificate import --dir` picks up
+var ImportExtensions = []string{".pfx", ".p12", ".pem"}
+
+// Key Vault's certificate name rules
+const maxCertificateNameLength = 127
+
+var certificateNameRe = regexp.MustCompile(`^[0-9a-zA-Z-]+$`)
+
+var invalidCertificateNameCharsRe = regexp.MustCompile(`[^0-9a-zA-Z]+`)
+
+// ImportTarget is a file to import as the certificate Name
+type ImportTarget struct {
+	Name string
+	Path string
+}
+
+// ValidateCertificateName checks name is a name Key Vault accepts
+func ValidateCertificateName(name string) error {
+	if !certificateNameRe.MatchString(name) {
+		return errors.Errorf("certificate name %#v can only have letters, digits and -", name)
+	}
+	if len(name) > maxCertificateNameLength {
+		return errors.Errorf("certificate name %#v is longer than %d characters", name, maxCertificateNameLength)
+	}
+	return nil
+}
+
+// CertificateNameFromPath derives a certificate name from a file name by
+// dropping the extension and replacing anything Key Vault doesn't allow with
+// -. Example: certs/www.example.com_2021.pfx -> www-example-com-2021
+func CertificateNameFromPath(path string) (string, error) {
+	base := filepath.Base(path)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	name := strings.Trim(invalidCertificateNameCharsRe.ReplaceAllString(base, "-"), "-")
+	err := ValidateCertificateName(name)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't derive a certificate name from %s", path)
+	}
+	return name, nil
+}
+
+// ImportTargetsFromDir lists the ImportExtensions files in dir (not
+// subdirectories), named after their file names
+func ImportTargetsFromDir(dir string) ([]ImportTarget, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var targets []ImportTarget
+	paths := make(map[string]string)
+	for _, e := range entries {
+		if e.IsDir() || !containsString(ImportExtensions, strings.ToLower(filepath.Ext(e.Name()))) {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		name, err := CertificateNameFromPath(path)
+		if err != nil {
+			return nil, err
+		}
+		// Key Vault names are case insensitive
+		if other, exists := paths[strings.ToLower(name)]; exists {
+			return nil, errors.Errorf("%s and %s would both be imported as %s. Rename one", other, path, name)
+		}
+		paths[strings.ToLower(name)] = path
+		targets = append(targets, ImportTarget{Name: name, Path: path})
+	}
+	if len(targets) == 0 {
+		return nil, errors.Errorf("no %s files in %s", strings.Join(ImportExtensions, ", "), dir)
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+	return targets, nil
+}
+
+// importFile is a read and checked file, ready to import
+type importFile struct {
+	target ImportTarget
+	// value is what Key Vault wants: base64 for PKCS #12, text for PEM
+	value       string
+	password    string
+	contentType string
+	leaf        *x509.Certificate
+	chain       []*x509.Certificate
+	keyType     string
+	keySize     int32
+}
+
+// keyTypeAndSize returns the Key Vault key type and size of key
+func keyTypeAndSize(key crypto.PrivateKey) (string, int32, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA", int32(k.N.BitLen()), nil
+	case *ecdsa.PrivateKey:
+		return "EC", int32(k.Curve.Params().BitSize), nil
+	}
+	return "", 0, errors.Errorf("unsupported private key type %T. Key Vault supports RSA and EC keys", key)
+}
+
+// readImportFile reads a PKCS #12 file (decrypted with password) or a PEM
+// file with a private key, its certificate and optionally the chain, in any
+// order
+func readImportFile(target ImportTarget, password string) (importFile, error) {
+	f := importFile{target: target}
+	data, err := ioutil.ReadFile(target.Path)
+	if err != nil {
+		return f, errors.WithStack(err)
+	}
+
+	var key crypto.PrivateKey
+	var certs []*x509.Certificate
+	if bytes.Contains(data, []byte("-----BEGIN ")) {
+		key, certs, err = parsePEMKeyAndCertificates(data)
+		if err != nil {
+			return f, err
+		}
+		if key == nil {
+			return f, errors.New("no private key. Concatenate the key, certificate and chain into one PEM file")
+		}
+		f.contentType = ContentTypePEM
+	} else {
+		var leaf *x509.Certificate
+		var caCerts []*x509.Certificate
+		key, leaf, caCerts, err = pkcs12.DecodeChain(data, password)
+		if err == pkcs12.ErrIncorrectPassword {
+			if password == "" {
+				return f, errors.New("the PFX is password protected. Pass --password-env")
+			}
+			return f, errors.New("wrong PFX password")
+		}
+		if err != nil {
+			return f, errors.Wrap(err, "can't read file as PEM or PFX")
+		}
+		certs = append([]*x509.Certificate{leaf}, caCerts...)
+		f.contentType = ContentTypePKCS12
+		f.value = base64.StdEncoding.EncodeToString(data)
+		f.password = password
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return f, errors.Errorf("unsupported private key type %T", key)
+	}
+	for _, c := range certs {
+		if f.leaf == nil && samePublicKey(c.PublicKey, signer.Public()) {
+			f.leaf = c
+		} else {
+			f.chain = append(f.chain, c)
+		}
+	}
+	if f.leaf == nil {
+		return f, errors.New("no certificate matches the private key")
+	}
+	err = checkChainOrder(append([]*x509.Certificate{f.leaf}, f.chain...))
+	if err != nil {
+		return f, err
+	}
+	f.keyType, f.keySize, err = keyTypeAndSize(key)
+	if err != nil {
+		return f, err
+	}
+
+	if f.contentType == ContentTypePEM {
+		// normalize to the key, certificate, then chain
+		keyPEM, err := marshalPrivateKeyPEM(key)
+		if err != nil {
+			return f, err
+		}
+		f.value = string(append(keyPEM, certificatesPEM(append([]*x509.Certificate{f.leaf}, f.chain...))...))
+	}
+	return f, nil
+}
+
+// importPolicyProblems are the problems with the parts of params that come
+// from the config or flags. The rest comes from the imported file
+func importPolicyProblems(params keyvault.CertificateCreateParameters) ValidationErrors {
+	var problems ValidationErrors
+	for _, p := range ValidateCertificateCreateParameters(params) {
+		if strings.HasPrefix(p.Path, "tags") || strings.HasPrefix(p.Path, "certificate_policy.lifetime_actions") {
+			problems = append(problems, p)
+		}
+	}
+	return problems
+}
+
+// autoRenewToEmailContacts replaces AutoRenew lifetime actions with
+// EmailContacts. Key Vault can't renew certificates from issuers it doesn't
+// integrate with. It returns whether any were replaced
+func autoRenewToEmailContacts(las *[]keyvault.LifetimeAction) bool {
+	if las == nil {
+		return false
+	}
+	replaced := false
+	for i, la := range *las {
+		if la.Action != nil && la.Action.ActionType == keyvault.AutoRenew {
+			(*las)[i].Action = &keyvault.Action{ActionType: keyvault.EmailContacts}
+			replaced = true
+		}
+	}
+	return replaced
+}
+
+// importParameters builds the parameters to import f with from the shared
+// params: the key type and size, content type and x509 properties come
+// from the file
+func importParameters(params keyvault.CertificateCreateParameters, f importFile) keyvault.CertificateImportParameters {
+	policy := *params.CertificatePolicy
+
+	keyProps := *policy.KeyProperties
+	keyProps.KeyType = &f.keyType
+	keyProps.KeySize = &f.keySize
+	policy.KeyProperties = &keyProps
+
+	policy.SecretProperties = &keyvault.SecretProperties{ContentType: &f.contentType}
+
+	subject := f.leaf.Subject.String()
+	dnsNames := f.leaf.DNSNames
+	policy.X509CertificateProperties = &keyvault.X509CertificateProperties{
+		Subject: &subject,
+		SubjectAlternativeNames: &keyvault.SubjectAlternativeNames{
+			DNSNames: &dnsNames,
+		},
+	}
+
+	ip := keyvault.CertificateImportParameters{
+		Base64EncodedCertificate: &f.value,
+		CertificatePolicy:        &policy,
+		CertificateAttributes:    params.CertificateAttributes,
+		Tags:                     params.Tags,
+	}
+	if f.password != "" {
+		ip.Password = &f.password
+	}
+	return ip
+}
+
+// importPrompt shows what will be imported and asks for confirmation
+func importPrompt(vaultURL string, params keyvault.CertificateCreateParameters, files []importFile, existing map[string]bool) error {
+	fmt.Printf("%d certificate(s) will be imported into keyvault '%s':\n", len(files), vaultURL)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tFILE\tSUBJECT\tEXPIRES\tCHAIN\t")
+	for _, f := range files {
+		name := f.target.Name
+		if existing[f.target.Name] {
+			name += " (new version)"
+		}
+		expires := f.leaf.NotAfter.Format(time.RFC3339)
+		if time.Now().After(f.leaf.NotAfter) {
+			expires += " (expired)"
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\t\n", name, f.target.Path, f.leaf.Subject.String(), expires, len(f.chain))
+	}
+	err := tw.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	fmt.Println("With:")
+	tw = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  Issuer:\t%s\n", formatStrPtr(params.CertificatePolicy.IssuerParameters.Name))
+	fmt.Fprintf(tw, "  Enabled:\t%s\n", formatBoolPtr(params.CertificateAttributes.Enabled))
+	fmt.Fprintf(tw, "  Exportable:\t%s\n", formatBoolPtr(params.CertificatePolicy.KeyProperties.Exportable))
+	fmt.Fprintf(tw, "  Lifetime Actions:\t%s\n", formatLifetimeActions(params.CertificatePolicy.LifetimeActions))
+	tags := make([]string, 0, len(params.Tags))
+	for k, v := range params.Tags {
+		tags = append(tags, k+"="+formatStrPtr(v))
+	}
+	sort.Strings(tags)
+	fmt.Fprintf(tw, "  Tags:\t%s\n", strings.Join(tags, ", "))
+	err = tw.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return confirmPrompt()
+}
+
+// CertificateImport imports PFX or PEM files (see readImportFile) with the
+// tags, attributes and lifetime actions from the config (or template)
+// overwritten with flags. Every file is checked before anything is
+// imported. A failed import doesn't stop the rest
+func CertificateImport(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	targets []ImportTarget,
+	cfgCertCreateParams CfgCertificateCreateParameters,
+	flagCertCreateParams FlagCertificateCreateParameters,
+	password string,
+	newVersionOk bool,
+	skipConfirmation bool,
+) error {
+	// Key Vault can only renew certificates from issuers it integrates
+	// with, so imported certificates default to Unknown
+	if flagCertCreateParams.IssuerName == "" {
+		flagCertCreateParams.IssuerName = "Unknown"
+	}
+	params := BuildCertificateCreateParameters(cfgCertCreateParams, flagCertCreateParams)
+	replacedAutoRenew := formatStrPtr(params.CertificatePolicy.IssuerParameters.Name) == "Unknown" &&
+		autoRenewToEmailContacts(params.CertificatePolicy.LifetimeActions)
+	problems := importPolicyProblems(params)
+	if len(problems) > 0 {
+		names := make([]string, 0, len(targets))
+		for _, t := range targets {
+			names = append(names, t.Name)
+		}
+		logValidationErrors(logger, "Invalid certificate import parameters. Fix the flags or config - `config validate` shows config line numbers", strings.Join(names, ", "), problems)
+		return problems
+	}
+
+	var files []importFile
+	var errs []string
+	for _, t := range targets {
+		f, err := readImportFile(t, password)
+		if err == nil {
+			err = ValidateCertificateName(t.Name)
+		}
+		if err != nil {
+			logger.Errorw(
+				"Can't import file",
+				"certName", t.Name,
+				"path", t.Path,
+				"err", err,
+			)
+			errs = append(errs, t.Path)
+			continue
+		}
+		files = append(files, f)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("%d of %d files can't be imported: %s", len(errs), len(targets), strings.Join(errs, ", "))
+	}
+
+	// check if they exist - the same small race condition as CertificateCreate
+	existing := make(map[string]bool)
+	for _, f := range files {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := kvClient.GetCertificate(ctx, vaultURL, f.target.Name, "")
+		cancel()
+		if err == nil {
+			existing[f.target.Name] = true
+			if !newVersionOk {
+				logger.Errorw(
+					"certificate already exists for name. Pass `--new-version-ok` to import a new version",
+					"certName", f.target.Name,
+					"path", f.target.Path,
+				)
+				errs = append(errs, f.target.Name)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("certificates already exist: %s", strings.Join(errs, ", "))
+	}
+
+	if replacedAutoRenew {
+		logger.Infow(
+			"AutoRenew lifetime actions changed to EmailContacts. Key Vault can't renew certificates with issuer Unknown",
+			"lifetimeActions", formatLifetimeActions(params.CertificatePolicy.LifetimeActions),
+		)
+	}
+
+	if !skipConfirmation {
+		err := importPrompt(vaultURL, params, files, existing)
+		if err != nil {
+			logger.Errorw(
+				"Can't confirm import",
+				"vaultURL", vaultURL,
+				"err", err,
+			)
+			return err
+		}
+	}
+
+	for _, f := range files {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		bundle, err := kvClient.ImportCertificate(ctx, vaultURL, f.target.Name, importParameters(params, f))
+		cancel()
+		if err != nil {
+			err = errors.WithStack(err)
+			logger.Errorw(
+				"certificate import error",
+				"certName", f.target.Name,
+				"path", f.target.Path,
+				"err", err,
+			)
+			errs = append(errs, f.target.Name)
+			continue
+		}
+		details, err := NewCertificateDetails(bundle)
+		if err != nil {
+			logger.Errorw(
+				"Can't parse imported certificate",
+				"certName", f.target.Name,
+				"err", err,
+			)
+			errs = append(errs, f.target.Name)
+			continue
+		}
+		logger.Infow(
+			"certificate imported",
+			"certName", f.target.Name,
+			"path", f.target.Path,
+			"version", details.Version,
+			"thumbprint", details.Thumbprint,
+			"expires", formatTimePtr(details.Expires),
+			"chainLength", len(f.chain),
+		)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("%d of %d imports failed: %s", len(errs), len(files), strings.Join(errs, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,323 @@
+package lib
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// CertificateListItemAttributes are a CertificateItem's attributes with
+// readable times
+type CertificateListItemAttributes struct {
+	Enabled       *bool      `json:"enabled"`
+	NotBefore     *time.Time `json:"not_before"`
+	Expires       *time.Time `json:"expires"`
+	Created       *time.Time `json:"created"`
+	Updated       *time.Time `json:"updated"`
+	RecoveryLevel string     `json:"recovery_level"`
+}
+
+// CertificateListItem is a CertificateItem flattened for output. Its JSON
+// keys are what --fields selects from
+type CertificateListItem struct {
+	// Vault is the vault's alias, or its URL if it doesn't have one
+	Vault      string                        `json:"vault"`
+	ID         string                        `json:"id"`
+	Name       string                        `json:"name"`
+	Attributes CertificateListItemAttributes `json:"attributes"`
+	Tags       map[string]string             `json:"tags"`
+	Thumbprint string                        `json:"thumbprint"`
+	// Details needs a GetCertificate, so it's only set by --detailed
+	Details *CertificateListItemDetails `json:"details,omitempty"`
+}
+
+// CertificateListItemDetails are the parts of the latest CertificateBundle
+// a CertificateItem doesn't have
+type CertificateListItemDetails struct {
+	Subject          string   `json:"subject"`
+	SANs             []string `json:"sans"`
+	X509Issuer       string   `json:"x509_issuer"`
+	IssuerName       string   `json:"issuer_name"`
+	KeyType          string   `json:"key_type"`
+	KeySize          *int32   `json:"key_size"`
+	ValidityInMonths *int32   `json:"validity_in_months"`
+	ContentType      string   `json:"content_type"`
+}
+
+// DefaultCertificateListFields are the table and csv columns when no fields
+// are passed
+var DefaultCertificateListFields = []string{"name", "attributes.enabled", "attributes.expires", "tags"}
+
+// DefaultCertificateListDetailedFields are DefaultCertificateListFields for
+// --detailed
+var DefaultCertificateListDetailedFields = []string{"name", "attributes.enabled", "attributes.expires", "details.issuer_name", "details.sans"}
+
+// NewCertificateListItem flattens a CertificateItem
+func NewCertificateListItem(item keyvault.CertificateItem) CertificateListItem {
+	ret := CertificateListItem{
+		Tags:       tagsToMap(item.Tags),
+		Thumbprint: thumbprintHex(item.X509Thumbprint),
+	}
+	if item.ID != nil {
+		ret.ID = *item.ID
+		ret.Name, _ = ParseCertificateID(*item.ID)
+	}
+	if item.Attributes != nil {
+		ret.Attributes = CertificateListItemAttributes{
+			Enabled:       item.Attributes.Enabled,
+			NotBefore:     unixTimeToTime(item.Attributes.NotBefore),
+			Expires:       unixTimeToTime(item.Attributes.Expires),
+			Created:       unixTimeToTime(item.Attributes.Created),
+			Updated:       unixTimeToTime(item.Attributes.Updated),
+			RecoveryLevel: string(item.Attributes.RecoveryLevel),
+		}
+	}
+	return ret
+}
+
+// NewCertificateListItemDetails pulls details out of a CertificateBundle.
+// Subject, SANs and issuer come from the issued certificate if there is one,
+// otherwise from the policy
+func NewCertificateListItemDetails(bundle keyvault.CertificateBundle) (*CertificateListItemDetails, error) {
+	d := &CertificateListItemDetails{SANs: []string{}}
+	if p := bundle.Policy; p != nil {
+		if p.IssuerParameters != nil && p.IssuerParameters.Name != nil {
+			d.IssuerName = *p.IssuerParameters.Name
+		}
+		if p.KeyProperties != nil {
+			d.KeyType = formatStrPtr(p.KeyProperties.KeyType)
+			d.KeySize = p.KeyProperties.KeySize
+		}
+		if p.SecretProperties != nil {
+			d.ContentType = formatStrPtr(p.SecretProperties.ContentType)
+		}
+		if props := p.X509CertificateProperties; props != nil {
+			d.Subject = formatStrPtr(props.Subject)
+			d.ValidityInMonths = props.ValidityInMonths
+			if props.SubjectAlternativeNames != nil && props.SubjectAlternativeNames.DNSNames != nil {
+				d.SANs = *props.SubjectAlternativeNames.DNSNames
+			}
+		}
+	}
+	if bundle.Cer != nil && len(*bundle.Cer) > 0 {
+		cert, err := x509.ParseCertificate(*bundle.Cer)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		d.Subject = cert.Subject.String()
+		d.X509Issuer = cert.Issuer.String()
+		if cert.DNSNames != nil {
+			d.SANs = cert.DNSNames
+		}
+	}
+	return d, nil
+}
+
+// listCertificates calls emit with every certificate that matches filter
+func listCertificates(
+	ctx context.Context,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	filter CertificateFilter,
+	emit func(keyvault.CertificateItem) error,
+) error {
+	// TODO: this crosses boundaries as needed. If it does that lazily, will the context time out?
+	certs, err := kvClient.GetCertificatesComplete(ctx, vaultURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "can't get certificates")
+	}
+	for certs.NotDone() {
+		cert := certs.Value()
+		if filter.Match(cert) {
+			err = emit(cert)
+			if err != nil {
+				return err
+			}
+		}
+		err = certs.NextWithContext(ctx)
+		if err != nil {
+			return errors.Wrap(err, "can't advance certs list")
+		}
+	}
+	return nil
+}
+
+// detailedResult is one certificate's place in the --detailed pipeline
+type detailedResult struct {
+	item CertificateListItem
+	err  error
+}
+
+// listCertificatesDetailed is listCertificates plus a GetCertificate for
+// each match. Up to concurrency GetCertificates run at once, but emit is
+// called in list order, as soon as the oldest outstanding fetch finishes.
+// The first failed fetch stops the listing and is returned once every
+// certificate before it has been emitted
+func listCertificatesDetailed(
+	ctx context.Context,
+	vault Vault,
+	filter CertificateFilter,
+	concurrency int,
+	emit func(CertificateListItem) error,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each fetch gets its own channel, queued in list order. The queue's
+	// size plus sem bound how many fetches are outstanding
+	queue := make(chan chan detailedResult, concurrency)
+	sem := make(chan struct{}, concurrency)
+
+	go func() {
+		defer close(queue)
+		err := listCertificates(ctx, vault.Client, vault.URL, filter, func(cert keyvault.CertificateItem) error {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return errors.WithStack(ctx.Err())
+			}
+			resultCh := make(chan detailedResult, 1)
+			select {
+			case queue <- resultCh:
+			case <-ctx.Done():
+				<-sem
+				return errors.WithStack(ctx.Err())
+			}
+			go func() {
+				defer func() { <-sem }()
+				item := NewCertificateListItem(cert)
+				item.Vault = vault.Label()
+				bundle, err := vault.Client.GetCertificate(ctx, vault.URL, item.Name, "")
+				if err != nil {
+					resultCh <- detailedResult{err: errors.Wrapf(err, "can't get certificate: %#v", item.Name)}
+					return
+				}
+				item.Details, err = NewCertificateListItemDetails(bundle)
+				if err != nil {
+					err = errors.WithMessagef(err, "can't parse certificate: %#v", item.Name)
+				}
+				resultCh <- detailedResult{item: item, err: err}
+			}()
+			return nil
+		})
+		if err != nil {
+			resultCh := make(chan detailedResult, 1)
+			resultCh <- detailedResult{err: err}
+			select {
+			case queue <- resultCh:
+			case <-ctx.Done():
+			}
+		}
+	}()
+
+	for resultCh := range queue {
+		result := <-resultCh
+		if result.err != nil {
+			return result.err
+		}
+		err := emit(result.item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CertificateList prints every certificate in vaults that matches filter
+// in one of ListOutputFormats. fields selects what to print (see
+// ParseFields); nil means the format's default. detailed also fetches each
+// certificate (concurrency at a time) for its subject, SANs, issuer and key
+func CertificateList(
+	logger *logos.Logger,
+	vaults []Vault,
+	timeout time.Duration,
+	filter CertificateFilter,
+	detailed bool,
+	concurrency int,
+	outputFormat string,
+	fields []string,
+) error {
+
+	err := filter.Validate()
+	if err != nil {
+		logger.Errorw(
+			"Invalid filter",
+			"err", err,
+		)
+		return err
+	}
+	if detailed && concurrency < 1 {
+		err := errors.Errorf("concurrency must be at least 1: %d", concurrency)
+		logger.Errorw(
+			"Invalid --concurrency",
+			"err", err,
+		)
+		return err
+	}
+
+	defaultFields := DefaultCertificateListFields
+	if detailed {
+		defaultFields = DefaultCertificateListDetailedFields
+	}
+	if len(vaults) > 1 {
+		defaultFields = append([]string{"vault"}, defaultFields...)
+	}
+	out, err := NewListWriter(os.Stdout, outputFormat, fields, defaultFields)
+	if err != nil {
+		logger.Errorw(
+			"Can't write output",
+			"outputFormat", outputFormat,
+			"fields", fields,
+			"err", err,
+		)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	write := func(item CertificateListItem) error {
+		err := out.Write(item)
+		if err != nil {
+			return errors.WithMessagef(err, "can't write cert info: %#v", item.Name)
+		}
+		return nil
+	}
+	for _, vault := range vaults {
+		if detailed {
+			err = listCertificatesDetailed(ctx, vault, filter, concurrency, write)
+		} else {
+			err = listCertificates(ctx, vault.Client, vault.URL, filter, func(cert keyvault.CertificateItem) error {
+				item := NewCertificateListItem(cert)
+				item.Vault = vault.Label()
+				return write(item)
+			})
+		}
+		if err != nil {
+			logger.Errorw(
+				"Can't list certificates",
+				"vaultURL", vault.URL,
+				"detailed", detailed,
+				"err", err,
+			)
+			return err
+		}
+	}
+
+	err = out.Close()
+	if err != nil {
+		logger.Errorw(
+			"Can't write output",
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+
+	return nil
+}
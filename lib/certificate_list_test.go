@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListCertificatesDetailed(t *testing.T) {
+	const certs = 10
+	const concurrency = 3
+	tv := newTestVault(t, 4)
+	var want []string
+	for i := 0; i < certs; i++ {
+		name := fmt.Sprintf("cert-%02d", i)
+		tv.createTestCertificate(t, name)
+		want = append(want, name)
+	}
+
+	// requests cancelled by a failure can reach the handler after their
+	// subtest is done, so the intercept is set once and its state is
+	// guarded by mu
+	var mu sync.Mutex
+	var failCert string
+	var inFlight, maxInFlight int
+	tv.intercept = func(w http.ResponseWriter, r *http.Request) {
+		// GetCertificate for the latest version is /certificates/{name}/
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/certificates/"), "/")
+		if r.URL.Path == "/certificates" || !strings.HasSuffix(r.URL.Path, "/") {
+			tv.fake.ServeHTTP(w, r)
+			return
+		}
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		fail := name == failCert
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		// earlier certificates finish last, so emit has to wait for them
+		var i int
+		fmt.Sscanf(name, "cert-%d", &i)
+		time.Sleep(time.Duration(certs-i) * 2 * time.Millisecond)
+		if fail {
+			http.Error(w, `{"error": {"code": "Forbidden", "message": "no get permission"}}`, http.StatusForbidden)
+			return
+		}
+		tv.fake.ServeHTTP(w, r)
+	}
+
+	tests := []struct {
+		name     string
+		failCert string
+		// want is emitted names. Everything before the failure is emitted
+		want []string
+	}{
+		// runs first, so no cancelled requests skew maxInFlight
+		{"all", "", want},
+		{"one fails", "cert-05", want[:5]},
+		{"first fails", "cert-00", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			failCert = tt.failCert
+			maxInFlight = 0
+			mu.Unlock()
+			atomic.StoreInt64(&tv.listRequests, 0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			vault := Vault{Alias: "test", URL: tv.vaultURL, Client: tv.kvClient}
+			var got []string
+			err := listCertificatesDetailed(ctx, vault, CertificateFilter{}, concurrency, func(item CertificateListItem) error {
+				if item.Details == nil || item.Vault != "test" {
+					t.Errorf("item %s is missing details or its vault: %+v", item.Name, item)
+				}
+				got = append(got, item.Name)
+				return nil
+			})
+
+			if tt.failCert == "" && err != nil {
+				t.Fatalf("unexpected err: %+v", err)
+			}
+			if tt.failCert != "" && (err == nil || !strings.Contains(err.Error(), tt.failCert)) {
+				t.Errorf("err = %v, want it to name %s", err, tt.failCert)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("emitted %v, want %v", got, tt.want)
+			}
+
+			// after a failure, cancelled requests can still be sleeping in
+			// the handler, so only check concurrency when nothing fails
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.failCert == "" {
+				if maxInFlight > concurrency {
+					t.Errorf("%d GetCertificates ran at once, want at most %d", maxInFlight, concurrency)
+				}
+				if maxInFlight < 2 {
+					t.Errorf("GetCertificates didn't run concurrently")
+				}
+				// pages of 4
+				if got := atomic.LoadInt64(&tv.listRequests); got != 3 {
+					t.Errorf("made %d list requests, want 3", got)
+				}
+			}
+		})
+	}
+}
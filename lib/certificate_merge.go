@@ -0,0 +1,245 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// samePublicKey compares public keys by their PKIX encoding
+func samePublicKey(a crypto.PublicKey, b crypto.PublicKey) bool {
+	aDER, err := x509.MarshalPKIXPublicKey(a)
+	if err != nil {
+		return false
+	}
+	bDER, err := x509.MarshalPKIXPublicKey(b)
+	return err == nil && bytes.Equal(aDER, bDER)
+}
+
+// readCertificatesFile reads every CERTIFICATE block from a PEM file (other
+// blocks are skipped), or a single DER certificate
+func readCertificatesFile(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	block, rest := pem.Decode(data)
+	if block == nil {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s isn't PEM or a DER certificate", path)
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+
+	var certs []*x509.Certificate
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse certificate %d in %s", len(certs)+1, path)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.Errorf("no CERTIFICATE blocks in %s", path)
+	}
+	return certs, nil
+}
+
+// checkChainOrder makes sure each certificate is signed by the next one, the
+// order Key Vault wants
+func checkChainOrder(certs []*x509.Certificate) error {
+	for i := 0; i+1 < len(certs); i++ {
+		err := certs[i].CheckSignatureFrom(certs[i+1])
+		if err != nil {
+			return errors.Wrapf(err, "%#v isn't signed by the next certificate, %#v. Order the chain from the signed certificate to the root", certs[i].Subject.String(), certs[i+1].Subject.String())
+		}
+	}
+	return nil
+}
+
+// getPendingCSR gets certName's pending operation's CSR
+func getPendingCSR(kvClient KeyVaultClient, vaultURL string, timeout time.Duration, certName string) (*x509.CertificateRequest, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	op, err := kvClient.GetCertificateOperation(ctx, vaultURL, certName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if op.Csr == nil || len(*op.Csr) == 0 {
+		return nil, errors.Errorf("operation for %s has no CSR", certName)
+	}
+	if formatStrPtr(op.Status) != OperationInProgress {
+		return nil, errors.Errorf("operation for %s is %s, not %s. Only pending certificates created with --issuer-name Unknown need a signed certificate merged", certName, formatStrPtr(op.Status), OperationInProgress)
+	}
+	csr, err := x509.ParseCertificateRequest(*op.Csr)
+	return csr, errors.WithStack(err)
+}
+
+// CertificateCSR writes certName's pending CSR as PEM to outPath, or stdout
+// if it's blank. Sign it with your CA and merge the result with
+// CertificateMerge
+func CertificateCSR(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	outPath string,
+) error {
+	csr, err := getPendingCSR(kvClient, vaultURL, timeout, certName)
+	if err != nil {
+		logger.Errorw(
+			"Can't get CSR",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	if outPath == "" {
+		_, err = os.Stdout.Write(csrPEM)
+		return errors.WithStack(err)
+	}
+	err = ioutil.WriteFile(outPath, csrPEM, 0644)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't write CSR",
+			"outPath", outPath,
+			"err", err,
+		)
+		return err
+	}
+	logger.Infow(
+		"CSR written",
+		"certName", certName,
+		"outPath", outPath,
+		"subject", csr.Subject.String(),
+		"dnsNames", strings.Join(csr.DNSNames, ", "),
+	)
+	return nil
+}
+
+// CertificateMerge merges a certificate signed outside of Key Vault (and
+// optionally its chain) into certName's pending operation. It checks the
+// certificate's public key matches the CSR first
+func CertificateMerge(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	certPath string,
+	chainPath string,
+) error {
+	certs, err := readCertificatesFile(certPath)
+	if err != nil {
+		logger.Errorw(
+			"Can't read signed certificate",
+			"certPath", certPath,
+			"err", err,
+		)
+		return err
+	}
+	if chainPath != "" {
+		chain, err := readCertificatesFile(chainPath)
+		if err != nil {
+			logger.Errorw(
+				"Can't read certificate chain",
+				"chainPath", chainPath,
+				"err", err,
+			)
+			return err
+		}
+		certs = append(certs, chain...)
+	}
+	err = checkChainOrder(certs)
+	if err != nil {
+		logger.Errorw(
+			"Certificate chain out of order",
+			"certPath", certPath,
+			"chainPath", chainPath,
+			"err", err,
+		)
+		return err
+	}
+
+	csr, err := getPendingCSR(kvClient, vaultURL, timeout, certName)
+	if err != nil {
+		logger.Errorw(
+			"Can't get CSR",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	if !samePublicKey(certs[0].PublicKey, csr.PublicKey) {
+		err = errors.Errorf("the public key of %#v doesn't match the CSR's", certs[0].Subject.String())
+		logger.Errorw(
+			"Signed certificate isn't for this CSR. Check you're merging the right file into the right certificate",
+			"certName", certName,
+			"certPath", certPath,
+			"err", err,
+		)
+		return err
+	}
+
+	x5c := make([][]byte, 0, len(certs))
+	for _, c := range certs {
+		x5c = append(x5c, c.Raw)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	bundle, err := kvClient.MergeCertificate(
+		ctx,
+		vaultURL,
+		certName,
+		keyvault.CertificateMergeParameters{X509Certificates: &x5c},
+	)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"certificate merge error",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	details, err := NewCertificateDetails(bundle)
+	if err != nil {
+		logger.Errorw(
+			"Can't parse merged certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	logger.Infow(
+		"certificate merged",
+		"certName", certName,
+		"version", details.Version,
+		"thumbprint", details.Thumbprint,
+		"expires", formatTimePtr(details.Expires),
+		"chainLength", len(certs),
+	)
+	return nil
+}
@@ -0,0 +1,244 @@
+package lib
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testCertificate makes a certificate for pub signed by signer, parent's
+// key. A nil parent makes it self-signed
+func testCertificate(t *testing.T, cn string, isCA bool, pub crypto.PublicKey, parent *x509.Certificate, signer crypto.Signer) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{cn}
+	}
+	if parent == nil {
+		parent = template
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeTestPEM writes blocks to a file in dir and returns its path
+func writeTestPEM(t *testing.T, dir string, name string, blocks ...*pem.Block) string {
+	t.Helper()
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, pem.EncodeToMemory(b)...)
+	}
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func certBlock(c *x509.Certificate) *pem.Block {
+	return &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw}
+}
+
+func TestSamePublicKey(t *testing.T) {
+	a := testKey(t)
+	b := testKey(t)
+	aCopy := a.PublicKey
+	tests := []struct {
+		name string
+		a    crypto.PublicKey
+		b    crypto.PublicKey
+		want bool
+	}{
+		{"same key", a.Public(), a.Public(), true},
+		{"equal copies", &aCopy, a.Public(), true},
+		{"different keys", a.Public(), b.Public(), false},
+		{"unsupported type", "key", "key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := samePublicKey(tt.a, tt.b); got != tt.want {
+				t.Errorf("samePublicKey() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckChainOrder(t *testing.T) {
+	rootKey := testKey(t)
+	root := testCertificate(t, "root", true, rootKey.Public(), nil, rootKey)
+	intKey := testKey(t)
+	intermediate := testCertificate(t, "intermediate", true, intKey.Public(), root, rootKey)
+	leaf := testCertificate(t, "leaf.example.com", false, testKey(t).Public(), intermediate, intKey)
+	otherKey := testKey(t)
+	other := testCertificate(t, "other", true, otherKey.Public(), nil, otherKey)
+
+	tests := []struct {
+		name    string
+		certs   []*x509.Certificate
+		wantErr bool
+	}{
+		{"leaf only", []*x509.Certificate{leaf}, false},
+		{"leaf to root", []*x509.Certificate{leaf, intermediate, root}, false},
+		{"without root", []*x509.Certificate{leaf, intermediate}, false},
+		{"reversed", []*x509.Certificate{root, intermediate, leaf}, true},
+		{"skips intermediate", []*x509.Certificate{leaf, root}, true},
+		{"wrong CA", []*x509.Certificate{leaf, other}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkChainOrder(tt.certs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadCertificatesFile(t *testing.T) {
+	dir := t.TempDir()
+	key := testKey(t)
+	ca := testCertificate(t, "ca", true, key.Public(), nil, key)
+	leaf := testCertificate(t, "leaf.example.com", false, testKey(t).Public(), ca, key)
+
+	derPath := filepath.Join(dir, "leaf.der")
+	err := ioutil.WriteFile(derPath, leaf.Raw, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		wantCount int
+		wantErr   bool
+	}{
+		{"PEM chain", writeTestPEM(t, dir, "chain.pem", certBlock(leaf), certBlock(ca)), 2, false},
+		{"other blocks are skipped", writeTestPEM(t, dir, "with-key.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")}, certBlock(leaf)), 1, false},
+		{"DER", derPath, 1, false},
+		{"no certificates", writeTestPEM(t, dir, "key.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")}), 0, true},
+		{"bad certificate", writeTestPEM(t, dir, "bad.pem", &pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")}), 0, true},
+		{"not a certificate", writeTestPEM(t, dir, "empty.pem"), 0, true},
+		{"missing", filepath.Join(dir, "missing.pem"), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs, err := readCertificatesFile(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(certs) != tt.wantCount {
+				t.Errorf("read %d certificates, want %d", len(certs), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestCertificateMerge(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.startTestOperation(t, "pending", "Unknown")
+	dir := t.TempDir()
+
+	csrPath := filepath.Join(dir, "pending.csr")
+	err := CertificateCSR(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "pending", csrPath)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	csrPEM, err := ioutil.ReadFile(csrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		t.Fatalf("CSR file isn't a PEM CSR: %s", csrPEM)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caKey := testKey(t)
+	ca := testCertificate(t, "ca", true, caKey.Public(), nil, caKey)
+	signed := testCertificate(t, "test.example.com", false, csr.PublicKey, ca, caKey)
+	signedPath := writeTestPEM(t, dir, "signed.pem", certBlock(signed))
+	caPath := writeTestPEM(t, dir, "ca.pem", certBlock(ca))
+	wrongKey := testCertificate(t, "test.example.com", false, testKey(t).Public(), ca, caKey)
+	wrongKeyPath := writeTestPEM(t, dir, "wrong-key.pem", certBlock(wrongKey))
+
+	tests := []struct {
+		name      string
+		certPath  string
+		chainPath string
+	}{
+		{"key doesn't match the CSR", wrongKeyPath, caPath},
+		{"chain out of order", caPath, signedPath},
+		{"missing file", filepath.Join(dir, "missing.pem"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CertificateMerge(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "pending", tt.certPath, tt.chainPath)
+			if err == nil {
+				t.Error("merge should fail")
+			}
+		})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	_, err = tv.kvClient.GetCertificate(ctx, tv.vaultURL, "pending", "")
+	if err == nil {
+		t.Fatal("failed merges shouldn't issue a certificate")
+	}
+
+	err = CertificateMerge(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "pending", signedPath, caPath)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got := tv.versionCount(t, "pending"); got != 1 {
+		t.Errorf("%d versions, want 1", got)
+	}
+
+	// it's no longer pending
+	err = CertificateMerge(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "pending", signedPath, caPath)
+	if err == nil {
+		t.Error("merging a completed operation should fail")
+	}
+	err = CertificateCSR(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "pending", csrPath)
+	if err == nil {
+		t.Error("getting the CSR of a completed operation should fail")
+	}
+}
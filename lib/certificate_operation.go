@@ -0,0 +1,514 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// Certificate operation statuses. Anything but OperationInProgress is final
+const (
+	OperationInProgress = "inProgress"
+	OperationCompleted  = "completed"
+	OperationFailed     = "failed"
+	OperationCancelled  = "cancelled"
+)
+
+// DefaultWaitTimeout is how long --wait waits for a CA by default
+const DefaultWaitTimeout = "10m"
+
+// polling starts quick for self-signed certificates and backs off for CAs
+// that take minutes
+const (
+	operationPollInitial = 2 * time.Second
+	operationPollMax     = 30 * time.Second
+)
+
+// OperationDetails is a CertificateOperation flattened for people to read.
+// Version, Thumbprint and Expires are the issued certificate's, once the
+// operation completes
+type OperationDetails struct {
+	Name                  string     `json:"name"`
+	Status                string     `json:"status"`
+	StatusDetails         string     `json:"status_details"`
+	Issuer                string     `json:"issuer"`
+	RequestID             string     `json:"request_id"`
+	CancellationRequested bool       `json:"cancellation_requested"`
+	Error                 string     `json:"error,omitempty"`
+	Target                string     `json:"target,omitempty"`
+	Version               string     `json:"version,omitempty"`
+	Thumbprint            string     `json:"thumbprint,omitempty"`
+	Expires               *time.Time `json:"expires,omitempty"`
+}
+
+// NewOperationDetails flattens a CertificateOperation
+func NewOperationDetails(certName string, op keyvault.CertificateOperation) OperationDetails {
+	details := OperationDetails{
+		Name:          certName,
+		Status:        formatStrPtr(op.Status),
+		StatusDetails: formatStrPtr(op.StatusDetails),
+		RequestID:     formatStrPtr(op.RequestID),
+		Target:        formatStrPtr(op.Target),
+	}
+	if op.IssuerParameters != nil {
+		details.Issuer = formatStrPtr(op.IssuerParameters.Name)
+	}
+	if op.CancellationRequested != nil {
+		details.CancellationRequested = *op.CancellationRequested
+	}
+	if op.Error != nil {
+		details.Error = formatStrPtr(op.Error.Code) + ": " + formatStrPtr(op.Error.Message)
+	}
+	return details
+}
+
+// operationNeedsMerge is true for operations waiting for a certificate
+// signed outside of Key Vault. Waiting won't finish them
+func operationNeedsMerge(op keyvault.CertificateOperation) bool {
+	return formatStrPtr(op.Status) == OperationInProgress &&
+		op.IssuerParameters != nil &&
+		formatStrPtr(op.IssuerParameters.Name) == "Unknown"
+}
+
+// WaitForCertificateOperation polls certName's operation, backing off from
+// operationPollInitial to operationPollMax, until it's no longer in
+// progress or needs a merge. Each poll gets timeout; the whole wait gets
+// waitTimeout
+func WaitForCertificateOperation(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	waitTimeout time.Duration,
+) (keyvault.CertificateOperation, error) {
+	start := time.Now()
+	interval := operationPollInitial
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		op, err := kvClient.GetCertificateOperation(ctx, vaultURL, certName)
+		cancel()
+		if err != nil {
+			return op, errors.WithStack(err)
+		}
+		if formatStrPtr(op.Status) != OperationInProgress || operationNeedsMerge(op) {
+			return op, nil
+		}
+
+		elapsed := time.Since(start)
+		if elapsed >= waitTimeout {
+			return op, errors.Errorf("operation still %s after %s", OperationInProgress, elapsed.Round(time.Second))
+		}
+		// check one last time at the deadline
+		sleep := interval
+		if remaining := waitTimeout - elapsed; remaining < sleep {
+			sleep = remaining
+		}
+		logger.Infow(
+			"waiting for certificate operation",
+			"certName", certName,
+			"status", formatStrPtr(op.Status),
+			"statusDetails", formatStrPtr(op.StatusDetails),
+			"elapsed", elapsed.Round(time.Second).String(),
+			"nextCheck", sleep.Round(time.Second).String(),
+		)
+		time.Sleep(sleep)
+		interval *= 2
+		if interval > operationPollMax {
+			interval = operationPollMax
+		}
+	}
+}
+
+// completeOperationDetails adds the issued certificate's version,
+// thumbprint and expiry to a completed operation's details
+func completeOperationDetails(
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	details *OperationDetails,
+) error {
+	if details.Status != OperationCompleted {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cert, err := kvClient.GetCertificate(ctx, vaultURL, details.Name, "")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	certDetails, err := NewCertificateDetails(cert)
+	if err != nil {
+		return err
+	}
+	details.Version = certDetails.Version
+	details.Thumbprint = certDetails.Thumbprint
+	details.Expires = certDetails.Expires
+	return nil
+}
+
+// operationResultErr is the error for an operation that won't produce a
+// certificate, or nil
+func operationResultErr(details OperationDetails) error {
+	switch details.Status {
+	case OperationCompleted:
+		return nil
+	case OperationInProgress:
+		return errors.Errorf("%s is waiting for a merge of a certificate signed outside of Key Vault", details.Name)
+	default:
+		msg := details.StatusDetails
+		if details.Error != "" {
+			msg = details.Error
+		}
+		return errors.Errorf("operation %s: %s", details.Status, msg)
+	}
+}
+
+// waitForIssuedCertificate waits for a just-started operation and logs the
+// issued certificate. A merge isn't an error - it's how Unknown issuers work
+func waitForIssuedCertificate(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	waitTimeout time.Duration,
+) error {
+	op, err := WaitForCertificateOperation(logger, kvClient, vaultURL, timeout, certName, waitTimeout)
+	if err != nil {
+		logger.Errorw(
+			"Can't wait for certificate operation",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	if operationNeedsMerge(op) {
+		logger.Infow(
+			"certificate operation needs a merge of a certificate signed outside of Key Vault",
+			"certName", certName,
+			"statusDetails", formatStrPtr(op.StatusDetails),
+		)
+		return nil
+	}
+
+	details := NewOperationDetails(certName, op)
+	err = operationResultErr(details)
+	if err != nil {
+		logger.Errorw(
+			"certificate operation didn't complete",
+			"certName", certName,
+			"status", details.Status,
+			"err", err,
+		)
+		return err
+	}
+	err = completeOperationDetails(kvClient, vaultURL, timeout, &details)
+	if err != nil {
+		logger.Errorw(
+			"Can't get issued certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	logger.Infow(
+		"certificate issued",
+		"certName", certName,
+		"version", details.Version,
+		"thumbprint", details.Thumbprint,
+		"expires", formatTimePtr(details.Expires),
+	)
+	return nil
+}
+
+// writeOperationDetailsTable writes details as aligned "key: value" lines
+func writeOperationDetailsTable(w io.Writer, d OperationDetails) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	row := func(key string, value string) {
+		if value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", key, value)
+		}
+	}
+
+	row("Name", d.Name)
+	row("Status", d.Status)
+	row("Status Details", d.StatusDetails)
+	row("Issuer", d.Issuer)
+	row("Request ID", d.RequestID)
+	row("Cancellation Requested", fmt.Sprintf("%t", d.CancellationRequested))
+	row("Error", d.Error)
+	row("Target", d.Target)
+	row("Version", d.Version)
+	row("Thumbprint", d.Thumbprint)
+	row("Expires", formatTimePtr(d.Expires))
+
+	return errors.WithStack(tw.Flush())
+}
+
+// WriteOperationDetails writes details in one of ShowOutputFormats
+func WriteOperationDetails(w io.Writer, d OperationDetails, outputFormat string) error {
+	if outputFormat == OutputTable {
+		return writeOperationDetailsTable(w, d)
+	}
+	return WriteData(w, d, outputFormat)
+}
+
+// CertificateOperationStatus prints certName's pending (or last)
+// certificate operation without waiting
+func CertificateOperationStatus(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	outputFormat string,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	op, err := kvClient.GetCertificateOperation(ctx, vaultURL, certName)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't get certificate operation",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	details := NewOperationDetails(certName, op)
+	err = completeOperationDetails(kvClient, vaultURL, timeout, &details)
+	if err != nil {
+		logger.Errorw(
+			"Can't get issued certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	err = WriteOperationDetails(os.Stdout, details, outputFormat)
+	if err != nil {
+		logger.Errorw(
+			"Can't print certificate operation",
+			"certName", certName,
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+	return nil
+}
+
+// CertificateOperationWait waits for certName's operation to finish, prints
+// it, and returns an error unless it completed
+func CertificateOperationWait(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	waitTimeout time.Duration,
+	outputFormat string,
+) error {
+	op, err := WaitForCertificateOperation(logger, kvClient, vaultURL, timeout, certName, waitTimeout)
+	if err != nil {
+		logger.Errorw(
+			"Can't wait for certificate operation",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	details := NewOperationDetails(certName, op)
+	err = completeOperationDetails(kvClient, vaultURL, timeout, &details)
+	if err != nil {
+		logger.Errorw(
+			"Can't get issued certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	err = WriteOperationDetails(os.Stdout, details, outputFormat)
+	if err != nil {
+		logger.Errorw(
+			"Can't print certificate operation",
+			"certName", certName,
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+
+	err = operationResultErr(details)
+	if err != nil {
+		logger.Errorw(
+			"certificate operation didn't complete",
+			"certName", certName,
+			"status", details.Status,
+			"err", err,
+		)
+		return err
+	}
+	return nil
+}
+
+// operationPrompt shows an operation and what will happen to it, and asks
+// for confirmation
+func operationPrompt(vaultURL string, action string, details OperationDetails) error {
+	fmt.Printf("The certificate operation for '%s' in keyvault '%s' will be %s:\n", details.Name, vaultURL, action)
+	err := writeOperationDetailsTable(os.Stdout, details)
+	if err != nil {
+		return err
+	}
+	return confirmPrompt()
+}
+
+// CertificateOperationCancel requests cancellation of certName's in
+// progress operation. CAs may still issue the certificate if it's too late
+// to cancel - check with CertificateOperationStatus
+func CertificateOperationCancel(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	skipConfirmation bool,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	op, err := kvClient.GetCertificateOperation(ctx, vaultURL, certName)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't get certificate operation",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+	details := NewOperationDetails(certName, op)
+	if details.Status != OperationInProgress {
+		err = errors.Errorf("operation is %s, not %s", details.Status, OperationInProgress)
+		logger.Errorw(
+			"Nothing to cancel. Use `certificate operation delete` to remove finished operations",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	if !skipConfirmation {
+		err = operationPrompt(vaultURL, "cancelled", details)
+		if err != nil {
+			logger.Errorw(
+				"Can't confirm cancellation",
+				"vaultURL", vaultURL,
+				"certName", certName,
+				"err", err,
+			)
+			return err
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cancellationRequested := true
+	op, err = kvClient.UpdateCertificateOperation(
+		ctx,
+		vaultURL,
+		certName,
+		keyvault.CertificateOperationUpdateParameter{
+			CancellationRequested: &cancellationRequested,
+		},
+	)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"certificate operation cancellation error",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	logger.Infow(
+		"certificate operation cancellation requested",
+		"certName", certName,
+		"status", formatStrPtr(op.Status),
+		"statusDetails", formatStrPtr(op.StatusDetails),
+	)
+	return nil
+}
+
+// CertificateOperationDelete deletes certName's operation, stopping it if
+// it's in progress. Issued certificate versions aren't touched
+func CertificateOperationDelete(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	skipConfirmation bool,
+) error {
+	if !skipConfirmation {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		op, err := kvClient.GetCertificateOperation(ctx, vaultURL, certName)
+		if err != nil {
+			err = errors.WithStack(err)
+			logger.Errorw(
+				"Can't get certificate operation",
+				"vaultURL", vaultURL,
+				"certName", certName,
+				"err", err,
+			)
+			return err
+		}
+		err = operationPrompt(vaultURL, "deleted", NewOperationDetails(certName, op))
+		if err != nil {
+			logger.Errorw(
+				"Can't confirm deletion",
+				"vaultURL", vaultURL,
+				"certName", certName,
+				"err", err,
+			)
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	op, err := kvClient.DeleteCertificateOperation(ctx, vaultURL, certName)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"certificate operation deletion error",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	logger.Infow(
+		"certificate operation deleted",
+		"certName", certName,
+		"status", formatStrPtr(op.Status),
+		"requestID", formatStrPtr(op.RequestID),
+	)
+	return nil
+}
@@ -0,0 +1,215 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestOperation creates certName with issuerName without waiting, so
+// its operation is left as fakekv has it
+func (tv *testVault) startTestOperation(t *testing.T, certName string, issuerName string) {
+	t.Helper()
+	err := CertificateCreate(
+		tv.logger, tv.kvClient, tv.vaultURL, testTimeout, certName,
+		testCertCreateParams(t), FlagCertificateCreateParameters{IssuerName: issuerName},
+		false, true, 0,
+	)
+	if err != nil {
+		t.Fatalf("can't create %s: %+v", certName, err)
+	}
+}
+
+func TestOperationResultErr(t *testing.T) {
+	tests := []struct {
+		name    string
+		details OperationDetails
+		wantErr string
+	}{
+		{"completed", OperationDetails{Status: OperationCompleted}, ""},
+		{"needs merge", OperationDetails{Name: "c", Status: OperationInProgress}, "c is waiting for a merge"},
+		{"cancelled", OperationDetails{Status: OperationCancelled, StatusDetails: "Certificate request cancelled."}, "operation cancelled: Certificate request cancelled."},
+		{"error beats status details", OperationDetails{Status: OperationFailed, StatusDetails: "failed", Error: "Code: msg"}, "operation failed: Code: msg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := operationResultErr(tt.details)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected err: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want it to contain %#v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWaitForCertificateOperation(t *testing.T) {
+	tests := []struct {
+		name           string
+		issuer         string
+		issueDelay     time.Duration
+		waitTimeout    time.Duration
+		wantStatus     string
+		wantNeedsMerge bool
+		wantErr        bool
+	}{
+		{"Self is issued right away", "Self", time.Hour, time.Minute, OperationCompleted, false, false},
+		// waits for one poll
+		{"CA issues while waiting", "DigiCert", 100 * time.Millisecond, time.Minute, OperationCompleted, false, false},
+		{"CA outlasts the wait", "DigiCert", time.Hour, 50 * time.Millisecond, OperationInProgress, false, true},
+		{"Unknown needs a merge", "Unknown", 0, time.Minute, OperationInProgress, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tv := newTestVault(t, 0)
+			tv.fake.SetIssueDelay(tt.issueDelay)
+			tv.startTestOperation(t, "op", tt.issuer)
+
+			op, err := WaitForCertificateOperation(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "op", tt.waitTimeout)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := formatStrPtr(op.Status); got != tt.wantStatus {
+				t.Errorf("status = %#v, want %#v", got, tt.wantStatus)
+			}
+			if got := operationNeedsMerge(op); got != tt.wantNeedsMerge {
+				t.Errorf("operationNeedsMerge() = %v, want %v", got, tt.wantNeedsMerge)
+			}
+		})
+	}
+}
+
+func TestCertificateOperationStatusAndWait(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.startTestOperation(t, "issued", "Self")
+	tv.startTestOperation(t, "pending", "Unknown")
+
+	for _, certName := range []string{"issued", "pending"} {
+		err := CertificateOperationStatus(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, certName, OutputJSON)
+		if err != nil {
+			t.Errorf("status of %s: %+v", certName, err)
+		}
+	}
+	err := CertificateOperationStatus(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "missing", OutputJSON)
+	if err == nil {
+		t.Error("status of a missing operation should fail")
+	}
+
+	err = CertificateOperationWait(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "issued", time.Minute, OutputJSON)
+	if err != nil {
+		t.Errorf("wait for issued: %+v", err)
+	}
+	// waiting won't merge it, so it's an error
+	err = CertificateOperationWait(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "pending", time.Minute, OutputJSON)
+	if err == nil {
+		t.Error("wait for an operation needing a merge should fail")
+	}
+}
+
+func TestCertificateCreateWait(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.fake.SetIssueDelay(time.Hour)
+	err := CertificateCreate(
+		tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "slow",
+		testCertCreateParams(t), FlagCertificateCreateParameters{IssuerName: "DigiCert"},
+		false, true, 50*time.Millisecond,
+	)
+	if err == nil {
+		t.Error("--wait should fail when the CA takes longer than --wait-timeout")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	op, err := tv.kvClient.GetCertificateOperation(ctx, tv.vaultURL, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatStrPtr(op.Status); got != OperationInProgress {
+		t.Errorf("status = %#v, the operation should be left running", got)
+	}
+}
+
+func TestCertificateOperationCancel(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.fake.SetIssueDelay(time.Hour)
+	tv.startTestOperation(t, "slow", "DigiCert")
+	tv.startTestOperation(t, "issued", "Self")
+
+	err := CertificateOperationCancel(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "slow", true)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	op, err := tv.kvClient.GetCertificateOperation(ctx, tv.vaultURL, "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := NewOperationDetails("slow", op)
+	if details.Status != OperationCancelled || !details.CancellationRequested {
+		t.Errorf("details = %+v, want cancelled", details)
+	}
+
+	tests := []struct {
+		name     string
+		certName string
+	}{
+		{"already cancelled", "slow"},
+		{"completed", "issued"},
+		{"missing", "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CertificateOperationCancel(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, tt.certName, true)
+			if err == nil {
+				t.Error("there's nothing to cancel, so it should fail")
+			}
+		})
+	}
+}
+
+func TestCertificateOperationDelete(t *testing.T) {
+	tests := []struct {
+		name   string
+		issuer string
+		// wantCertificate is whether a certificate version is left after
+		wantCertificate bool
+	}{
+		{"completed", "Self", true},
+		{"in progress", "DigiCert", false},
+		{"waiting for a merge", "Unknown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tv := newTestVault(t, 0)
+			tv.fake.SetIssueDelay(time.Hour)
+			tv.startTestOperation(t, "op", tt.issuer)
+
+			err := CertificateOperationDelete(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "op", true)
+			if err != nil {
+				t.Fatalf("%+v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			_, err = tv.kvClient.GetCertificateOperation(ctx, tv.vaultURL, "op")
+			if err == nil {
+				t.Error("the operation should be gone")
+			}
+			_, err = tv.kvClient.GetCertificate(ctx, tv.vaultURL, "op", "")
+			if (err == nil) != tt.wantCertificate {
+				t.Errorf("GetCertificate err = %v, want a certificate: %v", err, tt.wantCertificate)
+			}
+
+			err = CertificateOperationDelete(tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "op", true)
+			if err == nil {
+				t.Error("deleting a deleted operation should fail")
+			}
+		})
+	}
+}
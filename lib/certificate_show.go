@@ -0,0 +1,411 @@
+package lib
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// X509Details are the interesting parts of a parsed certificate
+type X509Details struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	SerialNumber       string    `json:"serial_number"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	DNSNames           []string  `json:"dns_names"`
+	EmailAddresses     []string  `json:"email_addresses,omitempty"`
+	KeyUsage           []string  `json:"key_usage"`
+	ExtKeyUsage        []string  `json:"ext_key_usage"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	PublicKeyAlgorithm string    `json:"public_key_algorithm"`
+	PublicKeySize      int       `json:"public_key_size,omitempty"`
+	IsCA               bool      `json:"is_ca"`
+}
+
+// CertificateDetails is a CertificateBundle flattened for people to read
+type CertificateDetails struct {
+	ID         string                      `json:"id"`
+	Name       string                      `json:"name"`
+	Version    string                      `json:"version"`
+	Enabled    *bool                       `json:"enabled"`
+	Created    *time.Time                  `json:"created"`
+	Updated    *time.Time                  `json:"updated"`
+	NotBefore  *time.Time                  `json:"not_before"`
+	Expires    *time.Time                  `json:"expires"`
+	Thumbprint string                      `json:"thumbprint"`
+	Tags       map[string]string           `json:"tags"`
+	X509       *X509Details                `json:"x509"`
+	Policy     *keyvault.CertificatePolicy `json:"policy"`
+}
+
+// ParseCertificateID splits a certificate id like
+// https://myvault.vault.azure.net/certificates/<name>/<version> into name
+// and version. version is blank for unversioned ids
+func ParseCertificateID(id string) (string, string) {
+	return parseObjectID(id, "certificates")
+}
+
+// parseObjectID splits a Key Vault object id like
+// https://myvault.vault.azure.net/<collection>/<name>/<version>
+func parseObjectID(id string, collection string) (string, string) {
+	i := strings.Index(id, "/"+collection+"/")
+	if i == -1 {
+		return "", ""
+	}
+	parts := strings.SplitN(strings.Trim(id[i+len(collection)+2:], "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func unixTimeToTime(t *date.UnixTime) *time.Time {
+	if t == nil {
+		return nil
+	}
+	ret := time.Time(*t).UTC()
+	return &ret
+}
+
+func tagsToMap(tags map[string]*string) map[string]string {
+	ret := make(map[string]string, len(tags))
+	for k, v := range tags {
+		if v != nil {
+			ret[k] = *v
+		}
+	}
+	return ret
+}
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digitalSignature"},
+	{x509.KeyUsageContentCommitment, "nonRepudiation"},
+	{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "keyAgreement"},
+	{x509.KeyUsageCertSign, "keyCertSign"},
+	{x509.KeyUsageCRLSign, "cRLSign"},
+	{x509.KeyUsageEncipherOnly, "encipherOnly"},
+	{x509.KeyUsageDecipherOnly, "decipherOnly"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+// NewX509Details parses DER certificate bytes (a CertificateBundle's Cer)
+func NewX509Details(cer []byte) (*X509Details, error) {
+	cert, err := x509.ParseCertificate(cer)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	keyUsage := []string{}
+	for _, ku := range keyUsageNames {
+		if cert.KeyUsage&ku.usage != 0 {
+			keyUsage = append(keyUsage, ku.name)
+		}
+	}
+	extKeyUsage := []string{}
+	for _, eku := range cert.ExtKeyUsage {
+		name, exists := extKeyUsageNames[eku]
+		if !exists {
+			name = fmt.Sprintf("unknown(%d)", eku)
+		}
+		extKeyUsage = append(extKeyUsage, name)
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		extKeyUsage = append(extKeyUsage, oid.String())
+	}
+
+	keySize := 0
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		keySize = pub.N.BitLen()
+	case *ecdsa.PublicKey:
+		keySize = pub.Curve.Params().BitSize
+	}
+
+	return &X509Details{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		SerialNumber:       formatSerial(cert.SerialNumber),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		DNSNames:           cert.DNSNames,
+		EmailAddresses:     cert.EmailAddresses,
+		KeyUsage:           keyUsage,
+		ExtKeyUsage:        extKeyUsage,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		PublicKeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		PublicKeySize:      keySize,
+		IsCA:               cert.IsCA,
+	}, nil
+}
+
+// formatSerial formats a serial number as colon separated hex, like openssl
+func formatSerial(serial *big.Int) string {
+	h := fmt.Sprintf("%X", serial)
+	if len(h)%2 != 0 {
+		h = "0" + h
+	}
+	var parts []string
+	for i := 0; i < len(h); i += 2 {
+		parts = append(parts, h[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// NewCertificateDetails flattens a CertificateBundle. The thumbprint is the
+// hex SHA-1 of the certificate, like the portal shows
+func NewCertificateDetails(bundle keyvault.CertificateBundle) (CertificateDetails, error) {
+	details := CertificateDetails{
+		Tags:   tagsToMap(bundle.Tags),
+		Policy: bundle.Policy,
+	}
+	if bundle.ID != nil {
+		details.ID = *bundle.ID
+		details.Name, details.Version = ParseCertificateID(*bundle.ID)
+	}
+	if bundle.Attributes != nil {
+		details.Enabled = bundle.Attributes.Enabled
+		details.Created = unixTimeToTime(bundle.Attributes.Created)
+		details.Updated = unixTimeToTime(bundle.Attributes.Updated)
+		details.NotBefore = unixTimeToTime(bundle.Attributes.NotBefore)
+		details.Expires = unixTimeToTime(bundle.Attributes.Expires)
+	}
+	if bundle.Cer != nil && len(*bundle.Cer) > 0 {
+		sum := sha1.Sum(*bundle.Cer)
+		details.Thumbprint = fmt.Sprintf("%X", sum[:])
+		x509Details, err := NewX509Details(*bundle.Cer)
+		if err != nil {
+			return details, err
+		}
+		details.X509 = x509Details
+	}
+	return details, nil
+}
+
+func formatTimePtr(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatBoolPtr(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return fmt.Sprintf("%t", *b)
+}
+
+func formatInt32Ptr(i *int32) string {
+	if i == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d", *i)
+}
+
+func formatStrPtr(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func formatStrSlicePtr(s *[]string) string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ", ")
+}
+
+// formatLifetimeActions formats actions like "AutoRenew at 30 days before expiry"
+func formatLifetimeActions(las *[]keyvault.LifetimeAction) string {
+	if las == nil {
+		return ""
+	}
+	var ret []string
+	for _, la := range *las {
+		action := ""
+		if la.Action != nil {
+			action = string(la.Action.ActionType)
+		}
+		trigger := ""
+		if la.Trigger != nil && la.Trigger.DaysBeforeExpiry != nil {
+			trigger = fmt.Sprintf(" at %d days before expiry", *la.Trigger.DaysBeforeExpiry)
+		}
+		if la.Trigger != nil && la.Trigger.LifetimePercentage != nil {
+			trigger = fmt.Sprintf(" at %d%% lifetime", *la.Trigger.LifetimePercentage)
+		}
+		ret = append(ret, action+trigger)
+	}
+	return strings.Join(ret, ", ")
+}
+
+// writeCertificateDetailsTable writes details as aligned "key: value" lines
+func writeCertificateDetailsTable(w io.Writer, d CertificateDetails) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	row := func(key string, value string) {
+		fmt.Fprintf(tw, "%s:\t%s\n", key, value)
+	}
+
+	row("Name", d.Name)
+	row("Version", d.Version)
+	row("ID", d.ID)
+	row("Enabled", formatBoolPtr(d.Enabled))
+	row("Created", formatTimePtr(d.Created))
+	row("Updated", formatTimePtr(d.Updated))
+	row("Not Before", formatTimePtr(d.NotBefore))
+	expires := formatTimePtr(d.Expires)
+	if d.Expires != nil {
+		days := int(time.Until(*d.Expires).Hours() / 24)
+		if days < 0 {
+			expires += fmt.Sprintf(" (expired %d days ago)", -days)
+		} else {
+			expires += fmt.Sprintf(" (in %d days)", days)
+		}
+	}
+	row("Expires", expires)
+	row("Thumbprint", d.Thumbprint)
+
+	if d.X509 != nil {
+		row("Subject", d.X509.Subject)
+		row("Issuer", d.X509.Issuer)
+		row("Serial Number", d.X509.SerialNumber)
+		row("SANs", strings.Join(d.X509.DNSNames, ", "))
+		if len(d.X509.EmailAddresses) > 0 {
+			row("Email SANs", strings.Join(d.X509.EmailAddresses, ", "))
+		}
+		row("Key Usage", strings.Join(d.X509.KeyUsage, ", "))
+		row("Ext Key Usage", strings.Join(d.X509.ExtKeyUsage, ", "))
+		row("Signature Algorithm", d.X509.SignatureAlgorithm)
+		row("Public Key", fmt.Sprintf("%s %d", d.X509.PublicKeyAlgorithm, d.X509.PublicKeySize))
+	}
+
+	if p := d.Policy; p != nil {
+		fmt.Fprintln(tw, "Policy:\t")
+		if p.IssuerParameters != nil {
+			row("  Issuer Name", formatStrPtr(p.IssuerParameters.Name))
+		}
+		if p.KeyProperties != nil {
+			row("  Key Type", formatStrPtr(p.KeyProperties.KeyType))
+			row("  Key Size", formatInt32Ptr(p.KeyProperties.KeySize))
+			row("  Exportable", formatBoolPtr(p.KeyProperties.Exportable))
+			row("  Reuse Key", formatBoolPtr(p.KeyProperties.ReuseKey))
+		}
+		if p.SecretProperties != nil {
+			row("  Content Type", formatStrPtr(p.SecretProperties.ContentType))
+		}
+		if x := p.X509CertificateProperties; x != nil {
+			row("  Subject", formatStrPtr(x.Subject))
+			if x.SubjectAlternativeNames != nil {
+				row("  SANs", formatStrSlicePtr(x.SubjectAlternativeNames.DNSNames))
+			}
+			row("  Validity (Months)", formatInt32Ptr(x.ValidityInMonths))
+		}
+		row("  Lifetime Actions", formatLifetimeActions(p.LifetimeActions))
+	}
+
+	fmt.Fprintln(tw, "Tags:\t")
+	keys := make([]string, 0, len(d.Tags))
+	for k := range d.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		row("  "+k, d.Tags[k])
+	}
+
+	return errors.WithStack(tw.Flush())
+}
+
+// WriteCertificateDetails writes details in one of ShowOutputFormats
+func WriteCertificateDetails(w io.Writer, d CertificateDetails, outputFormat string) error {
+	switch outputFormat {
+	case OutputTable:
+		return writeCertificateDetailsTable(w, d)
+	case OutputJSON:
+		return writeJSON(w, d)
+	case OutputYAML:
+		return writeYAML(w, d)
+	default:
+		return errors.Errorf("unknown output format: %#v", outputFormat)
+	}
+}
+
+// CertificateShow prints a single certificate version. A blank certVersion
+// means the latest version
+func CertificateShow(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	certVersion string,
+	outputFormat string,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cert, err := kvClient.GetCertificate(ctx, vaultURL, certName, certVersion)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't get certificate",
+			"vaultURL", vaultURL,
+			"certName", certName,
+			"certVersion", certVersion,
+			"err", err,
+		)
+		return err
+	}
+
+	details, err := NewCertificateDetails(cert)
+	if err != nil {
+		logger.Errorw(
+			"Can't parse certificate",
+			"certName", certName,
+			"certVersion", certVersion,
+			"err", err,
+		)
+		return err
+	}
+
+	err = WriteCertificateDetails(os.Stdout, details, outputFormat)
+	if err != nil {
+		logger.Errorw(
+			"Can't print certificate",
+			"certName", certName,
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+	return nil
+}
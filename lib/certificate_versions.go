@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// CertificateVersion summarizes one version of a certificate
+type CertificateVersion struct {
+	ID         string            `json:"id"`
+	Version    string            `json:"version"`
+	Enabled    *bool             `json:"enabled"`
+	Created    *time.Time        `json:"created"`
+	Updated    *time.Time        `json:"updated"`
+	NotBefore  *time.Time        `json:"not_before"`
+	Expires    *time.Time        `json:"expires"`
+	Thumbprint string            `json:"thumbprint"`
+	Tags       map[string]string `json:"tags"`
+	// Diff is a unified diff of the enabled attribute and tags from the
+	// previous version
+	Diff []string `json:"diff,omitempty"`
+}
+
+// thumbprintHex converts Key Vault's base64url x5t to the hex the portal shows
+func thumbprintHex(x5t *string) string {
+	if x5t == nil {
+		return ""
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(*x5t, "="))
+	if err != nil {
+		return *x5t
+	}
+	return fmt.Sprintf("%X", raw)
+}
+
+// newCertificateVersion summarizes a CertificateItem from a versions list
+func newCertificateVersion(item keyvault.CertificateItem) CertificateVersion {
+	v := CertificateVersion{
+		Thumbprint: thumbprintHex(item.X509Thumbprint),
+		Tags:       tagsToMap(item.Tags),
+	}
+	if item.ID != nil {
+		v.ID = *item.ID
+		_, v.Version = ParseCertificateID(*item.ID)
+	}
+	if item.Attributes != nil {
+		v.Enabled = item.Attributes.Enabled
+		v.Created = unixTimeToTime(item.Attributes.Created)
+		v.Updated = unixTimeToTime(item.Attributes.Updated)
+		v.NotBefore = unixTimeToTime(item.Attributes.NotBefore)
+		v.Expires = unixTimeToTime(item.Attributes.Expires)
+	}
+	return v
+}
+
+// versionYAML renders the parts of a version that get diffed. Key Vault
+// returns the certificate's current policy for every version, so the policy
+// is left out
+func versionYAML(cert keyvault.CertificateBundle) (string, error) {
+	return comparableYAML(nil, cert.Attributes, cert.Tags)
+}
+
+func writeCertificateVersionsTable(w io.Writer, versions []CertificateVersion) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tCREATED\tUPDATED\tEXPIRES\tENABLED\tTHUMBPRINT")
+	for _, v := range versions {
+		fmt.Fprintf(
+			tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			v.Version,
+			formatTimePtr(v.Created),
+			formatTimePtr(v.Updated),
+			formatTimePtr(v.Expires),
+			formatBoolPtr(v.Enabled),
+			v.Thumbprint,
+		)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	color := useColor()
+	for _, v := range versions {
+		if len(v.Diff) == 0 {
+			continue
+		}
+		diff := v.Diff
+		if color {
+			diff = ColorizeDiff(diff)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, strings.Join(diff, "\n"))
+	}
+	return nil
+}
+
+// listCertificateVersions lists every version of a certificate, oldest first
+func listCertificateVersions(
+	ctx context.Context,
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	certName string,
+) ([]CertificateVersion, error) {
+	items, err := kvClient.GetCertificateVersionsComplete(ctx, vaultURL, certName, nil)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"Can't get certificate versions",
+			"certName", certName,
+			"err", err,
+		)
+		return nil, err
+	}
+
+	var versions []CertificateVersion
+	for items.NotDone() {
+		versions = append(versions, newCertificateVersion(items.Value()))
+
+		err = items.NextWithContext(ctx)
+		if err != nil {
+			err := errors.WithStack(err)
+			logger.Errorw(
+				"Can't advance certificate versions list",
+				"certName", certName,
+				"err", err,
+			)
+			return nil, err
+		}
+	}
+
+	// Key Vault doesn't promise an order
+	sort.SliceStable(versions, func(i, j int) bool {
+		if versions[i].Created == nil || versions[j].Created == nil {
+			return versions[j].Created != nil
+		}
+		return versions[i].Created.Before(*versions[j].Created)
+	})
+	return versions, nil
+}
+
+// diffCertificateVersions fills in each version's Diff from the previous
+// version. versions must be oldest first
+func diffCertificateVersions(
+	ctx context.Context,
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	certName string,
+	versions []CertificateVersion,
+) error {
+	prevYAML := ""
+	prevVersion := ""
+	for i := range versions {
+		cert, err := kvClient.GetCertificate(ctx, vaultURL, certName, versions[i].Version)
+		if err != nil {
+			err = errors.WithStack(err)
+			logger.Errorw(
+				"Can't get certificate version",
+				"certName", certName,
+				"certVersion", versions[i].Version,
+				"err", err,
+			)
+			return err
+		}
+		y, err := versionYAML(cert)
+		if err != nil {
+			logger.Errorw(
+				"Can't render certificate version",
+				"certName", certName,
+				"certVersion", versions[i].Version,
+				"err", err,
+			)
+			return err
+		}
+		if i > 0 {
+			versions[i].Diff = UnifiedDiff(prevVersion, versions[i].Version, prevYAML, y, 3)
+		}
+		prevYAML = y
+		prevVersion = versions[i].Version
+	}
+	return nil
+}
+
+// CertificateVersions prints every version of a certificate, oldest first.
+// If diff is set, each version also gets a diff of its enabled attribute and
+// tags from the previous version (this costs one GetCertificate per version)
+func CertificateVersions(
+	logger *logos.Logger,
+	kvClient KeyVaultClient,
+	vaultURL string,
+	timeout time.Duration,
+	certName string,
+	diff bool,
+	outputFormat string,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	versions, err := listCertificateVersions(ctx, logger, kvClient, vaultURL, certName)
+	if err != nil {
+		return err
+	}
+
+	if diff {
+		err = diffCertificateVersions(ctx, logger, kvClient, vaultURL, certName, versions)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch outputFormat {
+	case OutputTable:
+		err = writeCertificateVersionsTable(os.Stdout, versions)
+	case OutputJSON:
+		err = writeJSON(os.Stdout, versions)
+	case OutputYAML:
+		err = writeYAML(os.Stdout, versions)
+	default:
+		err = errors.Errorf("unknown output format: %#v", outputFormat)
+	}
+	if err != nil {
+		logger.Errorw(
+			"Can't print certificate versions",
+			"certName", certName,
+			"outputFormat", outputFormat,
+			"err", err,
+		)
+		return err
+	}
+	return nil
+}
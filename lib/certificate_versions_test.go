@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDiffCertificateVersions(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.createTestCertificate(t, "versioned")
+	// a new version with a different policy, tags and enabled attribute
+	err := CertificateCreate(
+		tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "versioned",
+		testCertCreateParams(t), FlagCertificateCreateParameters{
+			Subject: "CN=other.example.com",
+			Sans:    []string{"other.example.com"},
+			Tags:    map[string]*string{"team": strPtr("infra")},
+			Enabled: boolPtr(false),
+		},
+		true, true, 0,
+	)
+	if err != nil {
+		t.Fatalf("can't create new version: %+v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	versions, err := listCertificateVersions(ctx, tv.logger, tv.kvClient, tv.vaultURL, "versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("got %d versions, want 2", len(versions))
+	}
+	err = diffCertificateVersions(ctx, tv.logger, tv.kvClient, tv.vaultURL, "versioned", versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if versions[0].Diff != nil {
+		t.Errorf("the first version has nothing to diff against: %v", versions[0].Diff)
+	}
+	diff := strings.Join(versions[1].Diff, "\n")
+	for _, want := range []string{
+		"--- " + versions[0].Version,
+		"+++ " + versions[1].Version,
+		"-  enabled: true",
+		"+  enabled: false",
+		"-  team: test",
+		"+  team: infra",
+	} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff missing %#v:\n%s", want, diff)
+		}
+	}
+	// Key Vault returns the current policy for every version, and
+	// timestamps change with every version
+	for _, unwanted := range []string{"policy", "subject", "created", "updated"} {
+		if strings.Contains(diff, unwanted) {
+			t.Errorf("diff shouldn't mention %#v:\n%s", unwanted, diff)
+		}
+	}
+}
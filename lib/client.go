@@ -0,0 +1,27 @@
+package lib
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+)
+
+// KeyVaultClient is the subset of *keyvault.BaseClient that kvcrutch uses.
+// Functions in this package take a KeyVaultClient so they can be exercised
+// against fakes or alternate backends instead of a real Azure Key Vault.
+// Method signatures match keyvault.BaseClient exactly.
+type KeyVaultClient interface {
+	CreateCertificate(ctx context.Context, vaultBaseURL string, certificateName string, parameters keyvault.CertificateCreateParameters) (keyvault.CertificateOperation, error)
+	DeleteCertificateOperation(ctx context.Context, vaultBaseURL string, certificateName string) (keyvault.CertificateOperation, error)
+	GetCertificate(ctx context.Context, vaultBaseURL string, certificateName string, certificateVersion string) (keyvault.CertificateBundle, error)
+	GetCertificateOperation(ctx context.Context, vaultBaseURL string, certificateName string) (keyvault.CertificateOperation, error)
+	GetCertificatesComplete(ctx context.Context, vaultBaseURL string, maxresults *int32) (keyvault.CertificateListResultIterator, error)
+	MergeCertificate(ctx context.Context, vaultBaseURL string, certificateName string, parameters keyvault.CertificateMergeParameters) (keyvault.CertificateBundle, error)
+	ImportCertificate(ctx context.Context, vaultBaseURL string, certificateName string, parameters keyvault.CertificateImportParameters) (keyvault.CertificateBundle, error)
+	GetSecret(ctx context.Context, vaultBaseURL string, secretName string, secretVersion string) (keyvault.SecretBundle, error)
+	GetCertificateVersionsComplete(ctx context.Context, vaultBaseURL string, certificateName string, maxresults *int32) (keyvault.CertificateListResultIterator, error)
+	UpdateCertificateOperation(ctx context.Context, vaultBaseURL string, certificateName string, certificateOperation keyvault.CertificateOperationUpdateParameter) (keyvault.CertificateOperation, error)
+}
+
+// make sure the real client keeps satisfying KeyVaultClient
+var _ KeyVaultClient = (*keyvault.BaseClient)(nil)
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type diffEdit struct {
+	op   byte // ' ', '-', or '+'
+	text string
+	// 0-based positions in a and b before this edit
+	ai int
+	bi int
+}
+
+// diffLines computes a shortest edit script from a to b with a simple
+// LCS table. Inputs are small (YAML dumps of certificate parameters)
+func diffLines(a []string, b []string) []diffEdit {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var edits []diffEdit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, diffEdit{' ', a[i], i, j})
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, diffEdit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, diffEdit{'+', b[j], i, j})
+			j++
+		}
+	}
+	return edits
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// UnifiedDiff returns the lines of a unified diff (like `diff -u`) from a
+// to b, with contextLines of context around each change. It returns nil if
+// a and b are the same
+func UnifiedDiff(aName string, bName string, a string, b string, contextLines int) []string {
+	edits := diffLines(splitLines(a), splitLines(b))
+
+	// group changes (and their context) into hunks of edits[start:end]
+	type hunk struct{ start, end int }
+	var hunks []hunk
+	for i := 0; i < len(edits); {
+		if edits[i].op == ' ' {
+			i++
+			continue
+		}
+		start := i - contextLines
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for {
+			for end < len(edits) && edits[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next < len(edits) && next-end <= 2*contextLines {
+				end = next
+				continue
+			}
+			end += contextLines
+			if end > len(edits) {
+				end = len(edits)
+			}
+			break
+		}
+		hunks = append(hunks, hunk{start, end})
+		i = end
+	}
+
+	if len(hunks) == 0 {
+		return nil
+	}
+
+	lines := []string{"--- " + aName, "+++ " + bName}
+	for _, h := range hunks {
+		aLen, bLen := 0, 0
+		for _, e := range edits[h.start:h.end] {
+			if e.op != '+' {
+				aLen++
+			}
+			if e.op != '-' {
+				bLen++
+			}
+		}
+		aStart, bStart := edits[h.start].ai, edits[h.start].bi
+		if aLen > 0 {
+			aStart++
+		}
+		if bLen > 0 {
+			bStart++
+		}
+		lines = append(lines, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aLen, bStart, bLen))
+		for _, e := range edits[h.start:h.end] {
+			lines = append(lines, string(e.op)+e.text)
+		}
+	}
+	return lines
+}
+
+// ANSI colors for diffs
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+	colorReset = "\x1b[0m"
+)
+
+// useColor is true if stdout is a terminal and $NO_COLOR isn't set
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ColorizeDiff colors UnifiedDiff lines like `git diff` does
+func ColorizeDiff(lines []string) []string {
+	colored := make([]string, 0, len(lines))
+	for i, l := range lines {
+		switch {
+		case i < 2:
+			// --- and +++ file headers
+			colored = append(colored, l)
+		case strings.HasPrefix(l, "@@"):
+			colored = append(colored, colorCyan+l+colorReset)
+		case strings.HasPrefix(l, "-"):
+			colored = append(colored, colorRed+l+colorReset)
+		case strings.HasPrefix(l, "+"):
+			colored = append(colored, colorGreen+l+colorReset)
+		default:
+			colored = append(colored, l)
+		}
+	}
+	return colored
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       string
+		b       string
+		context int
+		want    []string
+	}{
+		{
+			name:    "same",
+			a:       "a\nb\n",
+			b:       "a\nb\n",
+			context: 3,
+			want:    nil,
+		},
+		{
+			name:    "empty",
+			a:       "",
+			b:       "",
+			context: 3,
+			want:    nil,
+		},
+		{
+			name:    "changed line",
+			a:       "a\nb\nc\nd\ne\n",
+			b:       "a\nb\nC\nd\ne\n",
+			context: 1,
+			want: []string{
+				"--- old", "+++ new",
+				"@@ -2,3 +2,3 @@",
+				" b", "-c", "+C", " d",
+			},
+		},
+		{
+			name:    "added to empty",
+			a:       "",
+			b:       "x\n",
+			context: 3,
+			want: []string{
+				"--- old", "+++ new",
+				"@@ -0,0 +1,1 @@",
+				"+x",
+			},
+		},
+		{
+			name:    "removed everything",
+			a:       "x\ny\n",
+			b:       "",
+			context: 3,
+			want: []string{
+				"--- old", "+++ new",
+				"@@ -1,2 +0,0 @@",
+				"-x", "-y",
+			},
+		},
+		{
+			name:    "distant changes are separate hunks",
+			a:       "1\n2\n3\n4\n5\n6\n7\n",
+			b:       "X\n2\n3\n4\n5\n6\nY\n",
+			context: 1,
+			want: []string{
+				"--- old", "+++ new",
+				"@@ -1,2 +1,2 @@",
+				"-1", "+X", " 2",
+				"@@ -6,2 +6,2 @@",
+				" 6", "-7", "+Y",
+			},
+		},
+		{
+			name:    "close changes share a hunk",
+			a:       "1\n2\n3\n4\n",
+			b:       "X\n2\n3\nY\n",
+			context: 1,
+			want: []string{
+				"--- old", "+++ new",
+				"@@ -1,4 +1,4 @@",
+				"-1", "+X", " 2", " 3", "-4", "+Y",
+			},
+		},
+		{
+			name:    "no context",
+			a:       "a\nb\nc\n",
+			b:       "a\nB\nc\n",
+			context: 0,
+			want: []string{
+				"--- old", "+++ new",
+				"@@ -2,1 +2,1 @@",
+				"-b", "+B",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UnifiedDiff("old", "new", tt.a, tt.b, tt.context)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnifiedDiff() =\n%#v\nwant\n%#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestColorizeDiff(t *testing.T) {
+	lines := []string{"--- old", "+++ new", "@@ -1,1 +1,1 @@", "-a", "+b", " c"}
+	want := []string{
+		"--- old",
+		"+++ new",
+		colorCyan + "@@ -1,1 +1,1 @@" + colorReset,
+		colorRed + "-a" + colorReset,
+		colorGreen + "+b" + colorReset,
+		" c",
+	}
+	got := ColorizeDiff(lines)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ColorizeDiff() = %#v, want %#v", got, want)
+	}
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"encoding/hex"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DNAttribute is one type=value pair in a distinguished name, like CN=x
+type DNAttribute struct {
+	Type  string
+	Value string
+}
+
+// RDN is a relative distinguished name: usually one DNAttribute, or more
+// joined with +
+type RDN []DNAttribute
+
+// dnAttributeType is a descriptor like CN or an OID like 2.5.4.3
+var dnAttributeType = regexp.MustCompile(`^(?:[A-Za-z][A-Za-z0-9-]*|[0-9]+(?:\.[0-9]+)+)$`)
+
+// dnSpecial are the characters that can be escaped with a backslash
+const dnSpecial = "\"+,;<>\\=# "
+
+// ParseDN parses an RFC 4514 distinguished name like
+// "CN=example.com, O=Example\, Inc". Like Key Vault, it allows spaces
+// around separators and ; between RDNs. Hex (#04...) values are checked
+// but left encoded
+func ParseDN(dn string) ([]RDN, error) {
+	var rdns []RDN
+	i := 0
+	skipSpaces := func() {
+		for i < len(dn) && dn[i] == ' ' {
+			i++
+		}
+	}
+
+	for {
+		var rdn RDN
+		for {
+			skipSpaces()
+			start := i
+			for i < len(dn) && dn[i] != '=' && !strings.ContainsRune(",+;", rune(dn[i])) {
+				i++
+			}
+			attrType := strings.TrimSpace(dn[start:i])
+			if attrType == "" {
+				return nil, errors.Errorf("empty attribute (at character %d)", start+1)
+			}
+			if i == len(dn) || dn[i] != '=' {
+				return nil, errors.Errorf("%#v has no = (at character %d)", dn[start:i], start+1)
+			}
+			if !dnAttributeType.MatchString(attrType) {
+				return nil, errors.Errorf("%#v isn't an attribute type like CN or 2.5.4.3 (at character %d)", attrType, start+1)
+			}
+			i++ // =
+			skipSpaces()
+
+			value := strings.Builder{}
+			if i < len(dn) && dn[i] == '#' {
+				start = i
+				i++
+				for i < len(dn) && !strings.ContainsRune(",+; ", rune(dn[i])) {
+					i++
+				}
+				if _, err := hex.DecodeString(dn[start+1 : i]); err != nil || i == start+1 {
+					return nil, errors.Errorf("%s=%s isn't valid hex (at character %d)", attrType, dn[start:i], start+1)
+				}
+				value.WriteString(dn[start:i])
+				skipSpaces()
+			} else {
+				// unescaped trailing spaces are dropped
+				trimmed := 0
+				for i < len(dn) && !strings.ContainsRune(",+;", rune(dn[i])) {
+					c := dn[i]
+					switch {
+					case c == '\\':
+						if i+1 < len(dn) && strings.ContainsRune(dnSpecial, rune(dn[i+1])) {
+							value.WriteByte(dn[i+1])
+							i += 2
+						} else if i+2 < len(dn) && isHexDigit(dn[i+1]) && isHexDigit(dn[i+2]) {
+							b, _ := hex.DecodeString(dn[i+1 : i+3])
+							value.Write(b)
+							i += 3
+						} else {
+							return nil, errors.Errorf("%s has a bad escape (at character %d). Follow \\ with one of %s or two hex digits", attrType, i+1, strings.TrimSpace(dnSpecial)+" space")
+						}
+						trimmed = value.Len()
+						continue
+					case strings.ContainsRune("\"<>", rune(c)):
+						return nil, errors.Errorf("%s has an unescaped %c (at character %d)", attrType, c, i+1)
+					}
+					value.WriteByte(c)
+					if c != ' ' {
+						trimmed = value.Len()
+					}
+					i++
+				}
+				v := value.String()[:trimmed]
+				value.Reset()
+				value.WriteString(v)
+			}
+			rdn = append(rdn, DNAttribute{Type: attrType, Value: value.String()})
+
+			if i < len(dn) && dn[i] == '+' {
+				i++
+				continue
+			}
+			break
+		}
+		rdns = append(rdns, rdn)
+		if i == len(dn) {
+			return rdns, nil
+		}
+		// dn[i] is , or ;
+		i++
+	}
+}
+
+func isHexDigit(c byte) bool {
+	return strings.IndexByte("0123456789abcdefABCDEF", c) != -1
+}
+
+// CommonName returns the first CN in rdns, and whether there is one
+func CommonName(rdns []RDN) (string, bool) {
+	for _, rdn := range rdns {
+		for _, attr := range rdn {
+			if strings.EqualFold(attr.Type, "CN") || attr.Type == "2.5.4.3" {
+				return attr.Value, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDN(t *testing.T) {
+	tests := []struct {
+		dn      string
+		want    []RDN
+		wantErr bool
+	}{
+		{"CN=example.com", []RDN{{{"CN", "example.com"}}}, false},
+		{
+			"CN=example.com, O=Example\\, Inc, C=US",
+			[]RDN{{{"CN", "example.com"}}, {{"O", "Example, Inc"}}, {{"C", "US"}}},
+			false,
+		},
+		{"CN=a;O=b", []RDN{{{"CN", "a"}}, {{"O", "b"}}}, false},
+		{"CN=a+UID=b", []RDN{{{"CN", "a"}, {"UID", "b"}}}, false},
+		{"  CN = a  ,  O = b ", []RDN{{{"CN", "a"}}, {{"O", "b"}}}, false},
+		{"CN=trailing\\ ", []RDN{{{"CN", "trailing "}}}, false},
+		{"CN=caf\\C3\\A9", []RDN{{{"CN", "café"}}}, false},
+		{"2.5.4.3=oid", []RDN{{{"2.5.4.3", "oid"}}}, false},
+		{"CN=#0403616263", []RDN{{{"CN", "#0403616263"}}}, false},
+		{"CN=", []RDN{{{"CN", ""}}}, false},
+		{"", nil, true},
+		{"example.com", nil, true},
+		{"CN=a,", nil, true},
+		{"=a", nil, true},
+		{"C N=a", nil, true},
+		{"CN=a\"b", nil, true},
+		{"CN=a<b", nil, true},
+		{"CN=a\\x", nil, true},
+		{"CN=#zz", nil, true},
+		{"CN=#", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dn, func(t *testing.T) {
+			got, err := ParseDN(tt.dn)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDN(%#v) err = %v, wantErr %v", tt.dn, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDN(%#v) = %#v, want %#v", tt.dn, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommonName(t *testing.T) {
+	tests := []struct {
+		dn         string
+		want       string
+		wantExists bool
+	}{
+		{"CN=example.com, O=Example", "example.com", true},
+		{"O=Example, cn=lower.example.com", "lower.example.com", true},
+		{"2.5.4.3=oid.example.com", "oid.example.com", true},
+		{"O=Example+CN=multi", "multi", true},
+		{"O=Example", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dn, func(t *testing.T) {
+			rdns, err := ParseDN(tt.dn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, exists := CommonName(rdns)
+			if got != tt.want || exists != tt.wantExists {
+				t.Errorf("CommonName(%#v) = %#v, %v, want %#v, %v", tt.dn, got, exists, tt.want, tt.wantExists)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts every kvcrutch environment variable
+const EnvPrefix = "KVCRUTCH_"
+
+// envPathSep separates nested config keys in environment variable names,
+// since the keys themselves have single underscores
+const envPathSep = "__"
+
+// EnvOverride is an environment variable that sets a config key, like
+// KVCRUTCH_CERTIFICATE_CREATE_PARAMETERS__TAGS__OWNER=me
+type EnvOverride struct {
+	Name string
+	// Path is the config keys, like certificate_create_parameters, tags,
+	// owner. See envKey for their case
+	Path []string
+	// Value is parsed as YAML, so numbers, booleans and lists like [a, b]
+	// work. A blank value is null, which unsets the key
+	Value interface{}
+}
+
+// Key is Path joined with dots, like ValidationError.Path
+func (o EnvOverride) Key() string {
+	return strings.Join(o.Path, ".")
+}
+
+// Tree returns the override as nested maps, ready to merge onto a config
+func (o EnvOverride) Tree() map[string]interface{} {
+	var tree interface{} = o.Value
+	for i := len(o.Path) - 1; i >= 0; i-- {
+		tree = map[string]interface{}{o.Path[i]: tree}
+	}
+	return tree.(map[string]interface{})
+}
+
+// envKey turns part of an environment variable name into a config key.
+// Config keys are lowercase, so parts in all caps are lowercased. Anything
+// else is kept as is, so mixed case tag names and vault aliases can be set
+func envKey(part string) string {
+	if part == strings.ToUpper(part) {
+		return strings.ToLower(part)
+	}
+	return part
+}
+
+// ConfigEnvOverrides finds the KVCRUTCH_ variables in environ (see
+// os.Environ) that set config keys, sorted by name. flagEnvars are the
+// names already used by flags, which are skipped. Variables whose first
+// key isn't in topLevelKeys are returned in unknown (sorted) instead of
+// failing, since other tools might share the prefix
+func ConfigEnvOverrides(environ []string, flagEnvars []string, topLevelKeys []string) (overrides []EnvOverride, unknown []string, err error) {
+	skip := make(map[string]bool, len(flagEnvars))
+	for _, name := range flagEnvars {
+		skip[name] = true
+	}
+	known := make(map[string]bool, len(topLevelKeys))
+	for _, key := range topLevelKeys {
+		known[key] = true
+	}
+
+	for _, kv := range environ {
+		nameValue := strings.SplitN(kv, "=", 2)
+		name := nameValue[0]
+		if !strings.HasPrefix(name, EnvPrefix) || skip[name] || len(nameValue) != 2 {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(name, EnvPrefix), envPathSep)
+		if !known[envKey(parts[0])] {
+			unknown = append(unknown, name)
+			continue
+		}
+		o := EnvOverride{Name: name}
+		for _, part := range parts {
+			if part == "" {
+				return nil, nil, errors.Errorf("%s: empty config key. Separate nested keys with %s", name, envPathSep)
+			}
+			o.Path = append(o.Path, envKey(part))
+		}
+		err := yaml.Unmarshal([]byte(nameValue[1]), &o.Value)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "%s isn't valid YAML", name)
+		}
+		overrides = append(overrides, o)
+	}
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].Name < overrides[j].Name
+	})
+	sort.Strings(unknown)
+	return overrides, unknown, nil
+}
+
+// ApplyEnvOverrides merges overrides onto the config YAML in order. Maps
+// are merged key by key, so an override only replaces its own key
+func ApplyEnvOverrides(configBytes []byte, overrides []EnvOverride) ([]byte, error) {
+	var tree interface{}
+	err := yaml.Unmarshal(configBytes, &tree)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+	for _, o := range overrides {
+		tree = mergeYAML(tree, o.Tree())
+	}
+	y, err := yaml.Marshal(tree)
+	return y, errors.WithStack(err)
+}
+
+// EnvOverrideFor returns the override that sets key (a dotted path) or one
+// of its parents, if any
+func EnvOverrideFor(overrides []EnvOverride, key string) (EnvOverride, bool) {
+	for _, o := range overrides {
+		if k := o.Key(); key == k || strings.HasPrefix(key, k+".") {
+			return o, true
+		}
+	}
+	return EnvOverride{}, false
+}
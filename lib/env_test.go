@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfigEnvOverrides(t *testing.T) {
+	topLevelKeys := []string{"default_vault", "vaults", "certificate_create_parameters", "lumberjacklogger"}
+	tests := []struct {
+		name        string
+		environ     []string
+		want        []EnvOverride
+		wantUnknown []string
+		wantErr     bool
+	}{
+		{
+			name:    "not ours",
+			environ: []string{"HOME=/root", "KVCRUTCHX=1", EnvPrefix + "VAULT=flag"},
+		},
+		{
+			name:    "sorted by name",
+			environ: []string{EnvPrefix + "VAULTS__PROD__NAME=kv", EnvPrefix + "DEFAULT_VAULT=prod"},
+			want: []EnvOverride{
+				{Name: EnvPrefix + "DEFAULT_VAULT", Path: []string{"default_vault"}, Value: "prod"},
+				{Name: EnvPrefix + "VAULTS__PROD__NAME", Path: []string{"vaults", "prod", "name"}, Value: "kv"},
+			},
+		},
+		{
+			name:    "mixed case keys are kept",
+			environ: []string{EnvPrefix + "CERTIFICATE_CREATE_PARAMETERS__TAGS__CostCenter=42"},
+			want: []EnvOverride{
+				{Name: EnvPrefix + "CERTIFICATE_CREATE_PARAMETERS__TAGS__CostCenter", Path: []string{"certificate_create_parameters", "tags", "CostCenter"}, Value: 42},
+			},
+		},
+		{
+			name:    "YAML values",
+			environ: []string{EnvPrefix + "LUMBERJACKLOGGER=", EnvPrefix + "DEFAULT_VAULT=[a, b]"},
+			want: []EnvOverride{
+				{Name: EnvPrefix + "DEFAULT_VAULT", Path: []string{"default_vault"}, Value: []interface{}{"a", "b"}},
+				{Name: EnvPrefix + "LUMBERJACKLOGGER", Path: []string{"lumberjacklogger"}},
+			},
+		},
+		{
+			name:        "unknown top level keys are skipped",
+			environ:     []string{EnvPrefix + "DEBUG=1", EnvPrefix + "DEFAULT_VAULT=prod", EnvPrefix + "_X=1"},
+			want:        []EnvOverride{{Name: EnvPrefix + "DEFAULT_VAULT", Path: []string{"default_vault"}, Value: "prod"}},
+			wantUnknown: []string{EnvPrefix + "DEBUG", EnvPrefix + "_X"},
+		},
+		{
+			name:    "empty nested key",
+			environ: []string{EnvPrefix + "VAULTS____NAME=kv"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid YAML",
+			environ: []string{EnvPrefix + "DEFAULT_VAULT=[a"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, unknown, err := ConfigEnvOverrides(tt.environ, []string{EnvPrefix + "VAULT"}, topLevelKeys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+			if !reflect.DeepEqual(unknown, tt.wantUnknown) {
+				t.Errorf("unknown = %v, want %v", unknown, tt.wantUnknown)
+			}
+		})
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		overrides []EnvOverride
+		want      string
+	}{
+		{
+			name:   "empty config",
+			config: "",
+			overrides: []EnvOverride{
+				{Path: []string{"default_vault"}, Value: "prod"},
+			},
+			want: "default_vault: prod\n",
+		},
+		{
+			name:   "maps merge",
+			config: "tags:\n  a: \"1\"\n  b: \"2\"\n",
+			overrides: []EnvOverride{
+				{Path: []string{"tags", "b"}, Value: "3"},
+				{Path: []string{"tags", "C"}, Value: "4"},
+			},
+			want: "tags:\n  C: \"4\"\n  a: \"1\"\n  b: \"3\"\n",
+		},
+		{
+			name:   "lists replace",
+			config: "label_tags: [a, b]\n",
+			overrides: []EnvOverride{
+				{Path: []string{"label_tags"}, Value: []interface{}{"c"}},
+			},
+			want: "label_tags:\n- c\n",
+		},
+		{
+			name:   "null unsets",
+			config: "lumberjacklogger:\n  filename: x.log\n",
+			overrides: []EnvOverride{
+				{Path: []string{"lumberjacklogger"}},
+			},
+			want: "lumberjacklogger: null\n",
+		},
+		{
+			name:   "later overrides win",
+			config: "default_vault: dev\n",
+			overrides: []EnvOverride{
+				{Path: []string{"default_vault"}, Value: "a"},
+				{Path: []string{"default_vault"}, Value: "b"},
+			},
+			want: "default_vault: b\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ApplyEnvOverrides([]byte(tt.config), tt.overrides)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvOverrideFor(t *testing.T) {
+	overrides := []EnvOverride{
+		{Name: "A", Path: []string{"certificate_create_parameters", "tags"}},
+		{Name: "B", Path: []string{"default_vault"}},
+	}
+	tests := []struct {
+		key      string
+		wantName string
+	}{
+		{"certificate_create_parameters.tags", "A"},
+		{"certificate_create_parameters.tags.owner", "A"},
+		{"certificate_create_parameters.tagsx", ""},
+		{"default_vault", "B"},
+		{"vaults", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			o, exists := EnvOverrideFor(overrides, tt.key)
+			if o.Name != tt.wantName || exists != (tt.wantName != "") {
+				t.Errorf("EnvOverrideFor(%#v) = %#v, %v", tt.key, o.Name, exists)
+			}
+		})
+	}
+}
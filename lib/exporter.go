@@ -0,0 +1,385 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// CfgExporter is the exporter section of the config
+type CfgExporter struct {
+	// Vaults are more vault names or URLs to scrape, besides the main vault
+	Vaults []string `yaml:"vaults"`
+	// LabelTags are certificate tags to add as tag_<name> labels
+	LabelTags []string `yaml:"label_tags"`
+	// Interval is how often to list certificates in --listen mode
+	Interval string `yaml:"interval"`
+}
+
+// DefaultExporterInterval is used if the config and flags don't set one
+const DefaultExporterInterval = "5m"
+
+// exporterCertificate is the part of a CertificateItem that's exported
+type exporterCertificate struct {
+	name    string
+	expires *time.Time
+	enabled bool
+	tags    map[string]string
+}
+
+// exporterVault is the latest scrape of one vault. certs are kept from the
+// last successful scrape so one failure doesn't make series disappear.
+// connectErr is set for vaults that couldn't be connected to at startup,
+// which fail every scrape
+type exporterVault struct {
+	vault        Vault
+	connectErr   error
+	certs        []exporterCertificate
+	success      bool
+	errors       int
+	lastScrape   time.Time
+	lastDuration time.Duration
+}
+
+// Exporter lists certificates in vaults and renders them as Prometheus
+// metrics in the text exposition format
+type Exporter struct {
+	logger    *logos.Logger
+	labelTags []string
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	vaults []*exporterVault
+}
+
+// NewExporter builds an Exporter. failed vaults (see ConnectVaults) are
+// exported with kvcrutch_scrape_success 0. Duplicate labelTags are dropped
+func NewExporter(
+	logger *logos.Logger,
+	vaults []Vault,
+	failed []VaultError,
+	labelTags []string,
+	timeout time.Duration,
+) *Exporter {
+	e := &Exporter{
+		logger:  logger,
+		timeout: timeout,
+	}
+	for _, v := range vaults {
+		e.vaults = append(e.vaults, &exporterVault{vault: v})
+	}
+	for _, f := range failed {
+		e.vaults = append(e.vaults, &exporterVault{vault: f.Vault, connectErr: f.Err})
+	}
+	// tags like a.b and a_b would make duplicate labels
+	labelNames := make(map[string]bool)
+	for _, t := range labelTags {
+		if !labelNames[tagLabelName(t)] {
+			labelNames[tagLabelName(t)] = true
+			e.labelTags = append(e.labelTags, t)
+		}
+	}
+	// vaults are rendered sorted, so output is stable between scrapes
+	sort.SliceStable(e.vaults, func(i, j int) bool {
+		return e.vaults[i].vault.Label() < e.vaults[j].vault.Label()
+	})
+	return e
+}
+
+// scrapeVault lists every certificate in a vault
+func (e *Exporter) scrapeVault(v *exporterVault) ([]exporterCertificate, error) {
+	if v.connectErr != nil {
+		return nil, errors.WithMessage(v.connectErr, "couldn't connect at startup")
+	}
+	vault := v.vault
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	var certs []exporterCertificate
+	err := listCertificates(ctx, vault.Client, vault.URL, CertificateFilter{}, func(item keyvault.CertificateItem) error {
+		c := exporterCertificate{tags: tagsToMap(item.Tags)}
+		if item.ID != nil {
+			c.name, _ = ParseCertificateID(*item.ID)
+		}
+		if item.Attributes != nil {
+			c.expires = unixTimeToTime(item.Attributes.Expires)
+			c.enabled = item.Attributes.Enabled != nil && *item.Attributes.Enabled
+		}
+		certs = append(certs, c)
+		return nil
+	})
+	return certs, err
+}
+
+// Scrape lists every vault once. Errors are logged and counted, not
+// returned; Scrape returns false if any vault failed
+func (e *Exporter) Scrape() bool {
+	ok := true
+	for _, v := range e.vaults {
+		start := time.Now()
+		certs, err := e.scrapeVault(v)
+		duration := time.Since(start)
+
+		e.mu.Lock()
+		v.lastScrape = start
+		v.lastDuration = duration
+		v.success = err == nil
+		if err == nil {
+			v.certs = certs
+		} else {
+			v.errors++
+		}
+		e.mu.Unlock()
+
+		if err != nil {
+			ok = false
+			e.logger.Errorw(
+				"Can't scrape vault",
+				"vaultURL", v.vault.URL,
+				"err", err,
+			)
+			continue
+		}
+		e.logger.Debugw(
+			"Scraped vault",
+			"vaultURL", v.vault.URL,
+			"certificates", len(certs),
+			"duration", duration,
+		)
+	}
+	return ok
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// tagLabelName turns a tag name into a valid Prometheus label name
+func tagLabelName(tag string) string {
+	return "tag_" + invalidLabelChars.ReplaceAllString(tag, "_")
+}
+
+// escapeLabelValue escapes a label value for the text exposition format
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// formatLabels renders {k="v",...} with labels in the order given
+func formatLabels(labels [][2]string) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, l[0]+`="`+escapeLabelValue(l[1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// WriteMetrics renders the latest scrape in the Prometheus text exposition
+// format. Output is sorted so it's stable between scrapes
+func (e *Exporter) WriteMetrics(buf *bytes.Buffer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	certLabels := func(v *exporterVault, c exporterCertificate) string {
+		labels := [][2]string{{"vault", v.vault.Label()}, {"name", c.name}}
+		for _, t := range e.labelTags {
+			labels = append(labels, [2]string{tagLabelName(t), c.tags[t]})
+		}
+		return formatLabels(labels)
+	}
+	vaultLabels := func(v *exporterVault) string {
+		return formatLabels([][2]string{{"vault", v.vault.Label()}})
+	}
+	boolToInt := func(b bool) int {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	metric := func(name string, typ string, help string, each func()) {
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, typ)
+		each()
+	}
+
+	metric("kvcrutch_certificate_expiry_timestamp_seconds", "gauge", "When the certificate's latest version expires, in seconds since the epoch", func() {
+		for _, v := range e.vaults {
+			for _, c := range v.certs {
+				if c.expires != nil {
+					fmt.Fprintf(buf, "kvcrutch_certificate_expiry_timestamp_seconds%s %d\n", certLabels(v, c), c.expires.Unix())
+				}
+			}
+		}
+	})
+	metric("kvcrutch_certificate_enabled", "gauge", "1 if the certificate is enabled, 0 otherwise", func() {
+		for _, v := range e.vaults {
+			for _, c := range v.certs {
+				fmt.Fprintf(buf, "kvcrutch_certificate_enabled%s %d\n", certLabels(v, c), boolToInt(c.enabled))
+			}
+		}
+	})
+	metric("kvcrutch_scrape_success", "gauge", "1 if the last scrape of the vault succeeded, 0 otherwise", func() {
+		for _, v := range e.vaults {
+			fmt.Fprintf(buf, "kvcrutch_scrape_success%s %d\n", vaultLabels(v), boolToInt(v.success))
+		}
+	})
+	metric("kvcrutch_scrape_errors_total", "counter", "Failed scrapes of the vault", func() {
+		for _, v := range e.vaults {
+			fmt.Fprintf(buf, "kvcrutch_scrape_errors_total%s %d\n", vaultLabels(v), v.errors)
+		}
+	})
+	metric("kvcrutch_scrape_duration_seconds", "gauge", "How long the last scrape of the vault took", func() {
+		for _, v := range e.vaults {
+			fmt.Fprintf(buf, "kvcrutch_scrape_duration_seconds%s %g\n", vaultLabels(v), v.lastDuration.Seconds())
+		}
+	})
+	metric("kvcrutch_last_scrape_timestamp_seconds", "gauge", "When the vault was last scraped, in seconds since the epoch", func() {
+		for _, v := range e.vaults {
+			if !v.lastScrape.IsZero() {
+				fmt.Fprintf(buf, "kvcrutch_last_scrape_timestamp_seconds%s %d\n", vaultLabels(v), v.lastScrape.Unix())
+			}
+		}
+	})
+}
+
+// WriteTextfile scrapes once and writes the metrics to path for
+// node_exporter's textfile collector. The file is written to a temp file in
+// the same directory and renamed so node_exporter never reads half a file
+func (e *Exporter) WriteTextfile(path string) error {
+	ok := e.Scrape()
+
+	buf := bytes.Buffer{}
+	e.WriteMetrics(&buf)
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf.Bytes())
+	if err != nil {
+		tmp.Close()
+		return errors.WithStack(err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// node_exporter needs to be able to read it
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !ok {
+		return errors.New("some vaults couldn't be scraped. See the log")
+	}
+	return nil
+}
+
+// ServeHTTP serves the latest scrape's metrics
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := bytes.Buffer{}
+	e.WriteMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// RunExporter either writes metrics to textfilePath once (if not blank) or
+// scrapes every interval and serves /metrics on listenAddr until it errors
+func RunExporter(
+	logger *logos.Logger,
+	vaults []Vault,
+	failed []VaultError,
+	timeout time.Duration,
+	labelTags []string,
+	interval time.Duration,
+	listenAddr string,
+	textfilePath string,
+) error {
+	e := NewExporter(logger, vaults, failed, labelTags, timeout)
+
+	if textfilePath != "" {
+		err := e.WriteTextfile(textfilePath)
+		if err != nil {
+			logger.Errorw(
+				"Can't write textfile",
+				"textfilePath", textfilePath,
+				"err", err,
+			)
+			return err
+		}
+		logger.Infow(
+			"Wrote textfile",
+			"textfilePath", textfilePath,
+		)
+		return nil
+	}
+
+	if interval <= 0 {
+		err := errors.Errorf("interval must be positive: %s", interval)
+		logger.Errorw(
+			"Invalid interval",
+			"err", err,
+		)
+		return err
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"can't listen",
+			"listenAddr", listenAddr,
+			"err", err,
+		)
+		return err
+	}
+
+	// scrape before serving so the first Prometheus scrape has data
+	e.Scrape()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			e.Scrape()
+		}
+	}()
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, `<html><body><a href="/metrics">metrics</a></body></html>`)
+	})
+
+	logger.Infow(
+		"exporter listening",
+		"metricsURL", "http://"+listener.Addr().String()+"/metrics",
+		"vaults", len(e.vaults),
+		"interval", interval,
+	)
+	err = errors.WithStack(http.Serve(listener, mux))
+	logger.Errorw(
+		"exporter stopped",
+		"err", err,
+	)
+	return err
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const testExporterGolden = `# HELP kvcrutch_certificate_expiry_timestamp_seconds When the certificate's latest version expires, in seconds since the epoch
+# TYPE kvcrutch_certificate_expiry_timestamp_seconds gauge
+kvcrutch_certificate_expiry_timestamp_seconds{vault="kv",name="alpha",tag_team="pay\"ments",tag_owner_name="a\\b\nc"} 1609459200
+kvcrutch_certificate_expiry_timestamp_seconds{vault="kv",name="beta",tag_team="test",tag_owner_name=""} 1609459200
+# HELP kvcrutch_certificate_enabled 1 if the certificate is enabled, 0 otherwise
+# TYPE kvcrutch_certificate_enabled gauge
+kvcrutch_certificate_enabled{vault="kv",name="alpha",tag_team="pay\"ments",tag_owner_name="a\\b\nc"} 1
+kvcrutch_certificate_enabled{vault="kv",name="beta",tag_team="test",tag_owner_name=""} 0
+# HELP kvcrutch_scrape_success 1 if the last scrape of the vault succeeded, 0 otherwise
+# TYPE kvcrutch_scrape_success gauge
+kvcrutch_scrape_success{vault="down"} 0
+kvcrutch_scrape_success{vault="kv"} 1
+# HELP kvcrutch_scrape_errors_total Failed scrapes of the vault
+# TYPE kvcrutch_scrape_errors_total counter
+kvcrutch_scrape_errors_total{vault="down"} 2
+kvcrutch_scrape_errors_total{vault="kv"} 0
+# HELP kvcrutch_scrape_duration_seconds How long the last scrape of the vault took
+# TYPE kvcrutch_scrape_duration_seconds gauge
+kvcrutch_scrape_duration_seconds{vault="down"} 0.5
+kvcrutch_scrape_duration_seconds{vault="kv"} 0.5
+# HELP kvcrutch_last_scrape_timestamp_seconds When the vault was last scraped, in seconds since the epoch
+# TYPE kvcrutch_last_scrape_timestamp_seconds gauge
+kvcrutch_last_scrape_timestamp_seconds{vault="down"} 1609459200
+kvcrutch_last_scrape_timestamp_seconds{vault="kv"} 1609459200
+`
+
+// newTestExporter scrapes a fakekv vault with an alpha and a (disabled) beta
+// certificate, plus a vault that failed to connect
+func newTestExporter(t *testing.T) *Exporter {
+	t.Helper()
+	tv := newTestVault(t, 0)
+	create := func(name string, flags FlagCertificateCreateParameters) {
+		err := CertificateCreate(
+			tv.logger, tv.kvClient, tv.vaultURL, testTimeout, name,
+			testCertCreateParams(t), flags,
+			false, true, 0,
+		)
+		if err != nil {
+			t.Fatalf("can't create %s: %+v", name, err)
+		}
+	}
+	create("alpha", FlagCertificateCreateParameters{
+		Tags: map[string]*string{"team": strPtr(`pay"ments`), "owner.name": strPtr("a\\b\nc")},
+	})
+	create("beta", FlagCertificateCreateParameters{Enabled: boolPtr(false)})
+
+	vaults := []Vault{{Alias: "kv", URL: tv.vaultURL, Client: tv.kvClient}}
+	failed := []VaultError{{Vault: Vault{Alias: "down", URL: "https://down.vault.azure.net"}, Err: errors.New("connection refused")}}
+	// owner_name and the second team make the same labels as earlier tags
+	labelTags := []string{"team", "owner.name", "owner_name", "team"}
+	return NewExporter(tv.logger, vaults, failed, labelTags, testTimeout)
+}
+
+// fixTimes replaces the scrape's times so output can be compared
+func fixTimes(e *Exporter) {
+	fixed := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, v := range e.vaults {
+		v.lastScrape = fixed
+		v.lastDuration = 500 * time.Millisecond
+		for i := range v.certs {
+			v.certs[i].expires = &fixed
+		}
+	}
+}
+
+func TestExporterWriteMetrics(t *testing.T) {
+	e := newTestExporter(t)
+	for i := 0; i < 2; i++ {
+		if e.Scrape() {
+			t.Error("Scrape should report the down vault failed")
+		}
+	}
+	fixTimes(e)
+
+	buf := bytes.Buffer{}
+	e.WriteMetrics(&buf)
+	if buf.String() != testExporterGolden {
+		t.Errorf("metrics don't match golden output:\ngot:\n%s\nwant:\n%s", buf.String(), testExporterGolden)
+	}
+}
+
+func TestExporterWriteTextfile(t *testing.T) {
+	e := newTestExporter(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kvcrutch.prom")
+	err := ioutil.WriteFile(path, []byte("stale\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = e.WriteTextfile(path)
+	if err == nil || !strings.Contains(err.Error(), "couldn't be scraped") {
+		t.Errorf("err = %v, want the failed scrape reported", err)
+	}
+
+	// the file is still written, and replaced rather than rewritten in place
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("mode = %s, want 0644", info.Mode().Perm())
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`kvcrutch_certificate_enabled{vault="kv",name="alpha",tag_team="pay\"ments",tag_owner_name="a\\b\nc"} 1`,
+		`kvcrutch_scrape_success{vault="down"} 0`,
+		`kvcrutch_scrape_errors_total{vault="down"} 1`,
+	} {
+		if !strings.Contains(string(contents), want+"\n") {
+			t.Errorf("textfile missing %s:\n%s", want, contents)
+		}
+	}
+	if strings.Contains(string(contents), "stale") {
+		t.Error("textfile wasn't replaced")
+	}
+
+	// no temp files are left behind for node_exporter to pick up
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("dir has %v, want just kvcrutch.prom", names)
+	}
+}
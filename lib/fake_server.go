@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/bbkane/kvcrutch/fakekv"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// statusRecorder remembers the status code so requests can be logged
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func logRequests(logger *logos.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		logger.Infow(
+			"fake-server request",
+			"method", r.Method,
+			"url", r.URL.String(),
+			"status", rec.status,
+		)
+	})
+}
+
+// FakeServer serves an in-memory fakekv.Server until it errors. Unless
+// plainHTTP is set, it serves HTTPS with a freshly generated self-signed
+// certificate, written to caCertOut (if not blank) so clients can trust it.
+// issueDelay keeps operations for issuers other than Self in progress, to
+// try out waiting on them
+func FakeServer(
+	logger *logos.Logger,
+	listenAddr string,
+	pageSize int,
+	caCertOut string,
+	plainHTTP bool,
+	issueDelay time.Duration,
+) error {
+	fake := fakekv.New(pageSize)
+	fake.SetIssueDelay(issueDelay)
+	srv := &http.Server{
+		Addr:    listenAddr,
+		Handler: logRequests(logger, fake),
+	}
+
+	// listen before writing caCertOut, so a failed bind doesn't replace the
+	// CA of whatever is already serving there
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		err = errors.WithStack(err)
+		logger.Errorw(
+			"can't listen",
+			"listenAddr", listenAddr,
+			"err", err,
+		)
+		return err
+	}
+
+	scheme := "http"
+	if !plainHTTP {
+		scheme = "https"
+		host, _, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			listener.Close()
+			err = errors.WithStack(err)
+			logger.Errorw(
+				"can't parse --listen",
+				"listenAddr", listenAddr,
+				"err", err,
+			)
+			return err
+		}
+		tlsCert, certPEM, err := fakekv.NewTLSCertificate([]string{host, "localhost", "127.0.0.1", "::1"})
+		if err != nil {
+			listener.Close()
+			logger.Errorw(
+				"can't create TLS certificate",
+				"err", err,
+			)
+			return err
+		}
+		if caCertOut != "" {
+			err = ioutil.WriteFile(caCertOut, certPEM, 0644)
+			if err != nil {
+				listener.Close()
+				err = errors.WithStack(err)
+				logger.Errorw(
+					"can't write TLS certificate",
+					"caCertOut", caCertOut,
+					"err", err,
+				)
+				return err
+			}
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+	}
+
+	logger.Infow(
+		"fake-server listening",
+		"vaultURL", scheme+"://"+listener.Addr().String(),
+		"caCertOut", caCertOut,
+	)
+
+	if plainHTTP {
+		err = srv.Serve(listener)
+	} else {
+		err = srv.ServeTLS(listener, "", "")
+	}
+	err = errors.WithStack(err)
+	logger.Errorw(
+		"fake-server stopped",
+		"err", err,
+	)
+	return err
+}
@@ -0,0 +1,281 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/bbkane/kvcrutch/fakekv"
+	"github.com/bbkane/logos"
+	"gopkg.in/yaml.v2"
+)
+
+const testTimeout = 10 * time.Second
+
+// testVault is a fakekv.Server served over TLS with a client for it
+type testVault struct {
+	fake     *fakekv.Server
+	kvClient KeyVaultClient
+	vaultURL string
+	logger   *logos.Logger
+	// tlsConfig trusts the server's certificate
+	tlsConfig *tls.Config
+	// listRequests counts GETs of the certificate list, including nextLinks
+	listRequests int64
+	// intercept, if set, handles requests instead of fake. It can pass them
+	// on with fake.ServeHTTP. Set it before making requests
+	intercept http.HandlerFunc
+}
+
+func newTestVault(t *testing.T, pageSize int) *testVault {
+	t.Helper()
+	tv := &testVault{fake: fakekv.New(pageSize)}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/certificates" {
+			atomic.AddInt64(&tv.listRequests, 1)
+		}
+		if tv.intercept != nil {
+			tv.intercept(w, r)
+			return
+		}
+		tv.fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	tv.logger = logos.NewLogger(logos.NewZapSugaredLogger(nil, nil, "test"))
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+	kvClient, err := PrepareKV(tv.logger, autorest.NullAuthorizer{}, tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tv.kvClient = kvClient
+	tv.vaultURL = srv.URL
+	tv.tlsConfig = tlsConfig
+	return tv
+}
+
+const testCfgCertificateCreateParameters = `
+certificate_attributes:
+  enabled: true
+certificate_policy:
+  key_properties:
+    exportable: true
+    key_type: RSA
+    key_size: 2048
+    reuse_key: false
+  secret_properties:
+    content_type: application/x-pem-file
+  x509_certificate_properties:
+    subject: CN=test.example.com
+    subject_alternative_names:
+      - test.example.com
+    validity_in_months: 6
+  lifetime_actions:
+    - trigger:
+        days_before_expiry: 30
+      action: AutoRenew
+  issuer_parameters:
+    name: Self
+tags:
+  team: test
+`
+
+func testCertCreateParams(t *testing.T) CfgCertificateCreateParameters {
+	t.Helper()
+	var cfgCCP CfgCertificateCreateParameters
+	err := yaml.UnmarshalStrict([]byte(testCfgCertificateCreateParameters), &cfgCCP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfgCCP
+}
+
+// createTestCertificate creates a Self signed certificate named certName
+func (tv *testVault) createTestCertificate(t *testing.T, certName string) {
+	t.Helper()
+	err := CertificateCreate(
+		tv.logger, tv.kvClient, tv.vaultURL, testTimeout, certName,
+		testCertCreateParams(t), FlagCertificateCreateParameters{},
+		false, true, 0,
+	)
+	if err != nil {
+		t.Fatalf("can't create %s: %+v", certName, err)
+	}
+}
+
+func (tv *testVault) versionCount(t *testing.T, certName string) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	versions, err := tv.kvClient.GetCertificateVersionsComplete(ctx, tv.vaultURL, certName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for versions.NotDone() {
+		count++
+		err = versions.NextWithContext(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return count
+}
+
+func TestCertificateCreate(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.createTestCertificate(t, "created")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	bundle, err := tv.kvClient.GetCertificate(ctx, tv.vaultURL, "created", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	details, err := NewCertificateDetails(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.X509 == nil || details.X509.Subject != "CN=test.example.com" {
+		t.Errorf("unexpected x509 details: %#v", details.X509)
+	}
+	if details.Tags["team"] != "test" {
+		t.Errorf("tags = %v, want team=test", details.Tags)
+	}
+
+	// a second create needs newVersionOk
+	err = CertificateCreate(
+		tv.logger, tv.kvClient, tv.vaultURL, testTimeout, "created",
+		testCertCreateParams(t), FlagCertificateCreateParameters{},
+		false, true, 0,
+	)
+	if err == nil {
+		t.Error("creating an existing certificate without newVersionOk should fail")
+	}
+}
+
+func TestListCertificatesPaging(t *testing.T) {
+	tests := []struct {
+		name         string
+		pageSize     int
+		certs        int
+		wantRequests int64
+	}{
+		{"empty", 2, 0, 1},
+		{"one page", 5, 3, 1},
+		{"exact pages", 2, 4, 2},
+		{"partial last page", 2, 5, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tv := newTestVault(t, tt.pageSize)
+			for i := 0; i < tt.certs; i++ {
+				tv.createTestCertificate(t, "cert-"+string(rune('a'+i)))
+			}
+			atomic.StoreInt64(&tv.listRequests, 0)
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			var names []string
+			err := listCertificates(ctx, tv.kvClient, tv.vaultURL, CertificateFilter{}, func(item keyvault.CertificateItem) error {
+				names = append(names, NewCertificateListItem(item).Name)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(names) != tt.certs {
+				t.Errorf("listed %d certificates, want %d: %v", len(names), tt.certs, names)
+			}
+			if got := atomic.LoadInt64(&tv.listRequests); got != tt.wantRequests {
+				t.Errorf("made %d list requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestCertificateNewVersion(t *testing.T) {
+	tv := newTestVault(t, 0)
+	tv.createTestCertificate(t, "rotated")
+
+	changes := FlagNewVersionChanges{AddSans: []string{"www.test.example.com"}}
+	err := CertificateNewVersion(tv.logger, tv.kvClient, tv.vaultURL, "rotated", testTimeout, changes, true, 0)
+	if err != nil {
+		t.Fatalf("%+v", err)
+	}
+	if got := tv.versionCount(t, "rotated"); got != 2 {
+		t.Errorf("%d versions, want 2", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	bundle, err := tv.kvClient.GetCertificate(ctx, tv.vaultURL, "rotated", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sans := formatStrSlicePtr(bundle.Policy.X509CertificateProperties.SubjectAlternativeNames.DNSNames)
+	if sans != "test.example.com, www.test.example.com" {
+		t.Errorf("SANs = %#v", sans)
+	}
+
+	err = CertificateNewVersion(tv.logger, tv.kvClient, tv.vaultURL, "missing", testTimeout, FlagNewVersionChanges{}, true, 0)
+	if err == nil {
+		t.Error("new-version of a missing certificate should fail")
+	}
+}
+
+func TestCertificateNewVersionInheritedProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*keyvault.CertificateCreateParameters)
+	}{
+		{"CN without SANs", func(p *keyvault.CertificateCreateParameters) {
+			p.CertificatePolicy.X509CertificateProperties.SubjectAlternativeNames = nil
+		}},
+		{"no validity", func(p *keyvault.CertificateCreateParameters) {
+			p.CertificatePolicy.X509CertificateProperties.ValidityInMonths = nil
+		}},
+		{"validity longer than the issuer allows", func(p *keyvault.CertificateCreateParameters) {
+			p.CertificatePolicy.IssuerParameters.Name = strPtr("DigiCert")
+			months := int32(24)
+			p.CertificatePolicy.X509CertificateProperties.ValidityInMonths = &months
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tv := newTestVault(t, 0)
+			// create it directly, the way the portal would, since kvcrutch
+			// won't
+			params := BuildCertificateCreateParameters(testCertCreateParams(t), FlagCertificateCreateParameters{})
+			tt.edit(&params)
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			_, err := tv.kvClient.CreateCertificate(ctx, tv.vaultURL, "inherited", params)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			changes := FlagNewVersionChanges{AddTags: map[string]*string{"rotated": strPtr("yes")}}
+			err = CertificateNewVersion(tv.logger, tv.kvClient, tv.vaultURL, "inherited", testTimeout, changes, true, 0)
+			if err != nil {
+				t.Fatalf("inherited problems shouldn't block new-version: %+v", err)
+			}
+			if got := tv.versionCount(t, "inherited"); got != 2 {
+				t.Errorf("%d versions, want 2", got)
+			}
+
+			// problems the changes add still block it
+			changes = FlagNewVersionChanges{AddSans: []string{"*.com"}}
+			err = CertificateNewVersion(tv.logger, tv.kvClient, tv.vaultURL, "inherited", testTimeout, changes, true, 0)
+			if err == nil {
+				t.Error("adding an invalid SAN should fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/pkg/errors"
+)
+
+// ParseDuration is time.ParseDuration plus whole day ("30d") and week
+// ("2w") units, which come up a lot with certificate expiry
+func ParseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil {
+				return 0, errors.Errorf("invalid duration: %#v", s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	return d, errors.WithStack(err)
+}
+
+// CertificateFilter selects CertificateItems client-side. Every set field
+// must match (AND semantics); the zero value matches everything
+type CertificateFilter struct {
+	// Tags must all be present. A nil value only checks the key exists
+	Tags map[string]*string
+	// NameGlob is a path.Match pattern, matched case-insensitively
+	NameGlob string
+	// Enabled, if set, must equal the certificate's enabled attribute
+	Enabled *bool
+	// ExpiresWithin, if not 0, matches certificates expiring before
+	// Now+ExpiresWithin, including ones that have already expired
+	ExpiresWithin time.Duration
+	// Expired matches certificates that expired before Now
+	Expired bool
+	// Now is when expiry is measured from. Defaults to time.Now()
+	Now time.Time
+}
+
+// ParseTagFilters parses key=value (value must match) and key (key must
+// exist) tag filters
+func ParseTagFilters(flagTags []string) (map[string]*string, error) {
+	tags := make(map[string]*string)
+	for _, kv := range flagTags {
+		keyValue := strings.SplitN(kv, "=", 2)
+		if keyValue[0] == "" {
+			return nil, errors.Errorf("tag filters should be formatted key=value or key : %#v", kv)
+		}
+		if _, exists := tags[keyValue[0]]; exists {
+			return nil, errors.Errorf("key duplicate: %#v", kv)
+		}
+		if len(keyValue) == 1 {
+			tags[keyValue[0]] = nil
+		} else {
+			value := keyValue[1]
+			tags[keyValue[0]] = &value
+		}
+	}
+	return tags, nil
+}
+
+// Validate checks a glob compiles. Call it before listing so a bad pattern
+// doesn't silently match nothing
+func (f CertificateFilter) Validate() error {
+	if f.NameGlob != "" {
+		_, err := path.Match(f.NameGlob, "")
+		if err != nil {
+			return errors.Wrapf(err, "invalid name glob: %#v", f.NameGlob)
+		}
+	}
+	return nil
+}
+
+// Match reports whether item passes every filter
+func (f CertificateFilter) Match(item keyvault.CertificateItem) bool {
+	for k, want := range f.Tags {
+		got, exists := item.Tags[k]
+		if !exists {
+			return false
+		}
+		if want != nil && (got == nil || *got != *want) {
+			return false
+		}
+	}
+
+	if f.NameGlob != "" {
+		name := ""
+		if item.ID != nil {
+			name, _ = ParseCertificateID(*item.ID)
+		}
+		matched, err := path.Match(strings.ToLower(f.NameGlob), strings.ToLower(name))
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	if f.Enabled != nil {
+		if item.Attributes == nil || item.Attributes.Enabled == nil || *item.Attributes.Enabled != *f.Enabled {
+			return false
+		}
+	}
+
+	if f.ExpiresWithin != 0 || f.Expired {
+		now := f.Now
+		if now.IsZero() {
+			now = time.Now()
+		}
+		if item.Attributes == nil || item.Attributes.Expires == nil {
+			return false
+		}
+		expires := time.Time(*item.Attributes.Expires)
+		if f.ExpiresWithin != 0 && !expires.Before(now.Add(f.ExpiresWithin)) {
+			return false
+		}
+		if f.Expired && !expires.Before(now) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/Azure/go-autorest/autorest/date"
+)
+
+func strPtr(s string) *string { return &s }
+
+func boolPtr(b bool) *bool { return &b }
+
+func testCertificateItem(name string, enabled bool, expires time.Time, tags map[string]*string) keyvault.CertificateItem {
+	exp := date.UnixTime(expires)
+	return keyvault.CertificateItem{
+		ID: strPtr("https://test.vault.azure.net/certificates/" + name),
+		Attributes: &keyvault.CertificateAttributes{
+			Enabled: &enabled,
+			Expires: &exp,
+		},
+		Tags: tags,
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"12h", 12 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"0d", 0, false},
+		{"xd", 0, true},
+		{"1.5d", 0, true},
+		{"soon", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseDuration(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDuration(%#v) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseDuration(%#v) = %v, want %v", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTagFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   []string
+		want    map[string]*string
+		wantErr bool
+	}{
+		{"none", nil, map[string]*string{}, false},
+		{"key and value", []string{"team=a"}, map[string]*string{"team": strPtr("a")}, false},
+		{"key only", []string{"team"}, map[string]*string{"team": nil}, false},
+		{"empty value", []string{"team="}, map[string]*string{"team": strPtr("")}, false},
+		{"value with =", []string{"q=a=b"}, map[string]*string{"q": strPtr("a=b")}, false},
+		{"empty key", []string{"=a"}, nil, true},
+		{"duplicate key", []string{"team=a", "team=b"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTagFilters(tt.flags)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCertificateFilterValidate(t *testing.T) {
+	if err := (CertificateFilter{NameGlob: "api-*"}).Validate(); err != nil {
+		t.Errorf("valid glob: %v", err)
+	}
+	if err := (CertificateFilter{NameGlob: "api-["}).Validate(); err == nil {
+		t.Error("invalid glob should fail")
+	}
+}
+
+func TestCertificateFilterMatch(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	item := testCertificateItem("API-prod", true, now.Add(10*day), map[string]*string{
+		"team": strPtr("payments"),
+		"env":  nil,
+	})
+	expired := testCertificateItem("old", false, now.Add(-day), nil)
+
+	tests := []struct {
+		name   string
+		filter CertificateFilter
+		item   keyvault.CertificateItem
+		want   bool
+	}{
+		{"zero value matches", CertificateFilter{}, item, true},
+		{"tag value", CertificateFilter{Tags: map[string]*string{"team": strPtr("payments")}}, item, true},
+		{"wrong tag value", CertificateFilter{Tags: map[string]*string{"team": strPtr("search")}}, item, false},
+		{"tag exists", CertificateFilter{Tags: map[string]*string{"team": nil}}, item, true},
+		{"nil tag value doesn't match a value", CertificateFilter{Tags: map[string]*string{"env": strPtr("")}}, item, false},
+		{"missing tag", CertificateFilter{Tags: map[string]*string{"owner": nil}}, item, false},
+		{"glob is case insensitive", CertificateFilter{NameGlob: "api-*"}, item, true},
+		{"glob mismatch", CertificateFilter{NameGlob: "web-*"}, item, false},
+		{"enabled", CertificateFilter{Enabled: boolPtr(true)}, item, true},
+		{"disabled", CertificateFilter{Enabled: boolPtr(false)}, item, false},
+		{"expires within", CertificateFilter{ExpiresWithin: 30 * day, Now: now}, item, true},
+		{"expires later", CertificateFilter{ExpiresWithin: 5 * day, Now: now}, item, false},
+		{"expires within includes expired", CertificateFilter{ExpiresWithin: 5 * day, Now: now}, expired, true},
+		{"expired", CertificateFilter{Expired: true, Now: now}, expired, true},
+		{"not expired", CertificateFilter{Expired: true, Now: now}, item, false},
+		{"every filter", CertificateFilter{
+			Tags:          map[string]*string{"team": nil},
+			NameGlob:      "*prod",
+			Enabled:       boolPtr(true),
+			ExpiresWithin: 30 * day,
+			Now:           now,
+		}, item, true},
+		{"no attributes", CertificateFilter{Enabled: boolPtr(true)}, keyvault.CertificateItem{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.item); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
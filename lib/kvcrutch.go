@@ -3,16 +3,18 @@ package lib
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
-	kvauth "github.com/Azure/azure-sdk-for-go/services/keyvault/auth"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/bbkane/logos"
 	"github.com/pkg/errors"
@@ -51,13 +53,33 @@ type CfgCertificateCreateParameters struct {
 	Tags map[string]string `yaml:"tags"`
 }
 
+// FlagCertificateCreateParameters override the config's
+// CfgCertificateCreateParameters. Blank strings, zero numbers and nil
+// pointers and slices aren't passed
 type FlagCertificateCreateParameters struct {
 	Subject          string
 	Sans             []string
 	Tags             map[string]*string
 	ValidityInMonths int32
-	Enabled          bool
+	Enabled          *bool
 	IssuerName       string
+	Exportable       *bool
+	KeyType          string
+	KeySize          int32
+	ReuseKey         *bool
+	ContentType      string
+	// LifetimeActions replace the config's. Empty (not nil) removes them
+	LifetimeActions []keyvault.LifetimeAction
+}
+
+// FlagNewVersionChanges are changes to make to the latest version of a
+// certificate when creating a new version
+type FlagNewVersionChanges struct {
+	AddSans          []string
+	RmSans           []string
+	AddTags          map[string]*string
+	RmTags           []string
+	ValidityInMonths int32
 }
 
 func LogAutorestRequest(logger *logos.Logger) autorest.PrepareDecorator {
@@ -104,7 +126,7 @@ func LogAutorestResponse(logger *logos.Logger) autorest.RespondDecorator {
 
 func CertificateCreate(
 	logger *logos.Logger,
-	kvClient *keyvault.BaseClient,
+	kvClient KeyVaultClient,
 	vaultURL string,
 	timeout time.Duration,
 	certName string,
@@ -112,34 +134,43 @@ func CertificateCreate(
 	flagCertCreateParams FlagCertificateCreateParameters,
 	newVersionOk bool,
 	skipConfirmation bool,
+	waitTimeout time.Duration,
 ) error {
 
-	params := CreateKVCertCreateParamsFromCfg(cfgCertCreateParams)
+	params := BuildCertificateCreateParameters(cfgCertCreateParams, flagCertCreateParams)
 
-	OverwriteKVCertCreateParamsWithCreateFlags(&params, flagCertCreateParams)
+	problems := ValidateCertificateCreateParameters(params)
+	if len(problems) > 0 {
+		logValidationErrors(logger, "Invalid certificate create parameters. Fix the flags or config - `config validate` shows config line numbers", certName, problems)
+		return problems
+	}
 
 	// check if it exists - not that there's a small race condition if this succeeds and someone else creates
 	// a cert with the name we want before we issue our create
-	if !newVersionOk {
+	var latest *keyvault.CertificateBundle
+	{
 		// TODO: the timeout doesn't work here, though it work when I create a certificate
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		// A blank version means get the latest version
 		// NOTE: how much $$$ does this call cost?
-		_, err := kvClient.GetCertificate(ctx, vaultURL, certName, "")
+		cert, err := kvClient.GetCertificate(ctx, vaultURL, certName, "")
 		if err == nil {
-			err = errors.Errorf("certificate already exists for certName: %#v\n", certName)
-			logger.Errorw(
-				"certificate already exists for name. Pass `--new-version-ok` to create a new version",
-				"certName", certName,
-				"err", err,
-			)
-			return err
+			if !newVersionOk {
+				err = errors.Errorf("certificate already exists for certName: %#v\n", certName)
+				logger.Errorw(
+					"certificate already exists for name. Pass `--new-version-ok` to create a new version",
+					"certName", certName,
+					"err", err,
+				)
+				return err
+			}
+			latest = &cert
 		}
 	}
 
 	if !skipConfirmation {
-		err := creationPrompt(vaultURL, &params)
+		err := creationPrompt(vaultURL, &params, latest, nil)
 		if err != nil {
 			logger.Errorw(
 				"Can't confirm creation",
@@ -179,9 +210,21 @@ func CertificateCreate(
 		"status", *result.Status,
 		"statusDetails", *result.StatusDetails,
 	)
+	// 0 means don't wait
+	if waitTimeout > 0 {
+		return waitForIssuedCertificate(logger, kvClient, vaultURL, timeout, certName, waitTimeout)
+	}
 	return nil
 }
 
+// BuildCertificateCreateParameters is what `certificate create` sends: the
+// config (or template) overwritten with any flags passed
+func BuildCertificateCreateParameters(cfgCCP CfgCertificateCreateParameters, flagCCP FlagCertificateCreateParameters) keyvault.CertificateCreateParameters {
+	params := CreateKVCertCreateParamsFromCfg(cfgCCP)
+	OverwriteKVCertCreateParamsWithCreateFlags(&params, flagCCP)
+	return params
+}
+
 func CreateKVCertCreateParamsFromCfg(cfgCCP CfgCertificateCreateParameters) keyvault.CertificateCreateParameters {
 
 	var la []keyvault.LifetimeAction
@@ -202,6 +245,7 @@ func CreateKVCertCreateParamsFromCfg(cfgCCP CfgCertificateCreateParameters) keyv
 	tags := make(map[string]*string)
 	{
 		for k, v := range cfgCCP.Tags {
+			v := v
 			tags[k] = &v
 		}
 	}
@@ -259,15 +303,171 @@ func OverwriteKVCertCreateParamsWithCreateFlags(
 	if flagCertCreateParams.ValidityInMonths != 0 {
 		ccp.CertificatePolicy.X509CertificateProperties.ValidityInMonths = &flagCertCreateParams.ValidityInMonths
 	}
-	// NOTE: if not passed, then this resolves as false
-	// and we get the config version
-	if flagCertCreateParams.Enabled != false {
-		ccp.CertificateAttributes.Enabled = &flagCertCreateParams.Enabled
+	if flagCertCreateParams.Enabled != nil {
+		ccp.CertificateAttributes.Enabled = flagCertCreateParams.Enabled
 	}
-
 	if flagCertCreateParams.IssuerName != "" {
 		ccp.CertificatePolicy.IssuerParameters.Name = &flagCertCreateParams.IssuerName
 	}
+
+	keyProps := ccp.CertificatePolicy.KeyProperties
+	if flagCertCreateParams.Exportable != nil {
+		keyProps.Exportable = flagCertCreateParams.Exportable
+	}
+	if flagCertCreateParams.KeyType != "" {
+		keyProps.KeyType = &flagCertCreateParams.KeyType
+	}
+	if flagCertCreateParams.KeySize != 0 {
+		keyProps.KeySize = &flagCertCreateParams.KeySize
+	}
+	if flagCertCreateParams.ReuseKey != nil {
+		keyProps.ReuseKey = flagCertCreateParams.ReuseKey
+	}
+
+	if flagCertCreateParams.ContentType != "" {
+		ccp.CertificatePolicy.SecretProperties.ContentType = &flagCertCreateParams.ContentType
+	}
+	if flagCertCreateParams.LifetimeActions != nil {
+		ccp.CertificatePolicy.LifetimeActions = &flagCertCreateParams.LifetimeActions
+	}
+}
+
+// ParseLifetimeActions parses --lifetime-action flags like AutoRenew@30d
+// (30 days before expiry) or EmailContacts@80% (80% of the way through the
+// certificate's lifetime). A single "none" means no lifetime actions
+func ParseLifetimeActions(flagActions []string) ([]keyvault.LifetimeAction, error) {
+	if len(flagActions) == 0 {
+		return nil, nil
+	}
+	if len(flagActions) == 1 && flagActions[0] == "none" {
+		return []keyvault.LifetimeAction{}, nil
+	}
+	var las []keyvault.LifetimeAction
+	for _, fa := range flagActions {
+		actionTrigger := strings.SplitN(fa, "@", 2)
+		if len(actionTrigger) != 2 {
+			return nil, errors.Errorf("lifetime actions should be formatted <action>@<days>d or <action>@<percentage>%%: %#v", fa)
+		}
+		action, trigger := actionTrigger[0], actionTrigger[1]
+
+		la := keyvault.LifetimeAction{
+			Trigger: &keyvault.Trigger{},
+			Action:  &keyvault.Action{ActionType: keyvault.ActionType(action)},
+		}
+		var n int
+		var err error
+		switch {
+		case strings.HasSuffix(trigger, "d"):
+			n, err = strconv.Atoi(strings.TrimSuffix(trigger, "d"))
+			v := int32(n)
+			la.Trigger.DaysBeforeExpiry = &v
+		case strings.HasSuffix(trigger, "%"):
+			n, err = strconv.Atoi(strings.TrimSuffix(trigger, "%"))
+			v := int32(n)
+			la.Trigger.LifetimePercentage = &v
+		default:
+			err = errors.New("trigger must end in d or %")
+		}
+		if err != nil {
+			return nil, errors.Errorf("can't parse lifetime action trigger %#v in %#v: %s", trigger, fa, err)
+		}
+		las = append(las, la)
+	}
+	return las, nil
+}
+
+// ApplyNewVersionChanges applies changes to params (built from the latest
+// version of a certificate) and returns a description of each change.
+// Removing a SAN or tag that doesn't exist, or adding a SAN that does, is
+// an error - it's probably a typo
+func ApplyNewVersionChanges(params *keyvault.CertificateCreateParameters, changes FlagNewVersionChanges) ([]string, error) {
+	var descriptions []string
+
+	if len(changes.AddSans) > 0 || len(changes.RmSans) > 0 || changes.ValidityInMonths != 0 {
+		if params.CertificatePolicy == nil {
+			params.CertificatePolicy = &keyvault.CertificatePolicy{}
+		}
+		if params.CertificatePolicy.X509CertificateProperties == nil {
+			params.CertificatePolicy.X509CertificateProperties = &keyvault.X509CertificateProperties{}
+		}
+	}
+
+	if len(changes.AddSans) > 0 || len(changes.RmSans) > 0 {
+		x509Props := params.CertificatePolicy.X509CertificateProperties
+		if x509Props.SubjectAlternativeNames == nil {
+			x509Props.SubjectAlternativeNames = &keyvault.SubjectAlternativeNames{}
+		}
+		var sans []string
+		if x509Props.SubjectAlternativeNames.DNSNames != nil {
+			sans = append(sans, *x509Props.SubjectAlternativeNames.DNSNames...)
+		}
+
+		indexOf := func(san string) int {
+			for i, s := range sans {
+				if strings.EqualFold(s, san) {
+					return i
+				}
+			}
+			return -1
+		}
+		for _, san := range changes.RmSans {
+			i := indexOf(san)
+			if i == -1 {
+				return nil, errors.Errorf("can't remove SAN not in certificate: %#v", san)
+			}
+			sans = append(sans[:i], sans[i+1:]...)
+			descriptions = append(descriptions, "- san: "+san)
+		}
+		for _, san := range changes.AddSans {
+			if indexOf(san) != -1 {
+				return nil, errors.Errorf("can't add SAN already in certificate: %#v", san)
+			}
+			sans = append(sans, san)
+			descriptions = append(descriptions, "+ san: "+san)
+		}
+		x509Props.SubjectAlternativeNames.DNSNames = &sans
+	}
+
+	if len(changes.AddTags) > 0 || len(changes.RmTags) > 0 {
+		// copy so the old tags aren't changed under the caller
+		tags := make(map[string]*string, len(params.Tags))
+		for k, v := range params.Tags {
+			tags[k] = v
+		}
+		for _, k := range changes.RmTags {
+			old, exists := tags[k]
+			if !exists {
+				return nil, errors.Errorf("can't remove tag not in certificate: %#v", k)
+			}
+			delete(tags, k)
+			descriptions = append(descriptions, fmt.Sprintf("- tag: %s=%s", k, formatStrPtr(old)))
+		}
+		// sorted so the descriptions are stable
+		keys := make([]string, 0, len(changes.AddTags))
+		for k := range changes.AddTags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := changes.AddTags[k]
+			if old, exists := tags[k]; exists {
+				descriptions = append(descriptions, fmt.Sprintf("~ tag: %s=%s -> %s=%s", k, formatStrPtr(old), k, formatStrPtr(v)))
+			} else {
+				descriptions = append(descriptions, fmt.Sprintf("+ tag: %s=%s", k, formatStrPtr(v)))
+			}
+			tags[k] = v
+		}
+		params.Tags = tags
+	}
+
+	if changes.ValidityInMonths != 0 {
+		x509Props := params.CertificatePolicy.X509CertificateProperties
+		validity := changes.ValidityInMonths
+		descriptions = append(descriptions, fmt.Sprintf("~ validity_in_months: %s -> %d", formatInt32Ptr(x509Props.ValidityInMonths), validity))
+		x509Props.ValidityInMonths = &validity
+	}
+
+	return descriptions, nil
 }
 
 func ParseTags(flagTags []string) (map[string]*string, error) {
@@ -285,18 +485,15 @@ func ParseTags(flagTags []string) (map[string]*string, error) {
 	return flagTagsMap, nil
 }
 
-func PrepareKV(logger *logos.Logger) (*keyvault.BaseClient, error) {
+// PrepareKV builds a KeyVaultClient using authorizer (see NewAuthorizer).
+// tlsConfig is used for all vault connections
+func PrepareKV(logger *logos.Logger, authorizer autorest.Authorizer, tlsConfig *tls.Config) (KeyVaultClient, error) {
 	kvClient := keyvault.New()
-	var err error
-	kvClient.Authorizer, err = kvauth.NewAuthorizerFromCLI()
-	if err != nil {
-		err = errors.WithStack(err)
-		logger.Errorw(
-			"keyvault authorization error. Log in with `az login`",
-			"err", err,
-		)
-		return nil, err
-	}
+	kvClient.Authorizer = authorizer
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	kvClient.Sender = &http.Client{Transport: transport}
 
 	// https://github.com/Azure-Samples/azure-sdk-for-go-samples/blob/master/keyvault/examples/go-keyvault-msi-example.go
 	kvClient.RequestInspector = LogAutorestRequest(logger)
@@ -304,60 +501,15 @@ func PrepareKV(logger *logos.Logger) (*keyvault.BaseClient, error) {
 	return &kvClient, nil
 }
 
-func CertificateList(logger *logos.Logger, kvClient *keyvault.BaseClient, vaultURL string, timeout time.Duration) error {
-
-	// TODO: this crosses boundaries as needed. If it does that lazily, will the context time out?
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-	certs, err := kvClient.GetCertificatesComplete(ctx, vaultURL, nil)
-	if err != nil {
-		err = errors.WithStack(err)
-		logger.Errorw(
-			"Can't get certificates",
-			"err", err,
-		)
-		return err
-	}
-
-	for certs.NotDone() {
-
-		cert := certs.Value()
-
-		certJSON, err := json.MarshalIndent(cert, "", "  ")
-		if err != nil {
-			err := errors.WithStack(err)
-			logger.Errorw(
-				"Can't marshall cert info",
-				"cert", cert,
-				"err", err,
-			)
-			return err
-		}
-
-		fmt.Println(string(certJSON))
-
-		err = certs.NextWithContext(ctx)
-		if err != nil {
-			err := errors.WithStack(err)
-			logger.Errorw(
-				"Can't advance certs list",
-				"certs", certs,
-				"err", err,
-			)
-			return err
-		}
-	}
-
-	return nil
-}
-
 func CertificateNewVersion(
 	logger *logos.Logger,
-	kvClient *keyvault.BaseClient,
+	kvClient KeyVaultClient,
 	vaultURL string,
 	certName string,
 	timeout time.Duration,
+	changes FlagNewVersionChanges,
 	skipConfirmation bool,
+	waitTimeout time.Duration,
 ) error {
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
@@ -374,14 +526,55 @@ func CertificateNewVersion(
 		return err
 	}
 
+	// copy the policy so changes don't show up in cert (and the diff)
+	policy, err := copyCertificatePolicy(cert.Policy)
+	if err != nil {
+		logger.Errorw(
+			"Can't copy certificate policy",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
 	certCreateParams := keyvault.CertificateCreateParameters{
-		CertificatePolicy:     cert.Policy,
+		CertificatePolicy:     policy,
 		CertificateAttributes: cert.Attributes,
 		Tags:                  cert.Tags,
 	}
 
+	// Key Vault already accepted the latest version's problems (like a
+	// portal-created cert without SANs or an imported one without a
+	// validity), so only problems the changes add are blocking
+	latestProblems := ValidateCertificateCreateParameters(certCreateParams)
+
+	changeDescriptions, err := ApplyNewVersionChanges(&certCreateParams, changes)
+	if err != nil {
+		logger.Errorw(
+			"Can't apply changes to certificate",
+			"certName", certName,
+			"err", err,
+		)
+		return err
+	}
+
+	problems, inherited := ValidateCertificateCreateParameters(certCreateParams).Split(latestProblems)
+	if len(inherited) > 0 {
+		for _, p := range inherited {
+			fmt.Fprintln(os.Stderr, "warning: "+p.String())
+		}
+		logger.Infow(
+			"The latest version already has these problems, so they're not blocking the new version",
+			"certName", certName,
+			"problems", len(inherited),
+		)
+	}
+	if len(problems) > 0 {
+		logValidationErrors(logger, "Invalid certificate parameters for the new version", certName, problems)
+		return problems
+	}
+
 	if !skipConfirmation {
-		err := creationPrompt(vaultURL, &certCreateParams)
+		err := creationPrompt(vaultURL, &certCreateParams, &cert, changeDescriptions)
 		if err != nil {
 			logger.Errorw(
 				"Can't confirm creation",
@@ -422,17 +615,120 @@ func CertificateNewVersion(
 		"statusDetails", *result.StatusDetails,
 	)
 
+	if waitTimeout > 0 {
+		return waitForIssuedCertificate(logger, kvClient, vaultURL, timeout, certName, waitTimeout)
+	}
 	return nil
 }
 
-func creationPrompt(vaultURL string, params *keyvault.CertificateCreateParameters) error {
-	paramsJSON, err := json.MarshalIndent(
-		params, "  ", "  ",
-	)
-	paramsJSONStr := string(paramsJSON)
-	fmt.Printf("A certificate will be created in keyvault '%s' with the following parameters:\n", vaultURL)
-	fmt.Print("  ")
-	fmt.Println(paramsJSONStr)
+// copyCertificatePolicy deep copies a policy by round tripping it through
+// JSON. READ-ONLY fields like the policy ID aren't copied
+func copyCertificatePolicy(policy *keyvault.CertificatePolicy) (*keyvault.CertificatePolicy, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	j, err := json.Marshal(policy)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ret := keyvault.CertificatePolicy{}
+	err = json.Unmarshal(j, &ret)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &ret, nil
+}
+
+// comparableYAML renders the parts of a certificate that a new version can
+// change, leaving out read-only and per-version fields (ids, timestamps) so
+// they don't show up in diffs. A nil policy is left out
+func comparableYAML(policy *keyvault.CertificatePolicy, attributes *keyvault.CertificateAttributes, tags map[string]*string) (string, error) {
+	var p *keyvault.CertificatePolicy
+	if policy != nil {
+		shallow := *policy
+		shallow.Attributes = nil
+		p = &shallow
+	}
+	var enabled *bool
+	if attributes != nil {
+		enabled = attributes.Enabled
+	}
+	y, err := toYAML(struct {
+		Policy     *keyvault.CertificatePolicy `json:"policy,omitempty"`
+		Attributes struct {
+			Enabled *bool `json:"enabled"`
+		} `json:"attributes"`
+		Tags map[string]*string `json:"tags"`
+	}{
+		Policy: p,
+		Attributes: struct {
+			Enabled *bool `json:"enabled"`
+		}{enabled},
+		Tags: tags,
+	})
+	return string(y), err
+}
+
+// ParamsDiff is a unified diff of the policy, enabled attribute and tags
+// from latest to params. It's nil if nothing changed
+func ParamsDiff(latest keyvault.CertificateBundle, params *keyvault.CertificateCreateParameters) ([]string, error) {
+	latestYAML, err := comparableYAML(latest.Policy, latest.Attributes, latest.Tags)
+	if err != nil {
+		return nil, err
+	}
+	paramsYAML, err := comparableYAML(params.CertificatePolicy, params.CertificateAttributes, params.Tags)
+	if err != nil {
+		return nil, err
+	}
+	latestVersion := "latest"
+	if latest.ID != nil {
+		_, latestVersion = ParseCertificateID(*latest.ID)
+	}
+	return UnifiedDiff("latest version ("+latestVersion+")", "new version", latestYAML, paramsYAML, 3), nil
+}
+
+// creationPrompt shows what will be created and asks for confirmation. If
+// latest (the current latest version) isn't nil, it shows a diff against it
+// instead of all the parameters. changes are extra descriptions to show
+func creationPrompt(vaultURL string, params *keyvault.CertificateCreateParameters, latest *keyvault.CertificateBundle, changes []string) error {
+	if latest == nil {
+		paramsJSON, err := json.MarshalIndent(
+			params, "  ", "  ",
+		)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		paramsJSONStr := string(paramsJSON)
+		fmt.Printf("A certificate will be created in keyvault '%s' with the following parameters:\n", vaultURL)
+		fmt.Print("  ")
+		fmt.Println(paramsJSONStr)
+	} else {
+		diff, err := ParamsDiff(*latest, params)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("A new certificate version will be created in keyvault '%s'.\n", vaultURL)
+		if len(diff) == 0 {
+			fmt.Println("No changes: the new version will have the same policy, attributes and tags as the latest version.")
+		} else {
+			fmt.Println("Changes from the latest version:")
+			if useColor() {
+				diff = ColorizeDiff(diff)
+			}
+			fmt.Println(strings.Join(diff, "\n"))
+		}
+	}
+	if len(changes) > 0 {
+		fmt.Println("Requested changes:")
+		for _, c := range changes {
+			fmt.Println("  " + c)
+		}
+	}
+	return confirmPrompt()
+}
+
+// confirmPrompt asks the user to type yes
+func confirmPrompt() error {
 	fmt.Print("Type 'yes' to continue: ")
 
 	reader := bufio.NewReader(os.Stdin)
@@ -0,0 +1,374 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Output formats
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+)
+
+// ShowOutputFormats are the formats for commands that print one thing
+var ShowOutputFormats = []string{OutputTable, OutputJSON, OutputYAML}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = fmt.Fprintln(w, string(j))
+	return errors.WithStack(err)
+}
+
+// toYAML goes through JSON so the SDK's json tags and MarshalJSON methods
+// are respected. MapSlice keeps the JSON key order
+func toYAML(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ms := yaml.MapSlice{}
+	err = yaml.Unmarshal(j, &ms)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	y, err := yaml.Marshal(ms)
+	return y, errors.WithStack(err)
+}
+
+func writeYAML(w io.Writer, v interface{}) error {
+	y, err := toYAML(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(y)
+	return errors.WithStack(err)
+}
+
+// WriteData writes v as OutputJSON or OutputYAML
+func WriteData(w io.Writer, v interface{}, format string) error {
+	switch format {
+	case OutputJSON:
+		return writeJSON(w, v)
+	case OutputYAML:
+		return writeYAML(w, v)
+	}
+	return errors.Errorf("unknown output format: %#v", format)
+}
+
+// More output formats, for commands that print lists
+const (
+	OutputJSONL = "jsonl"
+	OutputCSV   = "csv"
+)
+
+// ListOutputFormats are the formats for commands that print lists
+var ListOutputFormats = []string{OutputTable, OutputJSON, OutputJSONL, OutputCSV, OutputYAML}
+
+// ParseFields splits a comma separated --fields value like
+// "id,tags.owner,attributes.expires". Blank means nil (the defaults)
+func ParseFields(fields string) []string {
+	var ret []string
+	for _, f := range strings.Split(fields, ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// toGeneric round trips v through JSON so fields can be looked up by their
+// JSON keys
+func toGeneric(v interface{}) (interface{}, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var ret interface{}
+	err = json.Unmarshal(j, &ret)
+	return ret, errors.WithStack(err)
+}
+
+// lookupField finds a dotted path like "tags.owner" in a toGeneric value.
+// Keys containing dots (like some tag names) are found by trying the whole
+// remaining path as a key first
+func lookupField(v interface{}, path string) (interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if val, exists := m[path]; exists {
+		return val, true
+	}
+	parts := strings.SplitN(path, ".", 2)
+	val, exists := m[parts[0]]
+	if !exists || len(parts) == 1 {
+		return val, exists
+	}
+	return lookupField(val, parts[1])
+}
+
+// formatCell formats a toGeneric value for table and csv output. Maps become
+// sorted key=value pairs joined with ';'
+func formatCell(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			pairs = append(pairs, k+"="+formatCell(t[k]))
+		}
+		return strings.Join(pairs, ";")
+	case []interface{}:
+		items := make([]string, 0, len(t))
+		for _, i := range t {
+			items = append(items, formatCell(i))
+		}
+		return strings.Join(items, ";")
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// selectedFields is an ordered field -> value object
+type selectedFields []selectedField
+
+type selectedField struct {
+	Key   string
+	Value interface{}
+}
+
+// MarshalJSON keeps fields in the order they were asked for
+func (sf selectedFields) MarshalJSON() ([]byte, error) {
+	buf := bytes.Buffer{}
+	buf.WriteString("{")
+	for i, f := range sf {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		k, err := json.Marshal(f.Key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		buf.Write(k)
+		buf.WriteString(":")
+		buf.Write(v)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+// ListWriter writes items one at a time, so lists can be printed while
+// they're paged in. Close must be called to finish the output
+type ListWriter interface {
+	Write(item interface{}) error
+	Close() error
+}
+
+type listWriter struct {
+	w       io.Writer
+	format  string
+	fields  []string
+	count   int
+	csv     *csv.Writer
+	table   *tabwriter.Writer
+	checked bool
+}
+
+// NewListWriter writes items to w in one of ListOutputFormats. Items are
+// selected by their JSON keys, so fields (see ParseFields) work for any
+// item type. table and csv use defaultFields if fields is empty
+func NewListWriter(w io.Writer, format string, fields []string, defaultFields []string) (ListWriter, error) {
+	lw := &listWriter{w: w, format: format, fields: fields}
+	switch format {
+	case OutputTable:
+		lw.table = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	case OutputCSV:
+		lw.csv = csv.NewWriter(w)
+	case OutputJSON, OutputJSONL, OutputYAML:
+	default:
+		return nil, errors.Errorf("unknown output format: %#v", format)
+	}
+	if (format == OutputTable || format == OutputCSV) && len(fields) == 0 {
+		lw.fields = defaultFields
+	}
+	return lw, nil
+}
+
+func (lw *listWriter) writeHeader() error {
+	switch lw.format {
+	case OutputTable:
+		header := make([]string, 0, len(lw.fields))
+		for _, f := range lw.fields {
+			header = append(header, strings.ToUpper(f))
+		}
+		_, err := fmt.Fprintln(lw.table, strings.Join(header, "\t"))
+		return errors.WithStack(err)
+	case OutputCSV:
+		return errors.WithStack(lw.csv.Write(lw.fields))
+	case OutputJSON:
+		_, err := fmt.Fprint(lw.w, "[\n  ")
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// selectFields picks lw.fields out of item. The first item is used to
+// check every field's top level key exists, to catch typos
+func (lw *listWriter) selectFields(item interface{}) (selectedFields, error) {
+	generic, err := toGeneric(item)
+	if err != nil {
+		return nil, err
+	}
+	if !lw.checked {
+		for _, f := range lw.fields {
+			top := strings.SplitN(f, ".", 2)[0]
+			if _, exists := lookupField(generic, top); !exists {
+				return nil, errors.Errorf("unknown field: %#v", f)
+			}
+		}
+		lw.checked = true
+	}
+	selected := make(selectedFields, 0, len(lw.fields))
+	for _, f := range lw.fields {
+		v, _ := lookupField(generic, f)
+		selected = append(selected, selectedField{Key: f, Value: v})
+	}
+	return selected, nil
+}
+
+func (lw *listWriter) Write(item interface{}) error {
+	if lw.count == 0 {
+		err := lw.writeHeader()
+		if err != nil {
+			return err
+		}
+	}
+	lw.count++
+
+	var v interface{} = item
+	if len(lw.fields) > 0 {
+		selected, err := lw.selectFields(item)
+		if err != nil {
+			return err
+		}
+		v = selected
+	}
+
+	switch lw.format {
+	case OutputTable, OutputCSV:
+		row := make([]string, 0, len(lw.fields))
+		for _, f := range v.(selectedFields) {
+			row = append(row, formatCell(f.Value))
+		}
+		if lw.format == OutputCSV {
+			return errors.WithStack(lw.csv.Write(row))
+		}
+		_, err := fmt.Fprintln(lw.table, strings.Join(row, "\t"))
+		return errors.WithStack(err)
+	case OutputJSONL:
+		j, err := json.Marshal(v)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = fmt.Fprintln(lw.w, string(j))
+		return errors.WithStack(err)
+	case OutputJSON:
+		j, err := json.MarshalIndent(v, "  ", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if lw.count > 1 {
+			_, err = fmt.Fprint(lw.w, ",\n  ")
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		_, err = lw.w.Write(j)
+		return errors.WithStack(err)
+	case OutputYAML:
+		// indent each item into a YAML list by hand so items can be streamed
+		y, err := toYAML(v)
+		if err != nil {
+			return err
+		}
+		lines := splitLines(string(y))
+		for i, l := range lines {
+			if i == 0 {
+				lines[i] = "- " + l
+			} else {
+				lines[i] = "  " + l
+			}
+		}
+		_, err = fmt.Fprintln(lw.w, strings.Join(lines, "\n"))
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (lw *listWriter) Close() error {
+	switch lw.format {
+	case OutputTable:
+		if lw.count == 0 {
+			err := lw.writeHeader()
+			if err != nil {
+				return err
+			}
+		}
+		return errors.WithStack(lw.table.Flush())
+	case OutputCSV:
+		if lw.count == 0 {
+			err := lw.writeHeader()
+			if err != nil {
+				return err
+			}
+		}
+		lw.csv.Flush()
+		return errors.WithStack(lw.csv.Error())
+	case OutputJSON:
+		var err error
+		if lw.count == 0 {
+			_, err = fmt.Fprintln(lw.w, "[]")
+		} else {
+			_, err = fmt.Fprint(lw.w, "\n]\n")
+		}
+		return errors.WithStack(err)
+	case OutputYAML:
+		if lw.count == 0 {
+			_, err := fmt.Fprintln(lw.w, "[]")
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
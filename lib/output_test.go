@@ -0,0 +1,154 @@
+package lib
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type testListItem struct {
+	Name    string            `json:"name"`
+	Enabled bool              `json:"enabled"`
+	Tags    map[string]string `json:"tags"`
+}
+
+var testListItems = []testListItem{
+	{Name: "a", Enabled: true, Tags: map[string]string{"owner": "x", "app.kubernetes.io/name": "y"}},
+	{Name: "bb", Enabled: false},
+}
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   []string
+	}{
+		{"", nil},
+		{" , ", nil},
+		{"name", []string{"name"}},
+		{"name, tags.owner ,,enabled", []string{"name", "tags.owner", "enabled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fields, func(t *testing.T) {
+			if got := ParseFields(tt.fields); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFields(%#v) = %#v, want %#v", tt.fields, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		fields []string
+		items  []testListItem
+		want   string
+	}{
+		{
+			name:   "table defaults",
+			format: OutputTable,
+			items:  testListItems,
+			want:   "NAME  ENABLED\na     true\nbb    false\n",
+		},
+		{
+			name:   "table nested and dotted fields",
+			format: OutputTable,
+			fields: []string{"name", "tags.owner", "tags.app.kubernetes.io/name"},
+			items:  testListItems,
+			want:   "NAME  TAGS.OWNER  TAGS.APP.KUBERNETES.IO/NAME\na     x           y\nbb                \n",
+		},
+		{
+			name:   "table map cell",
+			format: OutputTable,
+			fields: []string{"tags"},
+			items:  testListItems[:1],
+			want:   "TAGS\napp.kubernetes.io/name=y;owner=x\n",
+		},
+		{
+			name:   "empty table has a header",
+			format: OutputTable,
+			want:   "NAME  ENABLED\n",
+		},
+		{
+			name:   "csv",
+			format: OutputCSV,
+			fields: []string{"name", "tags.owner"},
+			items:  testListItems,
+			want:   "name,tags.owner\na,x\nbb,\n",
+		},
+		{
+			name:   "jsonl",
+			format: OutputJSONL,
+			fields: []string{"name", "tags.owner"},
+			items:  testListItems,
+			want:   "{\"name\":\"a\",\"tags.owner\":\"x\"}\n{\"name\":\"bb\",\"tags.owner\":null}\n",
+		},
+		{
+			name:   "jsonl whole items",
+			format: OutputJSONL,
+			items:  testListItems[1:],
+			want:   "{\"name\":\"bb\",\"enabled\":false,\"tags\":null}\n",
+		},
+		{
+			name:   "json",
+			format: OutputJSON,
+			fields: []string{"name"},
+			items:  testListItems,
+			want:   "[\n  {\n    \"name\": \"a\"\n  },\n  {\n    \"name\": \"bb\"\n  }\n]\n",
+		},
+		{
+			name:   "empty json",
+			format: OutputJSON,
+			want:   "[]\n",
+		},
+		{
+			name:   "yaml",
+			format: OutputYAML,
+			fields: []string{"name", "enabled"},
+			items:  testListItems,
+			want:   "- name: a\n  enabled: true\n- name: bb\n  enabled: false\n",
+		},
+		{
+			name:   "empty yaml",
+			format: OutputYAML,
+			want:   "[]\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			lw, err := NewListWriter(&buf, tt.format, tt.fields, []string{"name", "enabled"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range tt.items {
+				err = lw.Write(item)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = lw.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got:\n%q\nwant:\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListWriterErrors(t *testing.T) {
+	_, err := NewListWriter(&bytes.Buffer{}, "xml", nil, nil)
+	if err == nil {
+		t.Error("unknown format should fail")
+	}
+
+	lw, err := NewListWriter(&bytes.Buffer{}, OutputJSONL, []string{"nmae"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lw.Write(testListItems[0]); err == nil {
+		t.Error("unknown field should fail")
+	}
+}
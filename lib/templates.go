@@ -0,0 +1,190 @@
+package lib
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// CfgCertificateTemplates are the config's certificate_templates. Each one
+// is a CfgCertificateCreateParameters plus an optional `extends: <name>`.
+// They're kept as parsed YAML until they're resolved so a template only
+// needs the keys it changes from the one it extends (or, for templates that
+// don't extend one, from certificate_create_parameters)
+type CfgCertificateTemplates map[string]map[string]interface{}
+
+// extendsKey names the template a template inherits from
+const extendsKey = "extends"
+
+// mergeYAML deep merges override onto base. Maps are merged key by key;
+// everything else (including lists) in override replaces what's in base
+func mergeYAML(base interface{}, override interface{}) interface{} {
+	baseMap, baseOk := toStringMap(base)
+	overrideMap, overrideOk := toStringMap(override)
+	if !baseOk || !overrideOk {
+		return override
+	}
+	merged := make(map[string]interface{}, len(baseMap))
+	for k, v := range baseMap {
+		merged[k] = v
+	}
+	for k, v := range overrideMap {
+		if existing, exists := merged[k]; exists {
+			merged[k] = mergeYAML(existing, v)
+		} else {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// toStringMap converts yaml.v2's map types to map[string]interface{}
+func toStringMap(v interface{}) (map[string]interface{}, bool) {
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return m, true
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			ret[fmtYAMLKey(k)] = v
+		}
+		return ret, true
+	}
+	return nil, false
+}
+
+func fmtYAMLKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	y, _ := yaml.Marshal(k)
+	return strings.TrimSpace(string(y))
+}
+
+// Names returns the template names, sorted
+func (t CfgCertificateTemplates) Names() []string {
+	names := make([]string, 0, len(t))
+	for name := range t {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// chain returns name followed by the templates it extends, in order
+func (t CfgCertificateTemplates) chain(name string) ([]string, error) {
+	var chain []string
+	seen := make(map[string]bool)
+	for current := name; current != ""; {
+		if seen[current] {
+			return nil, errors.Errorf("certificate template %#v extends itself: %s", name, strings.Join(append(chain, current), " -> "))
+		}
+		seen[current] = true
+		tmpl, exists := t[current]
+		if !exists {
+			if current == name {
+				return nil, errors.Errorf("no certificate template named %#v. Templates: %s", name, strings.Join(t.Names(), ", "))
+			}
+			return nil, errors.Errorf("certificate template %#v extends unknown template %#v", chain[len(chain)-1], current)
+		}
+		chain = append(chain, current)
+
+		extends, _ := tmpl[extendsKey].(string)
+		if _, exists := tmpl[extendsKey]; exists && extends == "" {
+			return nil, errors.Errorf("certificate template %#v: extends must be a template name", current)
+		}
+		current = extends
+	}
+	return chain, nil
+}
+
+// yamlErrLine matches the "line 3: " yaml.v2 starts TypeError messages with
+var yamlErrLine = regexp.MustCompile(`^line \d+: `)
+
+// Resolve merges a template with the chain of templates it extends onto
+// base (certificate_create_parameters), base first, and parses the result.
+// Unknown keys are an error, like they are everywhere else in the config
+func (t CfgCertificateTemplates) Resolve(name string, base CfgCertificateCreateParameters) (CfgCertificateCreateParameters, error) {
+	ret := CfgCertificateCreateParameters{}
+
+	chain, err := t.chain(name)
+	if err != nil {
+		return ret, err
+	}
+
+	// round trip base through YAML so it merges like the templates
+	baseYAML, err := yaml.Marshal(base)
+	if err != nil {
+		return ret, errors.WithStack(err)
+	}
+	var merged interface{}
+	err = yaml.Unmarshal(baseYAML, &merged)
+	if err != nil {
+		return ret, errors.WithStack(err)
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		tmpl := make(map[string]interface{}, len(t[chain[i]]))
+		for k, v := range t[chain[i]] {
+			if k != extendsKey {
+				tmpl[k] = v
+			}
+		}
+		merged = mergeYAML(merged, tmpl)
+	}
+
+	y, err := yaml.Marshal(merged)
+	if err != nil {
+		return ret, errors.WithStack(err)
+	}
+	err = yaml.UnmarshalStrict(y, &ret)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		// the line numbers are in the merged template, not the config, so
+		// they'd only mislead
+		msgs := make([]string, 0, len(typeErr.Errors))
+		for _, e := range typeErr.Errors {
+			msgs = append(msgs, yamlErrLine.ReplaceAllString(e, ""))
+		}
+		err = errors.New(strings.Join(msgs, "; "))
+	}
+	if err != nil {
+		return ret, errors.Wrapf(err, "certificate template %#v", name)
+	}
+	return ret, nil
+}
+
+// Validate resolves every template onto base and checks the result with
+// ValidateCertificateCreateParameters. src is the config, for line numbers.
+// A problem with an inherited key is reported on the line of the template
+// (or certificate_create_parameters) that sets it
+func (t CfgCertificateTemplates) Validate(src []byte, base CfgCertificateCreateParameters) ValidationErrors {
+	var errs ValidationErrors
+	for _, name := range t.Names() {
+		prefix := "certificate_templates." + name
+		params, err := t.Resolve(name, base)
+		if err != nil {
+			errs = append(errs, ValidationError{
+				Path:    prefix,
+				Line:    YAMLKeyLine(src, prefix),
+				Message: errors.Cause(err).Error(),
+			})
+			continue
+		}
+		chain, _ := t.chain(name)
+		for _, e := range ValidateCertificateCreateParameters(CreateKVCertCreateParamsFromCfg(params)) {
+			for _, tmpl := range chain {
+				if e.Line = YAMLKeyLine(src, "certificate_templates."+tmpl+"."+e.Path); e.Line != 0 {
+					break
+				}
+			}
+			if e.Line == 0 {
+				e.Line = YAMLKeyLine(src, "certificate_create_parameters."+e.Path)
+			}
+			e.Path = prefix + "." + e.Path
+			errs = append(errs, e)
+		}
+	}
+	return errs
+}
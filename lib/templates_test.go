@@ -0,0 +1,202 @@
+package lib
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestMergeYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		base     interface{}
+		override interface{}
+		want     interface{}
+	}{
+		{
+			name:     "maps merge",
+			base:     map[string]interface{}{"a": 1, "b": 2},
+			override: map[interface{}]interface{}{"b": 3, "c": 4},
+			want:     map[string]interface{}{"a": 1, "b": 3, "c": 4},
+		},
+		{
+			name:     "nested maps merge",
+			base:     map[string]interface{}{"m": map[string]interface{}{"a": 1, "b": 2}},
+			override: map[string]interface{}{"m": map[string]interface{}{"b": 3}},
+			want:     map[string]interface{}{"m": map[string]interface{}{"a": 1, "b": 3}},
+		},
+		{
+			name:     "lists replace",
+			base:     map[string]interface{}{"l": []interface{}{1, 2}},
+			override: map[string]interface{}{"l": []interface{}{3}},
+			want:     map[string]interface{}{"l": []interface{}{3}},
+		},
+		{
+			name:     "scalar replaces map",
+			base:     map[string]interface{}{"m": map[string]interface{}{"a": 1}},
+			override: map[string]interface{}{"m": "x"},
+			want:     map[string]interface{}{"m": "x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeYAML(tt.base, tt.override); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeYAML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+const testTemplates = `
+base:
+  certificate_attributes:
+    enabled: true
+  tags:
+    kind: base
+    team: platform
+mtls:
+  extends: base
+  certificate_policy:
+    x509_certificate_properties:
+      subject_alternative_names:
+        - mtls.example.com
+      validity_in_months: 3
+  tags:
+    kind: mtls
+client:
+  extends: mtls
+  certificate_policy:
+    key_properties:
+      key_type: EC
+      key_size: 256
+loop-a:
+  extends: loop-b
+loop-b:
+  extends: loop-a
+self:
+  extends: self
+orphan:
+  extends: missing
+blank:
+  extends: ""
+typo:
+  certificate_polcy: {}
+`
+
+func testCfgTemplates(t *testing.T) CfgCertificateTemplates {
+	t.Helper()
+	templates := CfgCertificateTemplates{}
+	err := yaml.UnmarshalStrict([]byte(testTemplates), &templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+func TestCfgCertificateTemplatesResolve(t *testing.T) {
+	templates := testCfgTemplates(t)
+	base := testCertCreateParams(t)
+
+	mtls, err := templates.Resolve("mtls", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xp := mtls.CertificatePolicy.X509CertificateProperties
+	// certificate_create_parameters, then base, then mtls
+	if !mtls.CertificateAttributes.Enabled {
+		t.Error("enabled should come from base")
+	}
+	if xp.Subject != "CN=test.example.com" {
+		t.Errorf("subject should come from certificate_create_parameters, got %#v", xp.Subject)
+	}
+	if xp.ValidityInMonths != 3 {
+		t.Errorf("validity = %d, want 3 from mtls", xp.ValidityInMonths)
+	}
+	if !reflect.DeepEqual(xp.SubjectAlternativeNames, []string{"mtls.example.com"}) {
+		t.Errorf("SANs should be replaced, not merged: %v", xp.SubjectAlternativeNames)
+	}
+	if !reflect.DeepEqual(mtls.Tags, map[string]string{"kind": "mtls", "team": "platform"}) {
+		t.Errorf("tags = %v", mtls.Tags)
+	}
+
+	client, err := templates.Resolve("client", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp := client.CertificatePolicy.KeyProperties
+	if kp.KeyType != "EC" || kp.KeySize != 256 || !kp.Exportable {
+		t.Errorf("key properties = %+v", kp)
+	}
+	if client.CertificatePolicy.X509CertificateProperties.ValidityInMonths != 3 {
+		t.Error("client should inherit mtls' validity")
+	}
+
+	// resolving doesn't change base
+	if base.Tags["kind"] != "" || base.CertificatePolicy.X509CertificateProperties.ValidityInMonths != 6 {
+		t.Errorf("base changed: %+v", base)
+	}
+}
+
+func TestCfgCertificateTemplatesResolveErrors(t *testing.T) {
+	templates := testCfgTemplates(t)
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"loop-a", "extends itself: loop-a -> loop-b -> loop-a"},
+		{"self", "extends itself: self -> self"},
+		{"orphan", `"orphan" extends unknown template "missing"`},
+		{"blank", "extends must be a template name"},
+		{"typo", "certificate_polcy"},
+		{"nope", `no certificate template named "nope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := templates.Resolve(tt.name, testCertCreateParams(t))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Resolve(%#v) err = %v, want it to contain %#v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCfgCertificateTemplatesValidate(t *testing.T) {
+	src := []byte(`certificate_create_parameters:
+  certificate_policy:
+    x509_certificate_properties:
+      validity_in_months: 0
+certificate_templates:
+  partial:
+    tags:
+      kind: partial
+  fixed:
+    certificate_policy:
+      x509_certificate_properties:
+        validity_in_months: 3
+`)
+	var cfg struct {
+		CertificateCreateParameters CfgCertificateCreateParameters `yaml:"certificate_create_parameters"`
+		CertificateTemplates        CfgCertificateTemplates        `yaml:"certificate_templates"`
+	}
+	err := yaml.Unmarshal(src, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := testCertCreateParams(t)
+	base.CertificatePolicy.X509CertificateProperties.ValidityInMonths = 0
+
+	problems := cfg.CertificateTemplates.Validate(src, base)
+	if len(problems) != 1 {
+		t.Fatalf("want 1 problem, got %v", problems)
+	}
+	p := problems[0]
+	if p.Path != "certificate_templates.partial.certificate_policy.x509_certificate_properties.validity_in_months" {
+		t.Errorf("path = %#v", p.Path)
+	}
+	// inherited from certificate_create_parameters, so reported there
+	if p.Line != 4 {
+		t.Errorf("line = %d, want 4", p.Line)
+	}
+}
@@ -0,0 +1,405 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// ValidationError is one problem with a config or certificate create
+// parameters
+type ValidationError struct {
+	// Path is a dotted config key like
+	// certificate_policy.key_properties.key_size. List items are numbered
+	// from 0. It's blank if the problem isn't with one key
+	Path string `json:"path"`
+	// Line is the config line Path is on, or 0 if it's unknown
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e ValidationError) String() string {
+	s := e.Message
+	if e.Path != "" {
+		s = e.Path + ": " + s
+	}
+	if e.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", e.Line, s)
+	}
+	return s
+}
+
+// ValidationErrors are every problem found, so they can be fixed at once
+type ValidationErrors []ValidationError
+
+// Strings returns each problem's String
+func (ve ValidationErrors) Strings() []string {
+	ret := make([]string, 0, len(ve))
+	for _, e := range ve {
+		ret = append(ret, e.String())
+	}
+	return ret
+}
+
+// logValidationErrors prints every problem (the console logger would
+// escape them onto one line), logs them to the log file, and logs msg
+func logValidationErrors(logger *logos.Logger, msg string, certName string, problems ValidationErrors) {
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+	logger.Debugw(
+		msg,
+		"certName", certName,
+		"problems", problems.Strings(),
+	)
+	logger.Errorw(
+		msg,
+		"certName", certName,
+		"problems", len(problems),
+	)
+}
+
+func (ve ValidationErrors) Error() string {
+	return strings.Join(ve.Strings(), "\n")
+}
+
+// Split separates the problems in ve that are also in existing (same path
+// and message) from the new ones
+func (ve ValidationErrors) Split(existing ValidationErrors) (ValidationErrors, ValidationErrors) {
+	seen := make(map[ValidationError]bool, len(existing))
+	for _, e := range existing {
+		seen[e] = true
+	}
+	var added, inherited ValidationErrors
+	for _, e := range ve {
+		if seen[e] {
+			inherited = append(inherited, e)
+		} else {
+			added = append(added, e)
+		}
+	}
+	return added, inherited
+}
+
+// Prefix returns ve with prefix+"." prepended to each path
+func (ve ValidationErrors) Prefix(prefix string) ValidationErrors {
+	ret := make(ValidationErrors, 0, len(ve))
+	for _, e := range ve {
+		e.Path = prefix + "." + e.Path
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// WithLines fills in missing lines from src. A key that isn't in src (like
+// a missing key_size) gets the line of its closest parent that is
+func (ve ValidationErrors) WithLines(src []byte) ValidationErrors {
+	ret := make(ValidationErrors, 0, len(ve))
+	for _, e := range ve {
+		keys := strings.Split(e.Path, ".")
+		for i := len(keys); e.Line == 0 && i > 0; i-- {
+			e.Line = YAMLKeyLine(src, strings.Join(keys[:i], "."))
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+// Key types and sizes Key Vault accepts for certificates
+var validKeySizes = map[string][]int32{
+	"RSA":     {2048, 3072, 4096},
+	"RSA-HSM": {2048, 3072, 4096},
+	"EC":      {256, 384, 521},
+	"EC-HSM":  {256, 384, 521},
+}
+
+// Key Vault's limits on certificate tags
+const (
+	MaxTags           = 15
+	MaxTagNameLength  = 512
+	MaxTagValueLength = 256
+)
+
+// IssuerMaxValidityInMonths is the longest validity an issuer allows. Self
+// signed and Unknown (manually merged) certificates can last 100 years. The
+// other issuers Key Vault integrates with are public CAs (DigiCert and
+// GlobalSign), limited to 397 days by the CA/Browser Forum
+func IssuerMaxValidityInMonths(issuerName string) int32 {
+	switch issuerName {
+	case "Self", "Unknown":
+		return 1200
+	}
+	return 13
+}
+
+var validKeyTypes = []string{"RSA", "RSA-HSM", "EC", "EC-HSM"}
+
+var validContentTypes = []string{ContentTypePKCS12, ContentTypePEM}
+
+var validActionTypes = []string{string(keyvault.AutoRenew), string(keyvault.EmailContacts)}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt32(list []int32, i int32) bool {
+	for _, l := range list {
+		if l == i {
+			return true
+		}
+	}
+	return false
+}
+
+func formatInt32s(list []int32) string {
+	strs := make([]string, 0, len(list))
+	for _, i := range list {
+		strs = append(strs, strconv.Itoa(int(i)))
+	}
+	return strings.Join(strs, ", ")
+}
+
+// ValidateCertificateCreateParameters checks params for mistakes Key Vault
+// would otherwise reject with an unhelpful 400, and returns all of them.
+// Paths use the config's key names
+func ValidateCertificateCreateParameters(params keyvault.CertificateCreateParameters) ValidationErrors {
+	var errs ValidationErrors
+	add := func(path string, format string, args ...interface{}) {
+		errs = append(errs, ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	policy := params.CertificatePolicy
+	if policy == nil {
+		add("certificate_policy", "missing")
+		return errs
+	}
+
+	// this API version has no curve; Key Vault picks it from key_size
+	if kp := policy.KeyProperties; kp == nil || kp.KeyType == nil || *kp.KeyType == "" {
+		add("certificate_policy.key_properties.key_type", "missing. Valid key types: %s", strings.Join(validKeyTypes, ", "))
+	} else if sizes, exists := validKeySizes[*kp.KeyType]; !exists {
+		add("certificate_policy.key_properties.key_type", "unknown key type %#v. Valid key types: %s", *kp.KeyType, strings.Join(validKeyTypes, ", "))
+	} else {
+		if kp.KeySize == nil || !containsInt32(sizes, *kp.KeySize) {
+			size := "missing"
+			if kp.KeySize != nil {
+				size = strconv.Itoa(int(*kp.KeySize))
+			}
+			add("certificate_policy.key_properties.key_size", "%s isn't a valid %s key size. Valid sizes: %s", size, *kp.KeyType, formatInt32s(sizes))
+		}
+		if strings.HasSuffix(*kp.KeyType, "-HSM") && kp.Exportable != nil && *kp.Exportable {
+			add("certificate_policy.key_properties.exportable", "%s keys can't leave the HSM, so they can't be exportable", *kp.KeyType)
+		}
+	}
+
+	if sp := policy.SecretProperties; sp != nil && sp.ContentType != nil && *sp.ContentType != "" && !containsString(validContentTypes, *sp.ContentType) {
+		add("certificate_policy.secret_properties.content_type", "unknown content type %#v. Valid content types: %s", *sp.ContentType, strings.Join(validContentTypes, ", "))
+	}
+
+	issuerName := ""
+	if ip := policy.IssuerParameters; ip == nil || ip.Name == nil || strings.TrimSpace(*ip.Name) == "" {
+		add("certificate_policy.issuer_parameters.name", "missing. Use Self for self-signed certificates, or the name of an issuer in the vault")
+	} else {
+		issuerName = *ip.Name
+	}
+
+	if xp := policy.X509CertificateProperties; xp == nil {
+		add("certificate_policy.x509_certificate_properties", "missing")
+	} else {
+		const xpPath = "certificate_policy.x509_certificate_properties"
+		var sans []string
+		if xp.SubjectAlternativeNames != nil && xp.SubjectAlternativeNames.DNSNames != nil {
+			sans = *xp.SubjectAlternativeNames.DNSNames
+		}
+		seen := make(map[string]bool)
+		for i, san := range sans {
+			path := fmt.Sprintf("%s.subject_alternative_names.%d", xpPath, i)
+			if err := ValidateDNSName(san); err != nil {
+				add(path, "%s", err)
+			}
+			if seen[strings.ToLower(san)] {
+				add(path, "%#v is listed more than once", san)
+			}
+			seen[strings.ToLower(san)] = true
+		}
+
+		if xp.Subject == nil || strings.TrimSpace(*xp.Subject) == "" {
+			add(xpPath+".subject", "missing")
+		} else if rdns, err := ParseDN(*xp.Subject); err != nil {
+			add(xpPath+".subject", "%#v isn't a valid RFC 4514 distinguished name: %s", *xp.Subject, err)
+		} else if cn, exists := CommonName(rdns); exists {
+			// a CN that isn't a hostname (like a client certificate's "My
+			// Service") doesn't need a SAN
+			if cn == "" {
+				add(xpPath+".subject", "CN is empty")
+			} else if ValidateDNSName(cn) == nil && !seen[strings.ToLower(cn)] {
+				add(xpPath+".subject", "CN %#v isn't in subject_alternative_names. Browsers only check SANs", cn)
+			}
+		}
+
+		if xp.ValidityInMonths == nil || *xp.ValidityInMonths < 1 {
+			add(xpPath+".validity_in_months", "must be at least 1")
+		} else if limit := IssuerMaxValidityInMonths(issuerName); *xp.ValidityInMonths > limit {
+			add(xpPath+".validity_in_months", "%d is more than issuer %s allows: %d", *xp.ValidityInMonths, issuerName, limit)
+		}
+	}
+
+	if policy.LifetimeActions != nil {
+		for i, la := range *policy.LifetimeActions {
+			path := fmt.Sprintf("certificate_policy.lifetime_actions.%d", i)
+			if la.Trigger == nil || (la.Trigger.LifetimePercentage == nil && la.Trigger.DaysBeforeExpiry == nil) {
+				add(path+".trigger", "set one of lifetime_percentage or days_before_expiry")
+			} else if la.Trigger.LifetimePercentage != nil && la.Trigger.DaysBeforeExpiry != nil {
+				add(path+".trigger", "set only one of lifetime_percentage or days_before_expiry")
+			} else if p := la.Trigger.LifetimePercentage; p != nil && (*p < 1 || *p > 99) {
+				add(path+".trigger.lifetime_percentage", "must be between 1 and 99, not %d", *p)
+			} else if d := la.Trigger.DaysBeforeExpiry; d != nil && *d < 1 {
+				add(path+".trigger.days_before_expiry", "must be at least 1, not %d", *d)
+			}
+			if la.Action == nil || !containsString(validActionTypes, string(la.Action.ActionType)) {
+				action := ""
+				if la.Action != nil {
+					action = string(la.Action.ActionType)
+				}
+				add(path+".action", "unknown action %#v. Valid actions: %s", action, strings.Join(validActionTypes, ", "))
+			}
+		}
+	}
+
+	if len(params.Tags) > MaxTags {
+		add("tags", "%d tags is more than Key Vault's limit of %d", len(params.Tags), MaxTags)
+	}
+	tagNames := make([]string, 0, len(params.Tags))
+	for k := range params.Tags {
+		tagNames = append(tagNames, k)
+	}
+	sort.Strings(tagNames)
+	for _, k := range tagNames {
+		if k == "" {
+			add("tags", "tag names can't be empty")
+		} else if len(k) > MaxTagNameLength {
+			add("tags."+k, "tag name is %d characters. Key Vault's limit is %d", len(k), MaxTagNameLength)
+		}
+		if v := params.Tags[k]; v != nil && len(*v) > MaxTagValueLength {
+			add("tags."+k, "tag value is %d characters. Key Vault's limit is %d", len(*v), MaxTagValueLength)
+		}
+	}
+
+	return errs
+}
+
+// ValidateDNSName checks name is a valid DNS SAN: letters, digits and
+// hyphens in labels of at most 63 characters, with an optional * as the
+// whole leftmost label of a name with at least two more labels
+func ValidateDNSName(name string) error {
+	if name == "" {
+		return errors.New("DNS name is empty")
+	}
+	if len(name) > 253 {
+		return errors.Errorf("%#v is longer than 253 characters", name)
+	}
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			if len(labels) < 3 {
+				return errors.Errorf("%#v: a wildcard needs at least two more labels, like *.example.com", name)
+			}
+			continue
+		}
+		if label == "" || len(label) > 63 {
+			return errors.Errorf("%#v: labels must be 1 to 63 characters", name)
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return errors.Errorf("%#v: labels can't start or end with -", name)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				if c == '*' {
+					return errors.Errorf("%#v: * can only be the whole leftmost label", name)
+				}
+				return errors.Errorf("%#v: %q isn't allowed. Use letters, digits, - and punycode (xn--) for international names", name, c)
+			}
+		}
+	}
+	return nil
+}
+
+// yamlLineKey returns the key of a trimmed "key: value" line
+func yamlLineKey(trimmed string) string {
+	i := strings.Index(trimmed, ":")
+	if i == -1 {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(trimmed[:i]), `"'`)
+}
+
+// YAMLKeyLine finds the 1-based line of a dotted key path (see
+// ValidationError) in block style YAML by following indentation. It
+// returns 0 if it can't find it, for example in flow style YAML
+func YAMLKeyLine(src []byte, path string) int {
+	lines := strings.Split(string(src), "\n")
+	parentIndent := -1
+	start := 0
+	line := 0
+	for _, key := range strings.Split(path, ".") {
+		index, err := strconv.Atoi(key)
+		isIndex := err == nil
+
+		childIndent := -1
+		found := -1
+		count := 0
+		for i := start; i < len(lines); i++ {
+			trimmed := strings.TrimLeft(lines[i], " ")
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			indent := len(lines[i]) - len(trimmed)
+			if indent <= parentIndent {
+				break
+			}
+			if childIndent == -1 {
+				childIndent = indent
+			}
+			if indent != childIndent {
+				continue
+			}
+			if isIndex {
+				if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+					if count == index {
+						found = i
+						break
+					}
+					count++
+				}
+				continue
+			}
+			if yamlLineKey(trimmed) == key {
+				found = i
+				break
+			}
+		}
+		if found == -1 {
+			return 0
+		}
+		line = found + 1
+		parentIndent = childIndent
+		start = found + 1
+		if isIndex {
+			// make the item's first key line up with the rest of its keys
+			lines[found] = strings.Replace(lines[found], "-", " ", 1)
+			start = found
+		}
+	}
+	return line
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/profiles/2019-03-01/keyvault/keyvault"
+)
+
+const testYAMLKeyLineSrc = `version: 1.0.0
+# a comment
+certificate_create_parameters:
+  certificate_policy:
+    key_properties:
+
+      key_type: RSA  # blank line above
+      "key_size": 2048
+    lifetime_actions:
+      - trigger:
+          days_before_expiry: 30
+        action: AutoRenew
+      -
+        action: EmailContacts
+  tags:
+    key_type: not the one
+certificate_templates:
+  mtls:
+    tags: {kind: mtls}
+`
+
+func TestYAMLKeyLine(t *testing.T) {
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"version", 1},
+		{"certificate_create_parameters", 3},
+		{"certificate_create_parameters.certificate_policy.key_properties", 5},
+		{"certificate_create_parameters.certificate_policy.key_properties.key_type", 7},
+		{"certificate_create_parameters.certificate_policy.key_properties.key_size", 8},
+		{"certificate_create_parameters.tags.key_type", 16},
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.0", 10},
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.0.trigger", 10},
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.0.trigger.days_before_expiry", 11},
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.0.action", 12},
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.1", 13},
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.1.action", 14},
+		{"certificate_templates.mtls.tags", 19},
+		// missing
+		{"certificate_create_parameters.certificate_policy.lifetime_actions.2", 0},
+		{"certificate_create_parameters.certificate_policy.key_properties.exportable", 0},
+		{"certificate_policy", 0},
+		// flow style isn't followed
+		{"certificate_templates.mtls.tags.kind", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := YAMLKeyLine([]byte(testYAMLKeyLineSrc), tt.path); got != tt.want {
+				t.Errorf("YAMLKeyLine(%#v) = %d, want %d", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorsWithLines(t *testing.T) {
+	errs := ValidationErrors{
+		{Path: "certificate_create_parameters.certificate_policy.key_properties.key_size"},
+		// missing keys get their closest parent's line
+		{Path: "certificate_create_parameters.certificate_policy.key_properties.exportable"},
+		{Path: "nope"},
+		{Path: "version", Line: 99},
+	}
+	want := []int{8, 5, 0, 99}
+	got := errs.WithLines([]byte(testYAMLKeyLineSrc))
+	for i, e := range got {
+		if e.Line != want[i] {
+			t.Errorf("%s: line %d, want %d", e.Path, e.Line, want[i])
+		}
+	}
+}
+
+func TestValidateDNSName(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"example.com", false},
+		{"a-b.example.com", false},
+		{"*.example.com", false},
+		{"localhost", false},
+		{"", true},
+		{"*.com", true},
+		{"*", true},
+		{"a.*.example.com", true},
+		{"a*.example.com", true},
+		{"-a.example.com", true},
+		{"a-.example.com", true},
+		{"a..example.com", true},
+		{"a_b.example.com", true},
+		{strings.Repeat("a", 64) + ".example.com", true},
+		{strings.Repeat("a.", 127) + "com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDNSName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDNSName(%#v) = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateCertificateCreateParameters(t *testing.T) {
+	tests := []struct {
+		name string
+		flag FlagCertificateCreateParameters
+		edit func(*keyvault.CertificateCreateParameters)
+		// wantPaths are the problem paths, in order
+		wantPaths []string
+	}{
+		{name: "valid"},
+		{
+			name:      "bad subject",
+			flag:      FlagCertificateCreateParameters{Subject: "example.com"},
+			wantPaths: []string{"certificate_policy.x509_certificate_properties.subject"},
+		},
+		{
+			name:      "CN not in SANs",
+			flag:      FlagCertificateCreateParameters{Subject: "CN=other.example.com"},
+			wantPaths: []string{"certificate_policy.x509_certificate_properties.subject"},
+		},
+		{
+			name: "non hostname CN doesn't need a SAN",
+			flag: FlagCertificateCreateParameters{Subject: "CN=My Service"},
+		},
+		{
+			name: "bad and repeated SANs",
+			flag: FlagCertificateCreateParameters{Sans: []string{"test.example.com", "*.com", "TEST.example.com"}},
+			wantPaths: []string{
+				"certificate_policy.x509_certificate_properties.subject_alternative_names.1",
+				"certificate_policy.x509_certificate_properties.subject_alternative_names.2",
+			},
+		},
+		{
+			name:      "validity too long for a public CA",
+			flag:      FlagCertificateCreateParameters{IssuerName: "DigiCert", ValidityInMonths: 24},
+			wantPaths: []string{"certificate_policy.x509_certificate_properties.validity_in_months"},
+		},
+		{
+			name: "long validity for Self",
+			flag: FlagCertificateCreateParameters{ValidityInMonths: 120},
+		},
+		{
+			name: "missing validity",
+			edit: func(p *keyvault.CertificateCreateParameters) {
+				p.CertificatePolicy.X509CertificateProperties.ValidityInMonths = nil
+			},
+			wantPaths: []string{"certificate_policy.x509_certificate_properties.validity_in_months"},
+		},
+		{
+			name:      "RSA size",
+			flag:      FlagCertificateCreateParameters{KeySize: 1024},
+			wantPaths: []string{"certificate_policy.key_properties.key_size"},
+		},
+		{
+			name: "EC size",
+			flag: FlagCertificateCreateParameters{KeyType: "EC", KeySize: 384},
+		},
+		{
+			name:      "exportable HSM key",
+			flag:      FlagCertificateCreateParameters{KeyType: "EC-HSM", KeySize: 256},
+			wantPaths: []string{"certificate_policy.key_properties.exportable"},
+		},
+		{
+			name:      "unknown key type",
+			flag:      FlagCertificateCreateParameters{KeyType: "DSA"},
+			wantPaths: []string{"certificate_policy.key_properties.key_type"},
+		},
+		{
+			name:      "unknown content type",
+			flag:      FlagCertificateCreateParameters{ContentType: "text/plain"},
+			wantPaths: []string{"certificate_policy.secret_properties.content_type"},
+		},
+		{
+			name: "bad lifetime actions",
+			edit: func(p *keyvault.CertificateCreateParameters) {
+				pct, days := int32(100), int32(30)
+				*p.CertificatePolicy.LifetimeActions = []keyvault.LifetimeAction{
+					{Trigger: &keyvault.Trigger{LifetimePercentage: &pct}, Action: &keyvault.Action{ActionType: keyvault.AutoRenew}},
+					{Trigger: &keyvault.Trigger{DaysBeforeExpiry: &days}, Action: &keyvault.Action{ActionType: "Nothing"}},
+				}
+			},
+			wantPaths: []string{
+				"certificate_policy.lifetime_actions.0.trigger.lifetime_percentage",
+				"certificate_policy.lifetime_actions.1.action",
+			},
+		},
+		{
+			name: "too many and too long tags",
+			edit: func(p *keyvault.CertificateCreateParameters) {
+				p.Tags = map[string]*string{"long": strPtr(strings.Repeat("v", MaxTagValueLength+1))}
+				for i := 0; i < MaxTags; i++ {
+					p.Tags[string(rune('a'+i))] = strPtr("")
+				}
+			},
+			wantPaths: []string{"tags", "tags.long"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := BuildCertificateCreateParameters(testCertCreateParams(t), tt.flag)
+			if tt.edit != nil {
+				tt.edit(&params)
+			}
+			var paths []string
+			for _, p := range ValidateCertificateCreateParameters(params) {
+				paths = append(paths, p.Path)
+			}
+			if strings.Join(paths, "\n") != strings.Join(tt.wantPaths, "\n") {
+				t.Errorf("problems at %v, want %v", paths, tt.wantPaths)
+			}
+		})
+	}
+}
+
+func TestValidationErrorsSplit(t *testing.T) {
+	existing := ValidationErrors{
+		{Path: "a", Message: "old"},
+		{Path: "b", Message: "gone"},
+	}
+	ve := ValidationErrors{
+		{Path: "a", Message: "old"},
+		{Path: "a", Message: "different"},
+		{Path: "c", Message: "new"},
+	}
+	added, inherited := ve.Split(existing)
+	if len(inherited) != 1 || inherited[0].Message != "old" {
+		t.Errorf("inherited = %v", inherited)
+	}
+	if len(added) != 2 || added[0].Message != "different" || added[1].Message != "new" {
+		t.Errorf("added = %v", added)
+	}
+}
@@ -0,0 +1,289 @@
+package lib
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bbkane/logos"
+	"github.com/pkg/errors"
+)
+
+// DefaultVaultDNSSuffix is the Key Vault DNS suffix for the Azure public cloud.
+// Others include vault.usgovcloudapi.net and vault.azure.cn
+const DefaultVaultDNSSuffix = "vault.azure.net"
+
+// BuildVaultURL returns vaultURL if it's not blank, otherwise
+// https://<vaultName>.<dnsSuffix>
+func BuildVaultURL(vaultURL string, vaultName string, dnsSuffix string) (*url.URL, error) {
+	if vaultURL == "" {
+		if vaultName == "" {
+			return nil, errors.New("no vault name or vault URL passed")
+		}
+		if dnsSuffix == "" {
+			dnsSuffix = DefaultVaultDNSSuffix
+		}
+		vaultURL = "https://" + vaultName + "." + strings.TrimPrefix(dnsSuffix, ".")
+	}
+	u, err := url.Parse(strings.TrimSuffix(vaultURL, "/"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.Errorf("vault URL scheme must be https or http: %#v", vaultURL)
+	}
+	if u.Host == "" {
+		return nil, errors.Errorf("vault URL has no host: %#v", vaultURL)
+	}
+	return u, nil
+}
+
+// VaultResource returns the resource to request tokens for: the vault URL's
+// host without the vault name, like https://vault.usgovcloudapi.net. The
+// URL wins over dnsSuffix, so --vault-url works for any cloud. Hosts
+// without a DNS suffix (IPs and names like localhost) use dnsSuffix, or the
+// host if it's blank
+func VaultResource(vaultURL *url.URL, dnsSuffix string) string {
+	host := vaultURL.Hostname()
+	if i := strings.Index(host, "."); i != -1 && net.ParseIP(host) == nil {
+		return "https://" + host[i+1:]
+	}
+	if dnsSuffix == "" {
+		dnsSuffix = host
+	}
+	return "https://" + strings.TrimPrefix(dnsSuffix, ".")
+}
+
+// NewTLSConfig trusts the system CAs plus any CAs in the PEM file at
+// caBundlePath (if not blank). Useful for Azure Stack and local emulators.
+func NewTLSConfig(caBundlePath string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caBundlePath == "" {
+		return tlsConfig, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	caBundle, err := ioutil.ReadFile(caBundlePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, errors.Errorf("no PEM certificates found in CA bundle: %#v", caBundlePath)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
+
+// CheckVaultConnection makes sure we can connect to (and, for https, TLS
+// handshake with) the vault so we can fail fast with a clear error
+func CheckVaultConnection(vaultURL *url.URL, tlsConfig *tls.Config, timeout time.Duration) error {
+	port := vaultURL.Port()
+	if port == "" {
+		port = "443"
+		if vaultURL.Scheme == "http" {
+			port = "80"
+		}
+	}
+	address := net.JoinHostPort(vaultURL.Hostname(), port)
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	var err error
+	if vaultURL.Scheme == "http" {
+		conn, err = dialer.Dial("tcp", address)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(conn.Close())
+}
+
+// CfgVault is one entry in the config's vaults map, keyed by an alias like
+// dev-wus2. Set Name or URL (URL wins)
+type CfgVault struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// AuthMode overrides the auth section's mode for this vault
+	AuthMode string `yaml:"auth_mode"`
+	// CertificateTemplate is the certificate_templates entry `certificate
+	// create` uses in this vault unless --template is passed
+	CertificateTemplate string `yaml:"certificate_template"`
+}
+
+// VaultTarget is a vault to connect to
+type VaultTarget struct {
+	// Alias is the vaults map key, or blank if the vault wasn't from there
+	Alias    string
+	URL      *url.URL
+	AuthMode string
+}
+
+// ResolveAuthMode returns override (from --auth-mode), then the target's
+// AuthMode, then cfgMode (the auth section's mode), then AuthModeAuto
+func (t VaultTarget) ResolveAuthMode(override string, cfgMode string) string {
+	return firstNonEmpty(override, t.AuthMode, cfgMode, AuthModeAuto)
+}
+
+// NewVaultTarget builds a VaultTarget from a vaults map entry
+func NewVaultTarget(alias string, cfgVault CfgVault, dnsSuffix string) (VaultTarget, error) {
+	u, err := BuildVaultURL(cfgVault.URL, cfgVault.Name, dnsSuffix)
+	if err != nil {
+		return VaultTarget{}, errors.WithMessagef(err, "vault alias %#v", alias)
+	}
+	return VaultTarget{Alias: alias, URL: u, AuthMode: cfgVault.AuthMode}, nil
+}
+
+// ResolveVaultRef looks ref up in vaults, then treats it as a URL if it has
+// a scheme, and finally as a vault name
+func ResolveVaultRef(vaults map[string]CfgVault, ref string, dnsSuffix string) (VaultTarget, error) {
+	if cfgVault, exists := vaults[ref]; exists {
+		return NewVaultTarget(ref, cfgVault, dnsSuffix)
+	}
+	vaultURL, vaultName := "", ref
+	if strings.Contains(ref, "://") {
+		vaultURL, vaultName = ref, ""
+	}
+	u, err := BuildVaultURL(vaultURL, vaultName, dnsSuffix)
+	if err != nil {
+		return VaultTarget{}, err
+	}
+	return VaultTarget{URL: u}, nil
+}
+
+// AllVaultTargets returns every vault in vaults, sorted by alias
+func AllVaultTargets(vaults map[string]CfgVault, dnsSuffix string) ([]VaultTarget, error) {
+	if len(vaults) == 0 {
+		return nil, errors.New("no vaults in the config's vaults section")
+	}
+	aliases := make([]string, 0, len(vaults))
+	for alias := range vaults {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+	var targets []VaultTarget
+	for _, alias := range aliases {
+		t, err := NewVaultTarget(alias, vaults[alias], dnsSuffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// Vault is a vault and a client authorized for it
+type Vault struct {
+	Alias  string
+	URL    string
+	Client KeyVaultClient
+}
+
+// Label is how a vault is shown in output: its alias, or its URL if it
+// doesn't have one
+func (v Vault) Label() string {
+	if v.Alias != "" {
+		return v.Alias
+	}
+	return v.URL
+}
+
+// VaultError is a target ConnectVaults couldn't connect to. Its Client is
+// nil
+type VaultError struct {
+	Vault
+	Err error
+}
+
+// ConnectVaults checks each target is reachable and builds a client for it.
+// Targets with the same URL are only connected once. authModeOverride (from
+// --auth-mode) beats a target's AuthMode, which beats cfgAuth.Mode.
+// Authorizers are shared between targets with the same mode and resource.
+// A target that can't be connected to is logged and returned in failed so
+// one vault being down doesn't stop the rest. It's only an error if no
+// target connects
+func ConnectVaults(
+	logger *logos.Logger,
+	targets []VaultTarget,
+	cfgAuth CfgAuth,
+	authModeOverride string,
+	dnsSuffix string,
+	tlsConfig *tls.Config,
+	timeout time.Duration,
+) (vaults []Vault, failed []VaultError, err error) {
+	clients := make(map[string]KeyVaultClient)
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		vaultURL := t.URL.String()
+		if seen[vaultURL] {
+			continue
+		}
+		seen[vaultURL] = true
+
+		client, err := connectVault(logger, t, clients, cfgAuth, authModeOverride, dnsSuffix, tlsConfig, timeout)
+		vault := Vault{Alias: t.Alias, URL: vaultURL, Client: client}
+		if err != nil {
+			logger.Errorw(
+				"can't connect to vault. Skipping it",
+				"vaultAlias", t.Alias,
+				"vaultURL", vaultURL,
+				"timeout", timeout,
+				"err", err,
+			)
+			failed = append(failed, VaultError{Vault: vault, Err: err})
+			continue
+		}
+		vaults = append(vaults, vault)
+	}
+	if len(vaults) == 0 {
+		if len(failed) == 1 {
+			return nil, failed, failed[0].Err
+		}
+		return nil, failed, errors.Errorf("can't connect to any of %d vaults", len(failed))
+	}
+	return vaults, failed, nil
+}
+
+// connectVault checks t is reachable and returns a client for it, reusing
+// one from clients if there's one for the same auth mode and resource
+func connectVault(
+	logger *logos.Logger,
+	t VaultTarget,
+	clients map[string]KeyVaultClient,
+	cfgAuth CfgAuth,
+	authModeOverride string,
+	dnsSuffix string,
+	tlsConfig *tls.Config,
+	timeout time.Duration,
+) (KeyVaultClient, error) {
+	// Quick test to make sure we can connect
+	err := CheckVaultConnection(t.URL, tlsConfig, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	authMode := t.ResolveAuthMode(authModeOverride, cfgAuth.Mode)
+	resource := VaultResource(t.URL, dnsSuffix)
+	key := authMode + " " + resource
+	if client, exists := clients[key]; exists {
+		return client, nil
+	}
+	authorizer, _, err := NewAuthorizer(logger, cfgAuth, authMode, resource, timeout)
+	if err != nil {
+		return nil, err
+	}
+	client, err := PrepareKV(logger, authorizer, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	clients[key] = client
+	return client, nil
+}
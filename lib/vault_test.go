@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestConnectVaults(t *testing.T) {
+	good := newTestVault(t, 0)
+	good.createTestCertificate(t, "up")
+
+	// a listener that's closed, so connecting is refused
+	bad := httptest.NewTLSServer(http.NotFoundHandler())
+	badURL, err := url.Parse(bad.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Close()
+
+	goodURL, err := url.Parse(good.vaultURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// trusts the httptest CA
+	tlsConfig := good.tlsConfig
+	targets := []VaultTarget{
+		{Alias: "bad", URL: badURL},
+		{Alias: "good", URL: goodURL},
+		// duplicates are only connected once
+		{Alias: "good-again", URL: goodURL},
+	}
+
+	vaults, failed, err := ConnectVaults(good.logger, targets, CfgAuth{}, AuthModeNone, "", tlsConfig, testTimeout)
+	if err != nil {
+		t.Fatalf("one vault connecting isn't an error: %+v", err)
+	}
+	if len(vaults) != 1 || vaults[0].Alias != "good" || vaults[0].Client == nil {
+		t.Errorf("vaults = %+v, want just good", vaults)
+	}
+	if len(failed) != 1 || failed[0].Alias != "bad" || failed[0].Err == nil {
+		t.Errorf("failed = %+v, want just bad", failed)
+	}
+
+	// the exporter keeps going and reports the bad vault
+	e := NewExporter(good.logger, vaults, failed, nil, testTimeout)
+	if e.Scrape() {
+		t.Error("Scrape should report the bad vault failed")
+	}
+	buf := bytes.Buffer{}
+	e.WriteMetrics(&buf)
+	for _, want := range []string{
+		`kvcrutch_certificate_enabled{vault="good",name="up"} 1`,
+		`kvcrutch_scrape_success{vault="bad"} 0`,
+		`kvcrutch_scrape_success{vault="good"} 1`,
+		`kvcrutch_scrape_errors_total{vault="bad"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("metrics missing %s:\n%s", want, buf.String())
+		}
+	}
+
+	_, failed, err = ConnectVaults(good.logger, targets[:1], CfgAuth{}, AuthModeNone, "", tlsConfig, testTimeout)
+	if err == nil || len(failed) != 1 {
+		t.Errorf("no vault connecting should fail: err = %v, failed = %v", err, failed)
+	}
+	otherBadURL, err := url.Parse(bad.URL + "/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	twoBad := []VaultTarget{targets[0], {Alias: "other-bad", URL: otherBadURL}}
+	_, _, err = ConnectVaults(good.logger, twoBad, CfgAuth{}, AuthModeNone, "", tlsConfig, testTimeout)
+	if err == nil || !strings.Contains(err.Error(), "any of 2 vaults") {
+		t.Errorf("err = %v, want it to count the vaults", err)
+	}
+}
+
+func TestVaultResource(t *testing.T) {
+	tests := []struct {
+		vaultURL  string
+		dnsSuffix string
+		want      string
+	}{
+		{"https://kv.vault.azure.net", "", "https://vault.azure.net"},
+		{"https://kv.vault.usgovcloudapi.net", "", "https://vault.usgovcloudapi.net"},
+		{"https://kv.vault.azure.cn", "", "https://vault.azure.cn"},
+		{"https://kv.vault.local.azurestack.external:443", "", "https://vault.local.azurestack.external"},
+		// the URL beats a configured suffix
+		{"https://kv.vault.usgovcloudapi.net", "vault.azure.net", "https://vault.usgovcloudapi.net"},
+		{"https://kv.vault.azure.cn/", DefaultVaultDNSSuffix, "https://vault.azure.cn"},
+		// no suffix in the URL
+		{"https://127.0.0.1:8443", "vault.azure.net", "https://vault.azure.net"},
+		{"https://127.0.0.1:8443", "", "https://127.0.0.1"},
+		{"http://localhost:8080", ".vault.azure.net", "https://vault.azure.net"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.vaultURL+" "+tt.dnsSuffix, func(t *testing.T) {
+			u, err := url.Parse(tt.vaultURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := VaultResource(u, tt.dnsSuffix); got != tt.want {
+				t.Errorf("VaultResource(%#v, %#v) = %#v, want %#v", tt.vaultURL, tt.dnsSuffix, got, tt.want)
+			}
+		})
+	}
+}
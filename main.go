@@ -1,13 +1,14 @@
 package main
 
 import (
-	"crypto/tls"
 	_ "embed"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bbkane/glib"
@@ -31,23 +32,51 @@ var builtBy = "devBuiltBy"
 //go:embed embedded/kvcrutch.yaml
 var embeddedConfig []byte
 
+// embeddedConfigPath stands in for the config path when embeddedConfig is
+// used
+const embeddedConfigPath = "(embedded defaults)"
+
 type config struct {
 	Version                     string
 	LumberjackLogger            *lumberjack.Logger                      `yaml:"lumberjacklogger"`
 	VaultName                   string                                  `yaml:"vault_name"`
+	VaultDNSSuffix              string                                  `yaml:"vault_dns_suffix"`
+	VaultURL                    string                                  `yaml:"vault_url"`
+	CABundlePath                string                                  `yaml:"ca_bundle_path"`
+	Vaults                      map[string]kvcrutch.CfgVault            `yaml:"vaults"`
+	DefaultVault                string                                  `yaml:"default_vault"`
+	Auth                        kvcrutch.CfgAuth                        `yaml:"auth"`
+	Exporter                    kvcrutch.CfgExporter                    `yaml:"exporter"`
 	CertificateCreateParameters kvcrutch.CfgCertificateCreateParameters `yaml:"certificate_create_parameters"`
+	CertificateTemplates        kvcrutch.CfgCertificateTemplates        `yaml:"certificate_templates"`
 }
 
-func parseConfig(configBytes []byte) (*lumberjack.Logger, string, kvcrutch.CfgCertificateCreateParameters, error) {
+// parseConfig parses configBytes, applies envOverrides on top, and
+// expands ~ in paths
+func parseConfig(configBytes []byte, envOverrides []kvcrutch.EnvOverride) (*config, error) {
 
 	cfg := config{}
 	err := yaml.UnmarshalStrict(configBytes, &cfg)
 	if err != nil {
 		// not ok to get invalid YAML
-		return nil, "", kvcrutch.CfgCertificateCreateParameters{}, errors.WithStack(err)
+		return nil, errors.WithStack(err)
 	}
 
-	var lumberjackLogger *lumberjack.Logger = nil
+	if len(envOverrides) > 0 {
+		// parse the file first so its errors have the right line numbers
+		if problems := checkEnvOverrides(envOverrides); len(problems) > 0 {
+			return nil, problems
+		}
+		merged, err := kvcrutch.ApplyEnvOverrides(configBytes, envOverrides)
+		if err != nil {
+			return nil, err
+		}
+		cfg = config{}
+		err = yaml.UnmarshalStrict(merged, &cfg)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
 
 	// we can get a valid config with a nil logger
 	if cfg.LumberjackLogger != nil {
@@ -55,13 +84,283 @@ func parseConfig(configBytes []byte) (*lumberjack.Logger, string, kvcrutch.CfgCe
 		// make them
 		f, err := homedir.Expand(cfg.LumberjackLogger.Filename)
 		if err != nil {
-			return nil, "", kvcrutch.CfgCertificateCreateParameters{}, errors.WithStack(err)
+			return nil, errors.WithStack(err)
 		}
 		cfg.LumberjackLogger.Filename = f
-		lumberjackLogger = cfg.LumberjackLogger
 	}
 
-	return lumberjackLogger, cfg.VaultName, cfg.CertificateCreateParameters, nil
+	if cfg.Auth.CertificatePath != "" {
+		cfg.Auth.CertificatePath, err = homedir.Expand(cfg.Auth.CertificatePath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if cfg.CABundlePath != "" {
+		cfg.CABundlePath, err = homedir.Expand(cfg.CABundlePath)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// vaultFlags are the global --vault, --vault-name and --vault-url values.
+// kingpin also fills them from KVCRUTCH_VAULT, KVCRUTCH_VAULT_NAME and
+// KVCRUTCH_VAULT_URL, so cmdLine says which were actually passed
+type vaultFlags struct {
+	Alias   string
+	Name    string
+	URL     string
+	cmdLine map[string]bool
+}
+
+// withoutEnv drops the values that came from environment variables if any
+// vault flag (or allVaults) was passed, so every flag beats every
+// environment variable
+func (vf vaultFlags) withoutEnv(allVaults bool) vaultFlags {
+	if !allVaults && !vf.cmdLine["vault"] && !vf.cmdLine["vault-name"] && !vf.cmdLine["vault-url"] {
+		return vf
+	}
+	if !vf.cmdLine["vault"] {
+		vf.Alias = ""
+	}
+	if !vf.cmdLine["vault-name"] {
+		vf.Name = ""
+	}
+	if !vf.cmdLine["vault-url"] {
+		vf.URL = ""
+	}
+	return vf
+}
+
+// selectVaultTargets picks the vaults a command works with. The main vault
+// is the first of --vault-url, --vault-name, --vault (flags on the command
+// line first, then their environment variables), the config's
+// default_vault, and the config's vault_url or vault_name. allVaults
+// replaces it with every vault in the config's vaults section. extraRefs
+// (aliases, vault names or URLs) are added after
+func selectVaultTargets(
+	cfg *config,
+	vf vaultFlags,
+	allVaults bool,
+	extraRefs []string,
+) ([]kvcrutch.VaultTarget, error) {
+	vf = vf.withoutEnv(allVaults)
+	vaultAlias, vaultName, vaultURL := vf.Alias, vf.Name, vf.URL
+	var targets []kvcrutch.VaultTarget
+	switch {
+	case allVaults:
+		if vaultAlias != "" || vaultName != "" || vaultURL != "" {
+			return nil, errors.New("pass --all-vaults or a vault, not both")
+		}
+		all, err := kvcrutch.AllVaultTargets(cfg.Vaults, cfg.VaultDNSSuffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = all
+	case vaultURL != "" || vaultName != "":
+		// vault flags beat anything configured
+		u, err := kvcrutch.BuildVaultURL(vaultURL, vaultName, cfg.VaultDNSSuffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = []kvcrutch.VaultTarget{{URL: u}}
+	case vaultAlias != "" || cfg.DefaultVault != "":
+		alias := vaultAlias
+		if alias == "" {
+			alias = cfg.DefaultVault
+		}
+		cfgVault, exists := cfg.Vaults[alias]
+		if !exists {
+			return nil, errors.Errorf("no vault with alias %#v in the config's vaults section", alias)
+		}
+		t, err := kvcrutch.NewVaultTarget(alias, cfgVault, cfg.VaultDNSSuffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = []kvcrutch.VaultTarget{t}
+	default:
+		u, err := kvcrutch.BuildVaultURL(cfg.VaultURL, cfg.VaultName, cfg.VaultDNSSuffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = []kvcrutch.VaultTarget{{URL: u}}
+	}
+
+	for _, ref := range extraRefs {
+		t, err := kvcrutch.ResolveVaultRef(cfg.Vaults, ref, cfg.VaultDNSSuffix)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// withFailedVaults returns err, or if it's nil, an error naming the vaults
+// ConnectVaults skipped, so a command that read the other vaults still
+// exits non-zero
+func withFailedVaults(logger *logos.Logger, err error, failed []kvcrutch.VaultError) error {
+	if err != nil || len(failed) == 0 {
+		return err
+	}
+	labels := make([]string, 0, len(failed))
+	for _, f := range failed {
+		labels = append(labels, f.Label())
+	}
+	err = errors.Errorf("couldn't connect to %d vaults: %s", len(failed), strings.Join(labels, ", "))
+	logger.Errorw(
+		"Some vaults were skipped",
+		"err", err,
+	)
+	return err
+}
+
+// buildCertificateFilter turns `certificate list` filter flags into a
+// CertificateFilter
+func buildCertificateFilter(
+	tagFlags []string,
+	nameGlob string,
+	enabled bool,
+	disabled bool,
+	expiresWithin string,
+	expired bool,
+) (kvcrutch.CertificateFilter, error) {
+	filter := kvcrutch.CertificateFilter{
+		NameGlob: nameGlob,
+		Expired:  expired,
+	}
+	tags, err := kvcrutch.ParseTagFilters(tagFlags)
+	if err != nil {
+		return filter, err
+	}
+	filter.Tags = tags
+
+	if enabled && disabled {
+		return filter, errors.New("pass only one of --enabled and --disabled")
+	}
+	if enabled || disabled {
+		filter.Enabled = &enabled
+	}
+
+	if expiresWithin != "" {
+		filter.ExpiresWithin, err = kvcrutch.ParseDuration(expiresWithin)
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// parseWaitTimeout parses --wait-timeout. It's 0 (don't wait) without --wait
+func parseWaitTimeout(wait bool, waitTimeout string) (time.Duration, error) {
+	if !wait {
+		return 0, nil
+	}
+	d, err := kvcrutch.ParseDuration(waitTimeout)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("--wait-timeout must be positive: %#v", waitTimeout)
+	}
+	return d, nil
+}
+
+// importTargets turns `certificate import` --name and --file, or --dir, into
+// the files to import
+func importTargets(name string, file string, dir string) ([]kvcrutch.ImportTarget, error) {
+	if dir != "" {
+		if name != "" || file != "" {
+			return nil, errors.New("pass either --dir or --name and --file, not both")
+		}
+		return kvcrutch.ImportTargetsFromDir(dir)
+	}
+	if name == "" || file == "" {
+		return nil, errors.New("pass --name and --file, or --dir")
+	}
+	err := kvcrutch.ValidateCertificateName(name)
+	if err != nil {
+		return nil, err
+	}
+	return []kvcrutch.ImportTarget{{Name: name, Path: file}}, nil
+}
+
+// passwordFromEnv reads a password from the environment variable name, so it
+// doesn't end up in shell history. A blank name means no password
+func passwordFromEnv(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	password, exists := os.LookupEnv(name)
+	if !exists || password == "" {
+		return "", errors.Errorf("environment variable %s is empty or not set", name)
+	}
+	return password, nil
+}
+
+// globalFlagEnvars are the environment variables global flags read, so
+// they aren't mistaken for config keys
+func globalFlagEnvars(app *kingpin.Application) []string {
+	var envars []string
+	for _, flag := range app.Model().Flags {
+		if flag.Envar != "" {
+			envars = append(envars, flag.Envar)
+		}
+	}
+	return envars
+}
+
+// cmdLineFlags are the names of the flags in args. kingpin sets a flag from
+// its Envar too, so this tells the two apart
+func cmdLineFlags(app *kingpin.Application, args []string) (map[string]bool, error) {
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	passed := make(map[string]bool)
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			passed[flag.Model().Name] = true
+		}
+	}
+	return passed, nil
+}
+
+// optionalBool is a --name/--no-name flag that stays nil unless one is
+// passed, so "not passed" can fall back to the config
+type optionalBool struct {
+	value *bool
+}
+
+func (b *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	b.value = &v
+	return nil
+}
+
+func (b *optionalBool) String() string {
+	if b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b.value)
+}
+
+// IsBoolFlag makes kingpin add the --no-name flag and not expect a value
+func (b *optionalBool) IsBoolFlag() bool {
+	return true
+}
+
+// optionalBoolFlag registers an optionalBool on flag
+func optionalBoolFlag(flag *kingpin.FlagClause) *optionalBool {
+	b := &optionalBool{}
+	flag.SetValue(b)
+	return b
 }
 
 // downloadTextFile downloads a url to a filePath
@@ -109,9 +408,13 @@ func run() error {
 	app := kingpin.New("kvcrutch", "Augment `az keyvault`. See https://github.com/bbkane/kvcrutch for example usage").UsageTemplate(kingpin.DefaultUsageTemplate)
 	app.HelpFlag.Short('h')
 	defaultConfigPath := "~/.config/kvcrutch.yaml"
-	appConfigPathFlag := app.Flag("config-path", "Config filepath. Example: ./kvcrutch.yaml").Short('c').Default(defaultConfigPath).String()
-	appVaultNameFlag := app.Flag("vault-name", "Key Vault Name. Example: my-keyvault").Short('v').String()
-	appTimeout := app.Flag("timeout", "Limit keyvault operations when this expires. See https://golang.org/pkg/time/#ParseDuration for formatting details. Example: 1m").Default("30s").String()
+	appConfigPathFlag := app.Flag("config-path", "Config filepath. If it's the default and doesn't exist, the embedded defaults are used. Example: ./kvcrutch.yaml").Short('c').Envar(kvcrutch.EnvPrefix + "CONFIG_PATH").Default(defaultConfigPath).String()
+	appVaultFlag := app.Flag("vault", "Vault alias from the config's vaults section. Overrides default_vault. Example: dev-wus2").Envar(kvcrutch.EnvPrefix + "VAULT").String()
+	appVaultNameFlag := app.Flag("vault-name", "Key Vault Name. Overrides --vault. Example: my-keyvault").Short('v').Envar(kvcrutch.EnvPrefix + "VAULT_NAME").String()
+	appVaultURLFlag := app.Flag("vault-url", "Key Vault URL. Overrides --vault-name and --vault. Example: https://my-keyvault.vault.usgovcloudapi.net").Envar(kvcrutch.EnvPrefix + "VAULT_URL").String()
+	appCABundleFlag := app.Flag("ca-bundle", "PEM file of extra CA certificates to trust when connecting to the vault. Example: ./fake-server.pem").Envar(kvcrutch.EnvPrefix + "CA_BUNDLE").String()
+	appAuthModeFlag := app.Flag("auth-mode", "How to authenticate. Overrides the config's auth.mode. auto tries client-secret, client-certificate, cli, then managed-identity").Envar(kvcrutch.EnvPrefix + "AUTH_MODE").Enum(kvcrutch.AuthModes...)
+	appTimeout := app.Flag("timeout", "Limit keyvault operations when this expires. See https://golang.org/pkg/time/#ParseDuration for formatting details. Example: 1m").Envar(kvcrutch.EnvPrefix + "TIMEOUT").Default("30s").String()
 
 	configCmd := app.Command("config", "Config commands")
 	configCmdEditCmd := configCmd.Command("edit", "Edit or create configuration file. Uses $EDITOR as a fallback")
@@ -120,6 +423,12 @@ func run() error {
 	configCmdDownloadCmd := configCmd.Command("download", "Download config from a URL. Will not overwrite existing config")
 	configCmdDownloadCmdUrlFlag := configCmdDownloadCmd.Flag("url", "Example: https://example.com/kvcrutch.yaml").Required().String()
 
+	configCmdValidateCmd := configCmd.Command("validate", "Check the config for every problem kvcrutch can find without connecting to a vault, with line numbers")
+
+	configCmdShowCmd := configCmd.Command("show", "Print the config as parsed, with unset keys zeroed")
+	configCmdShowCmdEffectiveFlag := configCmdShowCmd.Flag("effective", "Print what commands use after merging the config file, environment and flags, including the exact certificate create parameters sent without create flags").Bool()
+	configCmdShowCmdTemplateFlag := configCmdShowCmd.Flag("template", "With --effective, show this certificate template's create parameters instead of the default. Example: internal-mtls").String()
+
 	certificateCmd := app.Command("certificate", "Work with certificates")
 
 	certificateCreateCmd := certificateCmd.Command("create", "Create a certificate")
@@ -128,20 +437,152 @@ func run() error {
 	certificateCreateCmdSANsFlag := certificateCreateCmd.Flag("san", "DNS Subject Alternative Name. Example: www.bbkane.com").Strings()
 	certificateCreateCmdTagsFlag := certificateCreateCmd.Flag("tag", "Tags to add in key=value form. Example: mykey=myvalue").Short('t').Strings()
 	certificateCreateCmdValidityInMonthsFlag := certificateCreateCmd.Flag("validity", "Validity in months. Example: 6").Int32()
-	certificateCreateCmdEnabledFlag := certificateCreateCmd.Flag("enabled", "Enable certificate on creation").Short('e').Bool()
+	certificateCreateCmdEnabledFlag := optionalBoolFlag(certificateCreateCmd.Flag("enabled", "Enable (or with --no-enabled, disable) the certificate on creation. Defaults to the config").Short('e'))
 	certificateCreateCmdIssuerNameFlag := certificateCreateCmd.Flag("issuer-name", "CA Issuer name. Example: Self").String()
+	certificateCreateCmdKeyTypeFlag := certificateCreateCmd.Flag("key-type", "Key type: RSA, RSA-HSM, EC or EC-HSM. Example: EC").String()
+	certificateCreateCmdKeySizeFlag := certificateCreateCmd.Flag("key-size", "Key size in bits. For EC keys, 256, 384 and 521 pick the P-256, P-384 and P-521 curves. Example: 4096").Int32()
+	certificateCreateCmdExportableFlag := optionalBoolFlag(certificateCreateCmd.Flag("exportable", "Make the private key exportable (or with --no-exportable, not). Defaults to the config"))
+	certificateCreateCmdReuseKeyFlag := optionalBoolFlag(certificateCreateCmd.Flag("reuse-key", "Reuse the key pair on renewal (or with --no-reuse-key, don't). Defaults to the config"))
+	certificateCreateCmdContentTypeFlag := certificateCreateCmd.Flag("content-type", "Secret content type: application/x-pkcs12 or application/x-pem-file. Example: application/x-pem-file").String()
+	certificateCreateCmdLifetimeActionFlag := certificateCreateCmd.Flag("lifetime-action", "Lifetime action as <action>@<days before expiry>d or <action>@<lifetime percentage>%. Repeatable. Replaces the config's. Pass none to remove them. Example: AutoRenew@30d").Strings()
+	certificateCreateCmdTemplateFlag := certificateCreateCmd.Flag("template", "Name of a certificate_templates entry in the config to create from. Defaults to the vault's certificate_template, then certificate_create_parameters. Example: internal-mtls").String()
 	certificateCreateCmdNewVersionOkFlag := certificateCreateCmd.Flag("new-version-ok", "Confirm it's ok to create a new version of a certificate").Bool()
 	certificateCreateCmdSkipConfirmationFlag := certificateCreateCmd.Flag("skip-confirmation", "Create cert without prompting for confirmation").Bool()
+	certificateCreateCmdWaitFlag := certificateCreateCmd.Flag("wait", "Wait until the certificate is issued (or the operation fails) and print its thumbprint and expiry").Bool()
+	certificateCreateCmdWaitTimeoutFlag := certificateCreateCmd.Flag("wait-timeout", "Give up on --wait after this long. Example: 1h").Default(kvcrutch.DefaultWaitTimeout).String()
+
+	certificateListCmd := certificateCmd.Command("list", "List all certificates in a keyvault. Filters are combined with AND")
+	certificateListCmdTagFlag := certificateListCmd.Flag("tag", "Only list certificates with this tag. Pass just the key to match any value. Example: owner=me").Short('t').Strings()
+	certificateListCmdNameGlobFlag := certificateListCmd.Flag("name-glob", "Only list certificates with names matching this glob. Example: 'api-*'").String()
+	certificateListCmdEnabledFlag := certificateListCmd.Flag("enabled", "Only list enabled certificates").Bool()
+	certificateListCmdDisabledFlag := certificateListCmd.Flag("disabled", "Only list disabled certificates").Bool()
+	certificateListCmdExpiresWithinFlag := certificateListCmd.Flag("expires-within", "Only list certificates expiring within this duration (including expired ones). Example: 30d").String()
+	certificateListCmdExpiredFlag := certificateListCmd.Flag("expired", "Only list expired certificates").Bool()
+	certificateListCmdDetailedFlag := certificateListCmd.Flag("detailed", "Also fetch each certificate for its subject, SANs, issuer and key. Adds a details field").Bool()
+	certificateListCmdConcurrencyFlag := certificateListCmd.Flag("concurrency", "Max certificates to fetch at once with --detailed").Default("10").Int()
+	certificateListCmdAllVaultsFlag := certificateListCmd.Flag("all-vaults", "List certificates in every vault in the config's vaults section").Bool()
+	certificateListCmdOutputFlag := certificateListCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputJSONL).Enum(kvcrutch.ListOutputFormats...)
+	certificateListCmdFieldsFlag := certificateListCmd.Flag("fields", "Comma separated fields to print. Dots select nested fields. Example: name,attributes.expires,tags.owner").String()
+
+	certificateFindCmd := certificateCmd.Command("find", "Find certificates whose latest version covers a hostname, by SAN (including wildcards) or CN")
+	certificateFindCmdHostFlag := certificateFindCmd.Flag("host", "Hostname to search for. Repeatable. Example: api.example.com").Short('H').Required().Strings()
+	certificateFindCmdAlsoVaultFlag := certificateFindCmd.Flag("also-vault", "Another vault alias, name or URL to search too. Repeatable. Example: prod-wus2").Strings()
+	certificateFindCmdConcurrencyFlag := certificateFindCmd.Flag("concurrency", "Max certificates to fetch at once").Default("10").Int()
+	certificateFindCmdAllVaultsFlag := certificateFindCmd.Flag("all-vaults", "Search every vault in the config's vaults section").Bool()
+	certificateFindCmdOutputFlag := certificateFindCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputTable).Enum(kvcrutch.ListOutputFormats...)
+	certificateFindCmdFieldsFlag := certificateFindCmd.Flag("fields", "Comma separated fields to print. Example: name,match,tags.owner").String()
 
-	certificateListCmd := certificateCmd.Command("list", "List all certificates in a keyvault")
+	certificateExpiringCmd := certificateCmd.Command("expiring", "Report enabled certificates expiring soon, grouped into expired, critical and warning buckets. Exits 2 for warning, 3 for critical and 4 for expired certificates")
+	certificateExpiringCmdWithinFlag := certificateExpiringCmd.Flag("within", "Report certificates expiring within this duration. Example: 30d").Default("30d").String()
+	certificateExpiringCmdCriticalFlag := certificateExpiringCmd.Flag("critical", "Certificates expiring within this duration are critical. Example: 7d").Default("7d").String()
+	certificateExpiringCmdOwnerTagFlag := certificateExpiringCmd.Flag("owner-tag", "Tag holding a certificate's owner. Repeatable, first match wins. Example: owner").Default("owner").Strings()
+	certificateExpiringCmdIncludeDisabledFlag := certificateExpiringCmd.Flag("include-disabled", "Also report disabled certificates").Bool()
+	certificateExpiringCmdAllVaultsFlag := certificateExpiringCmd.Flag("all-vaults", "Report on every vault in the config's vaults section").Bool()
+	certificateExpiringCmdOutputFlag := certificateExpiringCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputTable).Enum(kvcrutch.ListOutputFormats...)
+	certificateExpiringCmdFieldsFlag := certificateExpiringCmd.Flag("fields", "Comma separated fields to print. Example: bucket,name,tags.team").String()
 
 	certificateNewVersionCmd := certificateCmd.Command("new-version", "Create a new version of an existing certificate. Preserves tags, unlike creating a new version from the web portal. This command is most useful after changing the Issuance Policy of an existing certificate.")
 	certificateNewVersionCmdNameFlag := certificateNewVersionCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateNewVersionCmdAddSANsFlag := certificateNewVersionCmd.Flag("add-san", "DNS Subject Alternative Name to add. Example: new.example.com").Strings()
+	certificateNewVersionCmdRmSANsFlag := certificateNewVersionCmd.Flag("rm-san", "DNS Subject Alternative Name to remove. Example: old.example.com").Strings()
+	certificateNewVersionCmdAddTagsFlag := certificateNewVersionCmd.Flag("add-tag", "Tag to add or change in key=value form. Example: mykey=myvalue").Strings()
+	certificateNewVersionCmdRmTagsFlag := certificateNewVersionCmd.Flag("rm-tag", "Tag key to remove. Example: mykey").Strings()
+	certificateNewVersionCmdValidityInMonthsFlag := certificateNewVersionCmd.Flag("validity", "New validity in months. Example: 6").Int32()
 	certificateNewVersionSkipConfirmationFlag := certificateNewVersionCmd.Flag("skip-confirmation", "Create cert without prompting for confirmation").Bool()
+	certificateNewVersionCmdWaitFlag := certificateNewVersionCmd.Flag("wait", "Wait until the certificate is issued (or the operation fails) and print its thumbprint and expiry").Bool()
+	certificateNewVersionCmdWaitTimeoutFlag := certificateNewVersionCmd.Flag("wait-timeout", "Give up on --wait after this long. Example: 1h").Default(kvcrutch.DefaultWaitTimeout).String()
+
+	fakeServerCmd := app.Command("fake-server", "Serve an in-memory fake of the Key Vault certificate REST API for offline testing. Doesn't need a config")
+	fakeServerCmdListenFlag := fakeServerCmd.Flag("listen", "Address to listen on. Example: 127.0.0.1:8443").Default("127.0.0.1:8443").String()
+	fakeServerCmdPageSizeFlag := fakeServerCmd.Flag("page-size", "Max items per list page. Example: 25").Default("25").Int()
+	fakeServerCmdCACertOutFlag := fakeServerCmd.Flag("ca-cert-out", "Write the server's self-signed TLS certificate here so clients can trust it. Example: ./fake-server.pem").String()
+	fakeServerCmdPlainHTTPFlag := fakeServerCmd.Flag("plain-http", "Serve plain HTTP instead of HTTPS").Bool()
+	fakeServerCmdIssueDelayFlag := fakeServerCmd.Flag("issue-delay", "Keep certificate operations for issuers other than Self in progress this long, like a real CA. Example: 20s").Default("0s").Duration()
+
+	certificateShowCmd := certificateCmd.Command("show", "Show a certificate's attributes, tags, policy and X.509 details")
+	certificateShowCmdNameFlag := certificateShowCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateShowCmdVersionFlag := certificateShowCmd.Flag("version", "certificate version. Defaults to the latest version").String()
+	certificateShowCmdOutputFlag := certificateShowCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputTable).Enum(kvcrutch.ShowOutputFormats...)
+
+	certificateVersionsCmd := certificateCmd.Command("versions", "List every version of a certificate, oldest first")
+	certificateVersionsCmdNameFlag := certificateVersionsCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateVersionsCmdDiffFlag := certificateVersionsCmd.Flag("diff", "Show how the tags and enabled attribute changed between consecutive versions. Fetches every version").Bool()
+	certificateVersionsCmdOutputFlag := certificateVersionsCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputTable).Enum(kvcrutch.ShowOutputFormats...)
+
+	certificateDownloadCmd := certificateCmd.Command("download", "Download a certificate, and for exportable keys, its private key and chain")
+	certificateDownloadCmdNameFlag := certificateDownloadCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateDownloadCmdVersionFlag := certificateDownloadCmd.Flag("version", "certificate version. Defaults to the latest version").String()
+	certificateDownloadCmdFormatFlag := certificateDownloadCmd.Flag("format", "pem: <name>.crt, plus <name>.key and <name>.chain.pem for exportable keys. der: <name>.cer. pfx: <name>.pfx. pem-bundle: <name>.pem with the key, certificate and chain").Short('f').Default(kvcrutch.DownloadPEM).Enum(kvcrutch.DownloadFormats...)
+	certificateDownloadCmdOutDirFlag := certificateDownloadCmd.Flag("out-dir", "Directory to write files to. Created if it doesn't exist. Example: ./certs").Default(".").String()
+	certificateDownloadCmdPasswordEnvFlag := certificateDownloadCmd.Flag("password-env", "Encrypt the PFX with the password in this environment variable. Example: PFX_PASSWORD").String()
+	certificateDownloadCmdOverwriteFlag := certificateDownloadCmd.Flag("overwrite", "Replace existing files").Bool()
+
+	certificateCSRCmd := certificateCmd.Command("csr", "Write a pending certificate's CSR as PEM, to sign with a CA Key Vault doesn't integrate with. Create the certificate with --issuer-name Unknown first")
+	certificateCSRCmdNameFlag := certificateCSRCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateCSRCmdOutFlag := certificateCSRCmd.Flag("out", "File to write the CSR to. Defaults to stdout. Example: ./my-cert.csr").String()
+
+	certificateMergeCmd := certificateCmd.Command("merge", "Merge a certificate signed from the CSR of a pending certificate, completing it")
+	certificateMergeCmdNameFlag := certificateMergeCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateMergeCmdCertFlag := certificateMergeCmd.Flag("cert", "Signed certificate as PEM or DER. PEM files can include the chain after it. Example: ./signed.pem").Required().String()
+	certificateMergeCmdChainFlag := certificateMergeCmd.Flag("chain", "PEM file of intermediate (and optionally root) certificates, ordered from the one that signed --cert up. Example: ./chain.pem").String()
+
+	certificateImportCmd := certificateCmd.Command("import", "Import certificates with their private keys from PFX or PEM files, with tags and lifetime actions from the config")
+	certificateImportCmdNameFlag := certificateImportCmd.Flag("name", "certificate name in keyvault. Needs --file. Example: my-cert").Short('n').String()
+	certificateImportCmdFileFlag := certificateImportCmd.Flag("file", "PFX file, or PEM file with the private key, certificate and chain concatenated. Example: ./my-cert.pfx").String()
+	certificateImportCmdDirFlag := certificateImportCmd.Flag("dir", "Import every .pfx, .p12 and .pem file in this directory, named after the file. Example: ./certs").String()
+	certificateImportCmdPasswordEnvFlag := certificateImportCmd.Flag("password-env", "Decrypt PFX files with the password in this environment variable. Example: PFX_PASSWORD").String()
+	certificateImportCmdTagsFlag := certificateImportCmd.Flag("tag", "Tags to add in key=value form. Replaces the config's. Example: mykey=myvalue").Short('t').Strings()
+	certificateImportCmdEnabledFlag := optionalBoolFlag(certificateImportCmd.Flag("enabled", "Enable (or with --no-enabled, disable) the certificate on import. Defaults to the config").Short('e'))
+	certificateImportCmdIssuerNameFlag := certificateImportCmd.Flag("issuer-name", "CA Issuer name for renewals. Defaults to Unknown, not the config's. Example: DigiCert").String()
+	certificateImportCmdLifetimeActionFlag := certificateImportCmd.Flag("lifetime-action", "Lifetime action as <action>@<days before expiry>d or <action>@<lifetime percentage>%. Repeatable. Replaces the config's. Pass none to remove them. Example: EmailContacts@30d").Strings()
+	certificateImportCmdTemplateFlag := certificateImportCmd.Flag("template", "Name of a certificate_templates entry in the config to take tags and lifetime actions from. Example: internal-mtls").String()
+	certificateImportCmdNewVersionOkFlag := certificateImportCmd.Flag("new-version-ok", "Confirm it's ok to import a new version of an existing certificate").Bool()
+	certificateImportCmdSkipConfirmationFlag := certificateImportCmd.Flag("skip-confirmation", "Import without prompting for confirmation").Bool()
+
+	certificateOperationCmd := certificateCmd.Command("operation", "Work with a certificate's pending (or last) create operation")
+
+	certificateOperationStatusCmd := certificateOperationCmd.Command("status", "Show a certificate operation's status without waiting")
+	certificateOperationStatusCmdNameFlag := certificateOperationStatusCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateOperationStatusCmdOutputFlag := certificateOperationStatusCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputTable).Enum(kvcrutch.ShowOutputFormats...)
+
+	certificateOperationWaitCmd := certificateOperationCmd.Command("wait", "Wait for a certificate operation to complete, fail or be cancelled. Exits 1 unless the certificate was issued")
+	certificateOperationWaitCmdNameFlag := certificateOperationWaitCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateOperationWaitCmdTimeoutFlag := certificateOperationWaitCmd.Flag("wait-timeout", "Give up after this long. Example: 1h").Default(kvcrutch.DefaultWaitTimeout).String()
+	certificateOperationWaitCmdOutputFlag := certificateOperationWaitCmd.Flag("output", "Output format").Short('o').Default(kvcrutch.OutputTable).Enum(kvcrutch.ShowOutputFormats...)
+
+	certificateOperationCancelCmd := certificateOperationCmd.Command("cancel", "Request cancellation of an in progress certificate operation")
+	certificateOperationCancelCmdNameFlag := certificateOperationCancelCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateOperationCancelCmdSkipConfirmationFlag := certificateOperationCancelCmd.Flag("skip-confirmation", "Cancel without prompting for confirmation").Bool()
+
+	certificateOperationDeleteCmd := certificateOperationCmd.Command("delete", "Delete a certificate operation, stopping it if it's in progress. Issued versions aren't touched")
+	certificateOperationDeleteCmdNameFlag := certificateOperationDeleteCmd.Flag("name", "certificate name in keyvault. Example: my-cert").Short('n').Required().String()
+	certificateOperationDeleteCmdSkipConfirmationFlag := certificateOperationDeleteCmd.Flag("skip-confirmation", "Delete without prompting for confirmation").Bool()
+
+	exporterCmd := app.Command("exporter", "Export certificate expiry as Prometheus metrics, either by serving /metrics or writing a node_exporter textfile")
+	exporterCmdListenFlag := exporterCmd.Flag("listen", "Address to serve /metrics on. Example: :9865").Default(":9865").String()
+	exporterCmdTextfileFlag := exporterCmd.Flag("textfile", "Instead of serving, write metrics once to this file for node_exporter's textfile collector. Example: /var/lib/node_exporter/kvcrutch.prom").String()
+	exporterCmdIntervalFlag := exporterCmd.Flag("interval", "How often to list certificates. Overrides the config. Example: 5m").String()
+	exporterCmdLabelTagFlag := exporterCmd.Flag("label-tag", "Certificate tag to add as a tag_<name> label. Repeatable. Overrides the config. Example: owner").Strings()
+	exporterCmdAllVaultsFlag := exporterCmd.Flag("all-vaults", "Export every vault in the config's vaults section").Bool()
+	exporterCmdAlsoVaultFlag := exporterCmd.Flag("also-vault", "Another vault alias, name or URL to export. Repeatable. Added to the config's exporter.vaults. Example: prod-wus2").Strings()
 
 	versionCmd := app.Command("version", "Print kvcrutch build and version information")
 
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	cmdLine, err := cmdLineFlags(app, os.Args[1:])
+	if err != nil {
+		logos.Errorw(
+			"Can't parse flags",
+			"err", err,
+		)
+		return err
+	}
+	appVaultFlags := vaultFlags{
+		Alias:   *appVaultFlag,
+		Name:    *appVaultNameFlag,
+		URL:     *appVaultURLFlag,
+		cmdLine: cmdLine,
+	}
 
 	// work with commands that don't have dependencies (version, editConfig)
 	configPath, err := homedir.Expand(*appConfigPathFlag)
@@ -188,6 +629,25 @@ func run() error {
 		return nil
 	}
 
+	if cmd == fakeServerCmd.FullCommand() {
+		// no config, so no log file
+		logger := logos.NewLogger(
+			logos.NewZapSugaredLogger(
+				nil, zap.DebugLevel, version,
+			),
+		)
+		defer logger.Sync()
+		logger.LogOnPanic()
+		return kvcrutch.FakeServer(
+			logger,
+			*fakeServerCmdListenFlag,
+			*fakeServerCmdPageSizeFlag,
+			*fakeServerCmdCACertOutFlag,
+			*fakeServerCmdPlainHTTPFlag,
+			*fakeServerCmdIssueDelayFlag,
+		)
+	}
+
 	if cmd == versionCmd.FullCommand() {
 		logos.Infow(
 			"Version and build information",
@@ -199,10 +659,14 @@ func run() error {
 		return nil
 	}
 
-	// get a config
+	// get a config. Precedence is flags > env > config file > embedded
+	// defaults (only used without a config file)
 	configBytes, cfgLoadErr := ioutil.ReadFile(configPath)
 	if cfgLoadErr != nil {
-		if cfgLoadErr != nil {
+		if os.IsNotExist(cfgLoadErr) && *appConfigPathFlag == defaultConfigPath {
+			configBytes = embeddedConfig
+			configPath = embeddedConfigPath
+		} else {
 			logos.Errorw(
 				"Config error - try `config edit`",
 				"cfgLoadErr", cfgLoadErr,
@@ -212,8 +676,57 @@ func run() error {
 		}
 	}
 
-	lumberjackLogger, cfgVaultName, cfgCertCreateParams, cfgParseErr := parseConfig(configBytes)
+	envOverrides, unknownEnvars, err := kvcrutch.ConfigEnvOverrides(os.Environ(), globalFlagEnvars(app), configKeys())
+	if err != nil {
+		logos.Errorw(
+			"Can't read "+kvcrutch.EnvPrefix+"* environment variables",
+			"err", err,
+		)
+		return err
+	}
+	for _, name := range unknownEnvars {
+		logos.Infow(
+			"Skipping environment variable that doesn't start with a config key",
+			"name", name,
+		)
+	}
+
+	if cmd == configCmdValidateCmd.FullCommand() {
+		problems := validateConfig(configBytes, envOverrides)
+		// file:line: like compilers, so editors can jump to them
+		for _, p := range problems {
+			if p.Line == 0 {
+				fmt.Printf("%s: %s\n", configPath, p)
+				continue
+			}
+			line := p.Line
+			p.Line = 0
+			fmt.Printf("%s:%d: %s\n", configPath, line, p)
+		}
+		if len(problems) > 0 {
+			err = errors.Errorf("%d problems in config", len(problems))
+			logos.Errorw(
+				"Invalid config",
+				"configPath", configPath,
+				"err", err,
+			)
+			return err
+		}
+		logos.Infow(
+			"Config is valid",
+			"configPath", configPath,
+		)
+		return nil
+	}
+
+	cfg, cfgParseErr := parseConfig(configBytes, envOverrides)
 	if cfgParseErr != nil {
+		if problems, ok := cfgParseErr.(kvcrutch.ValidationErrors); ok {
+			for _, p := range problems {
+				fmt.Fprintln(os.Stderr, p)
+			}
+			cfgParseErr = errors.Errorf("%d problems in environment variables", len(problems))
+		}
 		logos.Errorw(
 			"Can't parse config",
 			"err", cfgParseErr,
@@ -224,19 +737,12 @@ func run() error {
 	// get a logger
 	logger := logos.NewLogger(
 		logos.NewZapSugaredLogger(
-			lumberjackLogger, zap.DebugLevel, version,
+			cfg.LumberjackLogger, zap.DebugLevel, version,
 		),
 	)
 	defer logger.Sync()
 	logger.LogOnPanic()
 
-	// get a keyvault client
-	kvClient, err := kvcrutch.PrepareKV(logger)
-	if err != nil {
-		err := errors.WithStack(err)
-		return err
-	}
-
 	// get a timeout
 	timeout, err := time.ParseDuration(*appTimeout)
 	if err != nil {
@@ -248,42 +754,89 @@ func run() error {
 		return err
 	}
 
-	// get the vaultURL
-	vaultName := cfgVaultName
-	if *appVaultNameFlag != "" {
-		vaultName = *appVaultNameFlag
+	if cmd == configCmdShowCmd.FullCommand() {
+		return configShow(
+			cfg,
+			configPath,
+			envOverrides,
+			*configCmdShowCmdEffectiveFlag,
+			appVaultFlags,
+			*appAuthModeFlag,
+			*appCABundleFlag,
+			timeout,
+			*configCmdShowCmdTemplateFlag,
+		)
 	}
-	vaultFQDN := vaultName + ".vault.azure.net"
-	port := "443"
-	// Quick test to make sure we can connect
-	conn, err := tls.DialWithDialer(
-		&net.Dialer{Timeout: timeout},
-		"tcp",
-		net.JoinHostPort(vaultFQDN, port),
-		nil,
+
+	// get the vaults
+	allVaults := false
+	var extraVaultRefs []string
+	switch cmd {
+	case certificateListCmd.FullCommand():
+		allVaults = *certificateListCmdAllVaultsFlag
+	case certificateExpiringCmd.FullCommand():
+		allVaults = *certificateExpiringCmdAllVaultsFlag
+	case certificateFindCmd.FullCommand():
+		allVaults = *certificateFindCmdAllVaultsFlag
+		extraVaultRefs = *certificateFindCmdAlsoVaultFlag
+	case exporterCmd.FullCommand():
+		allVaults = *exporterCmdAllVaultsFlag
+		// copy so cfg.Exporter.Vaults' backing array isn't written to
+		extraVaultRefs = append(append([]string(nil), cfg.Exporter.Vaults...), *exporterCmdAlsoVaultFlag...)
+	}
+	targets, err := selectVaultTargets(
+		cfg,
+		appVaultFlags,
+		allVaults,
+		extraVaultRefs,
 	)
 	if err != nil {
-		err = errors.WithStack(err)
 		logger.Errorw(
-			"can't connect to vault",
-			"vaultFQDN", vaultFQDN,
-			"port", port,
-			"timeout", timeout,
+			"can't pick a vault. Pass --vault, --vault-name or --vault-url, or set default_vault in the config",
+			"vault", *appVaultFlag,
+			"vaultName", *appVaultNameFlag,
+			"vaultURL", *appVaultURLFlag,
+			"allVaults", allVaults,
 			"err", err,
 		)
 		return err
 	}
-	err = conn.Close()
+
+	caBundlePath := cfg.CABundlePath
+	if *appCABundleFlag != "" {
+		caBundlePath = *appCABundleFlag
+	}
+	tlsConfig, err := kvcrutch.NewTLSConfig(caBundlePath)
 	if err != nil {
-		err = errors.WithStack(err)
 		logger.Errorw(
-			"can't close connection",
-			"conn", conn,
+			"can't load CA bundle",
+			"caBundlePath", caBundlePath,
 			"err", err,
 		)
 		return err
 	}
-	vaultURL := "https://" + vaultFQDN
+
+	// get keyvault clients
+	vaults, failedVaults, err := kvcrutch.ConnectVaults(
+		logger,
+		targets,
+		cfg.Auth,
+		*appAuthModeFlag,
+		cfg.VaultDNSSuffix,
+		tlsConfig,
+		timeout,
+	)
+	// the exporter reports vaults it can't connect to instead of stopping
+	if err != nil && !(cmd == exporterCmd.FullCommand() && len(failedVaults) > 0) {
+		return err
+	}
+	// most commands work with one vault
+	var vaultURL string
+	var kvClient kvcrutch.KeyVaultClient
+	if len(vaults) > 0 {
+		vaultURL = vaults[0].URL
+		kvClient = vaults[0].Client
+	}
 
 	// dispatch commands that use dependencies
 	switch cmd {
@@ -297,13 +850,46 @@ func run() error {
 			)
 			return err
 		}
+		flagLifetimeActions, err := kvcrutch.ParseLifetimeActions(*certificateCreateCmdLifetimeActionFlag)
+		if err != nil {
+			logger.Errorw(
+				"flag parsing error",
+				"err", err,
+			)
+			return err
+		}
 		flagCertCreateParams := kvcrutch.FlagCertificateCreateParameters{
 			Subject:          *certificateCreateCmdSubjectFlag,
 			Sans:             *certificateCreateCmdSANsFlag,
 			Tags:             flagTagsMap,
 			ValidityInMonths: *certificateCreateCmdValidityInMonthsFlag,
-			Enabled:          *certificateCreateCmdEnabledFlag,
+			Enabled:          certificateCreateCmdEnabledFlag.value,
 			IssuerName:       *certificateCreateCmdIssuerNameFlag,
+			Exportable:       certificateCreateCmdExportableFlag.value,
+			KeyType:          *certificateCreateCmdKeyTypeFlag,
+			KeySize:          *certificateCreateCmdKeySizeFlag,
+			ReuseKey:         certificateCreateCmdReuseKeyFlag.value,
+			ContentType:      *certificateCreateCmdContentTypeFlag,
+			LifetimeActions:  flagLifetimeActions,
+		}
+
+		cfgCertCreateParams, templateName, err := certificateCreateParams(cfg, *certificateCreateCmdTemplateFlag, vaults[0].Alias)
+		if err != nil {
+			logger.Errorw(
+				"can't use certificate template",
+				"template", templateName,
+				"err", err,
+			)
+			return err
+		}
+
+		waitTimeout, err := parseWaitTimeout(*certificateCreateCmdWaitFlag, *certificateCreateCmdWaitTimeoutFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't parse --wait-timeout",
+				"err", err,
+			)
+			return err
 		}
 
 		return kvcrutch.CertificateCreate(
@@ -316,23 +902,310 @@ func run() error {
 			flagCertCreateParams,
 			*certificateCreateCmdNewVersionOkFlag,
 			*certificateCreateCmdSkipConfirmationFlag,
+			waitTimeout,
 		)
 
 	case certificateListCmd.FullCommand():
-		return kvcrutch.CertificateList(
+		filter, err := buildCertificateFilter(
+			*certificateListCmdTagFlag,
+			*certificateListCmdNameGlobFlag,
+			*certificateListCmdEnabledFlag,
+			*certificateListCmdDisabledFlag,
+			*certificateListCmdExpiresWithinFlag,
+			*certificateListCmdExpiredFlag,
+		)
+		if err != nil {
+			logger.Errorw(
+				"flag parsing error",
+				"err", err,
+			)
+			return err
+		}
+		err = kvcrutch.CertificateList(
 			logger,
-			kvClient,
-			vaultURL,
+			vaults,
+			timeout,
+			filter,
+			*certificateListCmdDetailedFlag,
+			*certificateListCmdConcurrencyFlag,
+			*certificateListCmdOutputFlag,
+			kvcrutch.ParseFields(*certificateListCmdFieldsFlag),
+		)
+		return withFailedVaults(logger, err, failedVaults)
+	case certificateFindCmd.FullCommand():
+		err = kvcrutch.CertificateFind(
+			logger,
+			vaults,
+			timeout,
+			*certificateFindCmdHostFlag,
+			*certificateFindCmdConcurrencyFlag,
+			*certificateFindCmdOutputFlag,
+			kvcrutch.ParseFields(*certificateFindCmdFieldsFlag),
+		)
+		return withFailedVaults(logger, err, failedVaults)
+	case certificateExpiringCmd.FullCommand():
+		within, err := kvcrutch.ParseDuration(*certificateExpiringCmdWithinFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't parse --within",
+				"err", err,
+			)
+			return err
+		}
+		critical, err := kvcrutch.ParseDuration(*certificateExpiringCmdCriticalFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't parse --critical",
+				"err", err,
+			)
+			return err
+		}
+		err = kvcrutch.CertificateExpiring(
+			logger,
+			vaults,
+			timeout,
+			kvcrutch.ExpiryThresholds{
+				Within:    within,
+				Critical:  critical,
+				OwnerTags: *certificateExpiringCmdOwnerTagFlag,
+			},
+			*certificateExpiringCmdIncludeDisabledFlag,
+			*certificateExpiringCmdOutputFlag,
+			kvcrutch.ParseFields(*certificateExpiringCmdFieldsFlag),
+		)
+		return withFailedVaults(logger, err, failedVaults)
+	case exporterCmd.FullCommand():
+		intervalStr := kvcrutch.DefaultExporterInterval
+		if cfg.Exporter.Interval != "" {
+			intervalStr = cfg.Exporter.Interval
+		}
+		if *exporterCmdIntervalFlag != "" {
+			intervalStr = *exporterCmdIntervalFlag
+		}
+		interval, err := kvcrutch.ParseDuration(intervalStr)
+		if err != nil {
+			logger.Errorw(
+				"can't parse interval",
+				"interval", intervalStr,
+				"err", err,
+			)
+			return err
+		}
+		labelTags := cfg.Exporter.LabelTags
+		if len(*exporterCmdLabelTagFlag) > 0 {
+			labelTags = *exporterCmdLabelTagFlag
+		}
+		return kvcrutch.RunExporter(
+			logger,
+			vaults,
+			failedVaults,
 			timeout,
+			labelTags,
+			interval,
+			*exporterCmdListenFlag,
+			*exporterCmdTextfileFlag,
 		)
 	case certificateNewVersionCmd.FullCommand():
+		flagAddTagsMap, err := kvcrutch.ParseTags(*certificateNewVersionCmdAddTagsFlag)
+		if err != nil {
+			err := errors.WithStack(err)
+			logger.Errorw(
+				"flag parsing error",
+				"err", err,
+			)
+			return err
+		}
+		waitTimeout, err := parseWaitTimeout(*certificateNewVersionCmdWaitFlag, *certificateNewVersionCmdWaitTimeoutFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't parse --wait-timeout",
+				"err", err,
+			)
+			return err
+		}
 		return kvcrutch.CertificateNewVersion(
 			logger,
 			kvClient,
 			vaultURL,
 			*certificateNewVersionCmdNameFlag,
 			timeout,
+			kvcrutch.FlagNewVersionChanges{
+				AddSans:          *certificateNewVersionCmdAddSANsFlag,
+				RmSans:           *certificateNewVersionCmdRmSANsFlag,
+				AddTags:          flagAddTagsMap,
+				RmTags:           *certificateNewVersionCmdRmTagsFlag,
+				ValidityInMonths: *certificateNewVersionCmdValidityInMonthsFlag,
+			},
 			*certificateNewVersionSkipConfirmationFlag,
+			waitTimeout,
+		)
+	case certificateShowCmd.FullCommand():
+		return kvcrutch.CertificateShow(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateShowCmdNameFlag,
+			*certificateShowCmdVersionFlag,
+			*certificateShowCmdOutputFlag,
+		)
+	case certificateVersionsCmd.FullCommand():
+		return kvcrutch.CertificateVersions(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateVersionsCmdNameFlag,
+			*certificateVersionsCmdDiffFlag,
+			*certificateVersionsCmdOutputFlag,
+		)
+	case certificateOperationStatusCmd.FullCommand():
+		return kvcrutch.CertificateOperationStatus(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateOperationStatusCmdNameFlag,
+			*certificateOperationStatusCmdOutputFlag,
+		)
+	case certificateOperationWaitCmd.FullCommand():
+		waitTimeout, err := parseWaitTimeout(true, *certificateOperationWaitCmdTimeoutFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't parse --wait-timeout",
+				"err", err,
+			)
+			return err
+		}
+		return kvcrutch.CertificateOperationWait(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateOperationWaitCmdNameFlag,
+			waitTimeout,
+			*certificateOperationWaitCmdOutputFlag,
+		)
+	case certificateDownloadCmd.FullCommand():
+		pfxPassword, err := passwordFromEnv(*certificateDownloadCmdPasswordEnvFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't read --password-env",
+				"err", err,
+			)
+			return err
+		}
+		return kvcrutch.CertificateDownload(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateDownloadCmdNameFlag,
+			*certificateDownloadCmdVersionFlag,
+			*certificateDownloadCmdFormatFlag,
+			*certificateDownloadCmdOutDirFlag,
+			pfxPassword,
+			*certificateDownloadCmdOverwriteFlag,
+		)
+	case certificateCSRCmd.FullCommand():
+		return kvcrutch.CertificateCSR(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateCSRCmdNameFlag,
+			*certificateCSRCmdOutFlag,
+		)
+	case certificateMergeCmd.FullCommand():
+		return kvcrutch.CertificateMerge(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateMergeCmdNameFlag,
+			*certificateMergeCmdCertFlag,
+			*certificateMergeCmdChainFlag,
+		)
+	case certificateImportCmd.FullCommand():
+		targets, err := importTargets(*certificateImportCmdNameFlag, *certificateImportCmdFileFlag, *certificateImportCmdDirFlag)
+		if err != nil {
+			logger.Errorw(
+				"flag parsing error",
+				"err", err,
+			)
+			return err
+		}
+		password, err := passwordFromEnv(*certificateImportCmdPasswordEnvFlag)
+		if err != nil {
+			logger.Errorw(
+				"can't read --password-env",
+				"err", err,
+			)
+			return err
+		}
+		flagTagsMap, err := kvcrutch.ParseTags(*certificateImportCmdTagsFlag)
+		if err != nil {
+			err := errors.WithStack(err)
+			logger.Errorw(
+				"flag parsing error",
+				"err", err,
+			)
+			return err
+		}
+		flagLifetimeActions, err := kvcrutch.ParseLifetimeActions(*certificateImportCmdLifetimeActionFlag)
+		if err != nil {
+			logger.Errorw(
+				"flag parsing error",
+				"err", err,
+			)
+			return err
+		}
+		flagCertCreateParams := kvcrutch.FlagCertificateCreateParameters{
+			Tags:            flagTagsMap,
+			Enabled:         certificateImportCmdEnabledFlag.value,
+			IssuerName:      *certificateImportCmdIssuerNameFlag,
+			LifetimeActions: flagLifetimeActions,
+		}
+
+		cfgCertCreateParams, templateName, err := certificateCreateParams(cfg, *certificateImportCmdTemplateFlag, vaults[0].Alias)
+		if err != nil {
+			logger.Errorw(
+				"can't use certificate template",
+				"template", templateName,
+				"err", err,
+			)
+			return err
+		}
+
+		return kvcrutch.CertificateImport(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			targets,
+			cfgCertCreateParams,
+			flagCertCreateParams,
+			password,
+			*certificateImportCmdNewVersionOkFlag,
+			*certificateImportCmdSkipConfirmationFlag,
+		)
+	case certificateOperationCancelCmd.FullCommand():
+		return kvcrutch.CertificateOperationCancel(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateOperationCancelCmdNameFlag,
+			*certificateOperationCancelCmdSkipConfirmationFlag,
+		)
+	case certificateOperationDeleteCmd.FullCommand():
+		return kvcrutch.CertificateOperationDelete(
+			logger,
+			kvClient,
+			vaultURL,
+			timeout,
+			*certificateOperationDeleteCmdNameFlag,
+			*certificateOperationDeleteCmdSkipConfirmationFlag,
 		)
 	default:
 		err = errors.Errorf("Unknown command: %#v\n", cmd)
@@ -348,6 +1221,10 @@ func run() error {
 func main() {
 	err := run()
 	if err != nil {
+		var exitCodeErr *kvcrutch.ExitCodeError
+		if errors.As(err, &exitCodeErr) {
+			os.Exit(exitCodeErr.Code)
+		}
 		os.Exit(1)
 	}
 }